@@ -1,7 +1,8 @@
 package main
 
+import "time"
+
 type config struct {
-	MQTTBroker         string `env:"MQTT_BROKER"          envDefault:"tcp://localhost:1883"`
 	HTTPPort           string `env:"HTTP_SERVER_PORT"     envDefault:"8081"`
 	MetricsPort        string `env:"METRICS_PORT"         envDefault:"9092"`
 	ClickHouseAddr     string `env:"CLICKHOUSE_ADDR"      envDefault:"localhost:9000"`
@@ -12,4 +13,8 @@ type config struct {
 	RedisPassword      string `env:"REDIS_PASSWORD"       envDefault:""`
 	RedisDB            int    `env:"REDIS_DB"             envDefault:"0"`
 	CORSOrigin         string `env:"CORS_ORIGIN"          envDefault:"*"`
+	StreamQueueSize    int    `env:"STREAM_QUEUE_SIZE"    envDefault:"256"`
+	StreamReplaySize   int    `env:"STREAM_REPLAY_SIZE"   envDefault:"1024"`
+
+	ClusterResyncInterval time.Duration `env:"CLUSTER_RESYNC_INTERVAL" envDefault:"5m"`
 }
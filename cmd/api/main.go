@@ -1,39 +1,61 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v11"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sverdejot/beacon/internal/cache"
+	"github.com/sverdejot/beacon/internal/routing"
 	"github.com/sverdejot/beacon/internal/shared"
 	"github.com/sverdejot/beacon/internal/api"
 	"github.com/sverdejot/beacon/pkg/datex"
 )
 
-func stream(updateCh chan shared.MapLocation, deleteCh chan string) func(w http.ResponseWriter, r *http.Request) {
+func stream(hub *api.Hub, mapCache *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		clientIP := r.RemoteAddr
+
+		filter, err := api.ParseStreamFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		detail, err := routing.ParseDetail(r.URL.Query().Get("detail"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		slog.InfoContext(ctx, "sse client connected",
 			slog.String("client_ip", clientIP),
 			slog.String("user_agent", r.UserAgent()),
+			slog.Bool("filtered", !filter.Empty()),
 		)
 
+		sub, resumed := hub.Subscribe(filter, r.Header.Get("Last-Event-ID"))
 		api.SSEConnectionsTotal.Inc()
 		api.SSEConnectionsActive.Inc()
 		defer func() {
+			hub.Unsubscribe(sub)
 			api.SSEConnectionsActive.Dec()
-			slog.DebugContext(ctx, "sse client disconnected", slog.String("client_ip", clientIP))
+			slog.DebugContext(ctx, "sse client disconnected",
+				slog.String("client_ip", clientIP),
+				slog.Int64("delivered", sub.Delivered()),
+			)
 		}()
 
 		w.Header().Set("Content-Type", "text/event-stream")
@@ -41,6 +63,20 @@ func stream(updateCh chan shared.MapLocation, deleteCh chan string) func(w http.
 		w.Header().Set("Connection", "keep-alive")
 
 		rc := http.NewResponseController(w)
+
+		if resumed {
+			api.StreamResumes.WithLabelValues("replayed").Inc()
+		} else {
+			api.StreamResumes.WithLabelValues("snapshot").Inc()
+			if err := sendSnapshot(ctx, w, rc, mapCache, sub, detail); err != nil {
+				slog.WarnContext(ctx, "failed to send sse snapshot",
+					slog.String("client_ip", clientIP),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+		}
+
 		keepalive := time.NewTicker(15 * time.Second)
 		defer keepalive.Stop()
 
@@ -48,6 +84,9 @@ func stream(updateCh chan shared.MapLocation, deleteCh chan string) func(w http.
 			select {
 			case <-ctx.Done():
 				return
+			case <-sub.Evicted():
+				slog.WarnContext(ctx, "sse client too slow, disconnecting", slog.String("client_ip", clientIP))
+				return
 			case <-keepalive.C:
 				fmt.Fprint(w, ":keepalive\n\n") //nolint:errcheck
 				if err := rc.Flush(); err != nil {
@@ -57,41 +96,25 @@ func stream(updateCh chan shared.MapLocation, deleteCh chan string) func(w http.
 					)
 					return
 				}
-			case loc := <-updateCh:
-				data, err := json.Marshal(loc)
-				if err != nil {
-					slog.ErrorContext(ctx, "failed to marshal sse update event",
-						slog.String("incident_id", loc.ID),
-						slog.String("error", err.Error()),
-					)
-					continue
+			case ev := <-sub.Events():
+				var payload any = map[string]string{"id": ev.ID}
+				if ev.Type == api.EventUpdate {
+					payload = ev.Location.AtDetail(detail)
 				}
 
-				fmt.Fprintf(w, "event: update\ndata: %s\n\n", data) //nolint:errcheck
-				api.SSEEventsTotal.WithLabelValues("update").Inc()
-				err = rc.Flush()
-				if err != nil {
-					slog.DebugContext(ctx, "sse flush failed, client likely disconnected",
-						slog.String("client_ip", clientIP),
-						slog.String("error", err.Error()),
-					)
-					return
-				}
-			case id := <-deleteCh:
-				deleteData := map[string]string{"id": id}
-				data, err := json.Marshal(deleteData)
+				data, err := json.Marshal(payload)
 				if err != nil {
-					slog.ErrorContext(ctx, "failed to marshal sse delete event",
-						slog.String("incident_id", id),
+					slog.ErrorContext(ctx, "failed to marshal sse event",
+						slog.String("event", ev.Type),
+						slog.String("incident_id", ev.ID),
 						slog.String("error", err.Error()),
 					)
 					continue
 				}
 
-				fmt.Fprintf(w, "event: delete\ndata: %s\n\n", data) //nolint:errcheck
-				api.SSEEventsTotal.WithLabelValues("delete").Inc()
-				err = rc.Flush()
-				if err != nil {
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data) //nolint:errcheck
+				api.SSEEventsTotal.WithLabelValues(ev.Type).Inc()
+				if err := rc.Flush(); err != nil {
 					slog.DebugContext(ctx, "sse flush failed, client likely disconnected",
 						slog.String("client_ip", clientIP),
 						slog.String("error", err.Error()),
@@ -103,11 +126,56 @@ func stream(updateCh chan shared.MapLocation, deleteCh chan string) func(w http.
 	}
 }
 
+// sendSnapshot writes every cached location that passes the subscriber's
+// filter as a single snapshot event, tagged with the ID of the last event
+// published before the subscriber joined.
+func sendSnapshot(ctx context.Context, w http.ResponseWriter, rc *http.ResponseController, mapCache *cache.Cache, sub *api.Subscriber, detail routing.Detail) error {
+	matching, err := snapshot(ctx, mapCache, sub.Filter(), detail)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(matching)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: snapshot\ndata: %s\n\n", sub.Start(), data) //nolint:errcheck
+	api.SSEEventsTotal.WithLabelValues("snapshot").Inc()
+	return rc.Flush()
+}
+
+// snapshot returns every cached location that passes filter, with segment
+// paths encoded at detail. Bounded filters are answered from the geo index
+// instead of loading every incident.
+func snapshot(ctx context.Context, mapCache *cache.Cache, filter api.StreamFilter, detail routing.Detail) ([]shared.MapLocation, error) {
+	var (
+		locations []shared.MapLocation
+		err       error
+	)
+	if filter.BBox != nil {
+		locations, err = mapCache.GetMapLocationsInBBox(ctx, *filter.BBox)
+	} else {
+		locations, err = mapCache.GetAllMapLocations(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	matching := make([]shared.MapLocation, 0, len(locations))
+	for i := range locations {
+		if filter.Match(&locations[i]) {
+			matching = append(matching, locations[i].AtDetail(detail))
+		}
+	}
+	return matching, nil
+}
+
 func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Skip timeout for SSE endpoints (long-lived connections)
-			if r.URL.Path == "/sse" || r.URL.Path == "/sse/dashboard" {
+			if r.URL.Path == "/sse" || r.URL.Path == "/sse/dashboard" || r.URL.Path == "/ws" {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -148,6 +216,24 @@ func (rw *responseWriter) Unwrap() http.ResponseWriter {
 	return rw.ResponseWriter
 }
 
+// Hijack lets the WebSocket upgrader take over connections wrapped for metrics.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// metricsEndpoint collapses paths carrying IDs so they don't create a label
+// value per incident.
+func metricsEndpoint(path string) string {
+	if strings.HasPrefix(path, "/api/incidents/") {
+		return "/api/incidents/{id}"
+	}
+	if rest, ok := strings.CutPrefix(path, "/tiles/"); ok {
+		layer, _, _ := strings.Cut(rest, "/")
+		return "/tiles/" + layer
+	}
+	return path
+}
+
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -156,7 +242,7 @@ func metricsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 
 		duration := time.Since(start).Seconds()
-		endpoint := r.URL.Path
+		endpoint := metricsEndpoint(r.URL.Path)
 		method := r.Method
 		status := strconv.Itoa(rw.statusCode)
 
@@ -180,7 +266,6 @@ func main() {
 	}
 
 	slog.Info("configuration loaded",
-		slog.String("mqtt_broker", cfg.MQTTBroker),
 		slog.String("http_port", cfg.HTTPPort),
 		slog.String("metrics_port", cfg.MetricsPort),
 		slog.String("clickhouse_addr", cfg.ClickHouseAddr),
@@ -240,22 +325,30 @@ func main() {
 
 	dashboardHandler := api.NewHandler(dashboardRepo, mapCache)
 
-	slog.Info("connecting to mqtt broker", slog.String("broker", cfg.MQTTBroker))
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBroker)
-	client := mqtt.NewClient(opts)
-
-	if tok := client.Connect(); tok.Wait() && tok.Error() != nil {
-		slog.Error("failed to connect to mqtt broker", slog.String("error", tok.Error().Error()))
-		os.Exit(1)
+	if n, err := mapCache.RebuildGeoIndex(ctx); err != nil {
+		slog.Warn("failed to rebuild map geo index", slog.String("error", err.Error()))
+	} else {
+		slog.Info("rebuilt map geo index", slog.Int("incidents", n))
 	}
-	slog.Info("connected to mqtt broker")
 
-	updateCh, deleteCh := locationStream(client, mapCache)
+	hub := api.NewHub(cfg.StreamQueueSize, cfg.StreamReplaySize)
+	clusters := api.NewClusterIndex()
+	if locations, err := mapCache.GetAllMapLocations(ctx); err != nil {
+		slog.Warn("failed to seed stream hub from cache", slog.String("error", err.Error()))
+	} else {
+		hub.Seed(locations)
+		clusters.Reset(locations, hub.Seq())
+	}
+	hub.Observe(clusters.Apply)
+	go resyncLocations(ctx, mapCache, hub, clusters, cfg.ClusterResyncInterval)
+	go locationChanges(ctx, mapCache, hub)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /sse", stream(updateCh, deleteCh))
+	mux.HandleFunc("GET /sse", stream(hub, mapCache))
+	mux.HandleFunc("GET /ws", websocketStream(hub, mapCache, cfg.CORSOrigin))
 	mux.HandleFunc("GET /api/map/incidents", mapIncidents(mapCache))
+	mux.HandleFunc("GET /api/map/incidents/nearby", mapIncidentsNearby(mapCache))
+	mux.HandleFunc("GET /api/map/clusters", mapClusters(clusters))
 	dashboardHandler.RegisterRoutes(mux)
 
 	srv := &http.Server{
@@ -275,9 +368,6 @@ func main() {
 		srv.Shutdown(shutdownCtx) //nolint:errcheck
 		slog.Debug("http server stopped")
 
-		client.Disconnect(250)
-		slog.Debug("disconnected from mqtt broker")
-
 		dashboardRepo.Close() //nolint:errcheck
 		slog.Debug("closed clickhouse connection")
 
@@ -294,107 +384,216 @@ func main() {
 	}
 }
 
+const (
+	defaultNearbyRadius = 5000   // meters
+	maxNearbyRadius     = 100000 // meters
+	defaultNearbyLimit  = 50
+	maxNearbyLimit      = 500
+)
+
+// mapIncidents serves the active incidents, limited to those intersecting the
+// bbox query parameter when it is set.
 func mapIncidents(mapCache *cache.Cache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		api.MapIncidentsRequests.Inc()
 
-		locations, err := mapCache.GetAllMapLocations(ctx)
+		detail, err := routing.ParseDetail(r.URL.Query().Get("detail"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var locations []shared.MapLocation
+		if raw := r.URL.Query().Get("bbox"); raw != "" {
+			bbox, perr := shared.ParseBBox(raw)
+			if perr != nil {
+				writeJSONError(w, http.StatusBadRequest, perr.Error())
+				return
+			}
+			locations, err = mapCache.GetMapLocationsInBBox(ctx, bbox)
+		} else {
+			locations, err = mapCache.GetAllMapLocations(ctx)
+		}
 		if err != nil {
 			slog.ErrorContext(ctx, "failed to get map incidents from cache", slog.String("error", err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to get incidents"}) //nolint:errcheck
+			writeJSONError(w, http.StatusInternalServerError, "failed to get incidents")
 			return
 		}
 
 		api.MapIncidentsCount.Set(float64(len(locations)))
 		slog.DebugContext(ctx, "serving map incidents", slog.Int("count", len(locations)))
 
+		if api.WantsGeoJSON(w, r) {
+			api.WriteGeoJSON(w, api.GeoJSONResponse{FeatureCollection: api.MapLocationFeatures(locations)})
+			return
+		}
+		for i := range locations {
+			locations[i] = locations[i].AtDetail(detail)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{"data": locations}) //nolint:errcheck
 	}
 }
 
-func locationStream(client mqtt.Client, mapCache *cache.Cache) (chan shared.MapLocation, chan string) {
-	updateCh := make(chan shared.MapLocation, 100)
-	deleteCh := make(chan string, 100)
-
-	tok := client.Subscribe("beacon/+/+/situations/#", 0, func(c mqtt.Client, m mqtt.Message) {
-		ctx := context.Background()
-		topic := m.Topic()
-		api.MQTTStreamMessagesTotal.WithLabelValues("update").Inc()
-
-		slog.DebugContext(ctx, "received situation update for streaming",
-			slog.Uint64("message_id", uint64(m.MessageID())),
-			slog.String("topic", topic),
-		)
+// mapIncidentsNearby serves the active incidents within radius meters of
+// lat/lon, nearest first.
+func mapIncidentsNearby(mapCache *cache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		q := r.URL.Query()
+		api.MapNearbyRequests.Inc()
 
-		var record datex.Record
-		if err := json.Unmarshal(m.Payload(), &record); err != nil {
-			slog.ErrorContext(ctx, "failed to unmarshal situation for streaming",
-				slog.String("topic", topic),
-				slog.String("error", err.Error()),
-			)
+		lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+		lon, errLon := strconv.ParseFloat(q.Get("lon"), 64)
+		if errLat != nil || errLon != nil || lat < -85 || lat > 85 || lon < -180 || lon > 180 {
+			writeJSONError(w, http.StatusBadRequest, "lat and lon are required and must be valid coordinates")
 			return
 		}
 
-		loc, err := mapCache.GetMapLocation(ctx, record.ID)
+		detail, err := routing.ParseDetail(q.Get("detail"))
 		if err != nil {
-			slog.DebugContext(ctx, "cache miss, retrying after delay", slog.String("incident_id", record.ID))
-			time.Sleep(100 * time.Millisecond)
-			loc, err = mapCache.GetMapLocation(ctx, record.ID)
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		radius := float64(defaultNearbyRadius)
+		if raw := q.Get("radius"); raw != "" {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil || v <= 0 || v > maxNearbyRadius {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("radius must be between 0 and %d meters", maxNearbyRadius))
+				return
+			}
+			radius = v
+		}
+
+		limit := defaultNearbyLimit
+		if raw := q.Get("limit"); raw != "" {
+			if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+				limit = min(v, maxNearbyLimit)
+			}
 		}
 
+		nearby, err := mapCache.GetNearbyMapLocations(ctx, datex.Coordinates{Lat: lat, Lon: lon}, radius, limit)
 		if err != nil {
-			slog.WarnContext(ctx, "failed to get location from cache for streaming",
-				slog.String("incident_id", record.ID),
-				slog.String("error", err.Error()),
-			)
+			slog.ErrorContext(ctx, "failed to get nearby incidents from cache", slog.String("error", err.Error()))
+			writeJSONError(w, http.StatusInternalServerError, "failed to get incidents")
 			return
 		}
 
-		select {
-		case updateCh <- *loc:
-		default:
-			api.SSEEventsDropped.Inc()
-			slog.Warn("sse update channel full, dropping event",
-				slog.String("incident_id", record.ID),
-			)
+		if api.WantsGeoJSON(w, r) {
+			api.WriteGeoJSON(w, api.GeoJSONResponse{FeatureCollection: api.NearbyLocationFeatures(nearby)})
+			return
 		}
-	})
-	tok.Wait()
-	slog.Info("subscribed to situation updates", slog.String("pattern", "beacon/+/+/situations/#"))
+		for i := range nearby {
+			nearby[i].MapLocation = nearby[i].MapLocation.AtDetail(detail)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"data": nearby}) //nolint:errcheck
+	}
+}
 
-	tok = client.Subscribe("beacon/+/+/deletions/#", 0, func(c mqtt.Client, m mqtt.Message) {
-		ctx := context.Background()
-		topic := m.Topic()
-		api.MQTTStreamMessagesTotal.WithLabelValues("deletion").Inc()
+// mapClusters serves the cluster index for the bbox and zoom query parameters.
+// bbox defaults to the whole world.
+func mapClusters(clusters *api.ClusterIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
 
-		slog.DebugContext(ctx, "received deletion for streaming",
-			slog.Uint64("message_id", uint64(m.MessageID())),
-			slog.String("topic", topic),
-		)
+		zoom, err := strconv.Atoi(q.Get("zoom"))
+		if err != nil || zoom < 0 || zoom > api.MaxMapZoom {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("zoom must be between 0 and %d", api.MaxMapZoom))
+			return
+		}
 
-		var deletion datex.DeletionEvent
-		if err := json.Unmarshal(m.Payload(), &deletion); err != nil {
-			slog.ErrorContext(ctx, "failed to unmarshal deletion for streaming",
-				slog.String("topic", topic),
-				slog.String("error", err.Error()),
-			)
+		detail, err := routing.ParseDetail(q.Get("detail"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
+		bbox := shared.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+		if raw := q.Get("bbox"); raw != "" {
+			if bbox, err = shared.ParseBBox(raw); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		found, incidents := clusters.Query(bbox, zoom)
+		for i := range incidents {
+			incidents[i] = incidents[i].AtDetail(detail)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.ClustersResponse{Zoom: zoom, Clusters: found, Incidents: incidents}) //nolint:errcheck
+	}
+}
+
+// resyncLocations periodically rebuilds the cluster index from the cache and
+// prunes the hub's last known locations, to drop incidents whose cache entry
+// expired without a deletion event.
+func resyncLocations(ctx context.Context, mapCache *cache.Cache, hub *api.Hub, clusters *api.ClusterIndex, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case deleteCh <- deletion.ID:
-		default:
-			api.SSEEventsDropped.Inc()
-			slog.Warn("sse delete channel full, dropping event",
-				slog.String("incident_id", deletion.ID),
-			)
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			since := hub.Seq()
+			locations, err := mapCache.GetAllMapLocations(ctx)
+			if err != nil {
+				slog.Warn("failed to resync cluster index", slog.String("error", err.Error()))
+				continue
+			}
+			clusters.Reset(locations, since)
+			if n := hub.Prune(locations, since); n > 0 {
+				slog.Debug("pruned expired incidents from stream hub", slog.Int("count", n))
+			}
+		}
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg}) //nolint:errcheck
+}
+
+// locationChanges publishes every location the ingester stores, replaces or
+// removes to hub. Locations are read once they are in the cache, however far
+// behind the MQTT feed the ingester is.
+func locationChanges(ctx context.Context, mapCache *cache.Cache, hub *api.Hub) {
+	for {
+		err := mapCache.SubscribeMapLocationChanges(ctx, func(id string) {
+			loc, err := mapCache.GetMapLocation(ctx, id)
+			if errors.Is(err, cache.ErrLocationNotFound) {
+				api.LocationChangesTotal.WithLabelValues(api.EventDelete).Inc()
+				hub.Publish(api.Event{Type: api.EventDelete, ID: id})
+				return
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "failed to get changed location from cache",
+					slog.String("incident_id", id),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			api.LocationChangesTotal.WithLabelValues(api.EventUpdate).Inc()
+			hub.Publish(api.Event{Type: api.EventUpdate, ID: loc.ID, Location: loc})
+		})
+		if err == nil {
+			return
 		}
-	})
-	tok.Wait()
-	slog.Info("subscribed to deletions", slog.String("pattern", "beacon/+/+/deletions/#"))
 
-	return updateCh, deleteCh
+		slog.WarnContext(ctx, "location change subscription failed, retrying", slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
 }
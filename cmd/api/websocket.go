@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sverdejot/beacon/internal/api"
+	"github.com/sverdejot/beacon/internal/cache"
+	"github.com/sverdejot/beacon/internal/routing"
+)
+
+const (
+	wsWriteTimeout   = 10 * time.Second
+	wsPongTimeout    = 60 * time.Second
+	wsPingInterval   = 25 * time.Second
+	wsMaxMessageSize = 4096
+)
+
+// wsClientMessage is sent by clients to change their subscription without
+// reconnecting. Filter uses the same keys and value format as the /sse query
+// parameters (province, eventType, severity, road, bbox).
+type wsClientMessage struct {
+	Type   string            `json:"type"` // subscribe, unsubscribe
+	Filter map[string]string `json:"filter,omitempty"`
+}
+
+// wsServerMessage wraps events and replies sent to clients. Update and delete
+// data match the corresponding /sse payloads.
+type wsServerMessage struct {
+	Type  string `json:"type"` // snapshot, update, delete, unsubscribed, error
+	ID    uint64 `json:"id,omitempty"`
+	Data  any    `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// websocketStream serves live map events over a WebSocket. The initial filter
+// is read from the query string like /sse; afterwards the client sends
+// subscribe messages to replace it and receives a fresh snapshot for the new
+// filter, or unsubscribe to pause delivery while keeping the connection.
+func websocketStream(hub *api.Hub, mapCache *cache.Cache, origin string) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			o := r.Header.Get("Origin")
+			return origin == "*" || o == "" || o == origin
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.RemoteAddr
+
+		filter, err := api.ParseStreamFilter(r.URL.Query())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
+			return
+		}
+		detail, err := routing.ParseDetail(r.URL.Query().Get("detail"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Debug("websocket upgrade failed",
+				slog.String("client_ip", clientIP),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+
+		// The request context is not cancelled for hijacked connections.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		slog.Info("websocket client connected",
+			slog.String("client_ip", clientIP),
+			slog.String("user_agent", r.UserAgent()),
+		)
+
+		sub, _ := hub.Subscribe(filter, "")
+		api.WebSocketConnectionsTotal.Inc()
+		api.WebSocketConnectionsActive.Inc()
+		defer func() {
+			hub.Unsubscribe(sub)
+			api.WebSocketConnectionsActive.Dec()
+			slog.Debug("websocket client disconnected",
+				slog.String("client_ip", clientIP),
+				slog.Int64("delivered", sub.Delivered()),
+			)
+		}()
+
+		requests := make(chan wsClientMessage)
+		go readWebSocket(ctx, conn, requests, cancel)
+
+		if err := writeWebSocketSnapshot(ctx, conn, mapCache, sub, detail); err != nil {
+			slog.Warn("failed to send websocket snapshot",
+				slog.String("client_ip", clientIP),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.Evicted():
+				slog.Warn("websocket client too slow, disconnecting", slog.String("client_ip", clientIP))
+				msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout)) //nolint:errcheck
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			case req := <-requests:
+				if err := handleWebSocketRequest(ctx, conn, mapCache, sub, &detail, req); err != nil {
+					slog.Debug("websocket write failed",
+						slog.String("client_ip", clientIP),
+						slog.String("error", err.Error()),
+					)
+					return
+				}
+			case ev := <-sub.Events():
+				var data any = map[string]string{"id": ev.ID}
+				if ev.Type == api.EventUpdate {
+					data = ev.Location.AtDetail(detail)
+				}
+				if err := writeWebSocket(conn, wsServerMessage{Type: ev.Type, ID: ev.Seq, Data: data}); err != nil {
+					slog.Debug("websocket write failed",
+						slog.String("client_ip", clientIP),
+						slog.String("error", err.Error()),
+					)
+					return
+				}
+				api.WebSocketEventsTotal.WithLabelValues(ev.Type).Inc()
+			}
+		}
+	}
+}
+
+// readWebSocket forwards client messages to requests until the connection
+// fails, then cancels the connection's context.
+func readWebSocket(ctx context.Context, conn *websocket.Conn, requests chan<- wsClientMessage, cancel context.CancelFunc) {
+	defer cancel()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout)) //nolint:errcheck
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg wsClientMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			msg = wsClientMessage{Type: "invalid"}
+		}
+
+		select {
+		case requests <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleWebSocketRequest applies a client message. A subscribe message may
+// also change the path detail, which stays in effect until the next one.
+func handleWebSocketRequest(ctx context.Context, conn *websocket.Conn, mapCache *cache.Cache, sub *api.Subscriber, detail *routing.Detail, req wsClientMessage) error {
+	switch req.Type {
+	case "subscribe":
+		q := url.Values{}
+		for k, v := range req.Filter {
+			q.Set(k, v)
+		}
+		filter, err := api.ParseStreamFilter(q)
+		if err != nil {
+			api.WebSocketMessagesTotal.WithLabelValues("invalid").Inc()
+			return writeWebSocket(conn, wsServerMessage{Type: "error", Error: err.Error()})
+		}
+		d, err := routing.ParseDetail(q.Get("detail"))
+		if err != nil {
+			api.WebSocketMessagesTotal.WithLabelValues("invalid").Inc()
+			return writeWebSocket(conn, wsServerMessage{Type: "error", Error: err.Error()})
+		}
+		api.WebSocketMessagesTotal.WithLabelValues("subscribe").Inc()
+
+		// Events still queued were routed with the old filter; the snapshot
+		// that follows supersedes them.
+		sub.SetFilter(filter)
+		*detail = d
+		drain(sub)
+		return writeWebSocketSnapshot(ctx, conn, mapCache, sub, d)
+
+	case "unsubscribe":
+		api.WebSocketMessagesTotal.WithLabelValues("unsubscribe").Inc()
+		sub.Pause()
+		drain(sub)
+		return writeWebSocket(conn, wsServerMessage{Type: "unsubscribed"})
+
+	default:
+		api.WebSocketMessagesTotal.WithLabelValues("invalid").Inc()
+		return writeWebSocket(conn, wsServerMessage{Type: "error", Error: "unknown message type, expected subscribe or unsubscribe"})
+	}
+}
+
+func writeWebSocketSnapshot(ctx context.Context, conn *websocket.Conn, mapCache *cache.Cache, sub *api.Subscriber, detail routing.Detail) error {
+	locations, err := snapshot(ctx, mapCache, sub.Filter(), detail)
+	if err != nil {
+		return err
+	}
+	if err := writeWebSocket(conn, wsServerMessage{Type: "snapshot", Data: locations}); err != nil {
+		return err
+	}
+	api.WebSocketEventsTotal.WithLabelValues("snapshot").Inc()
+	return nil
+}
+
+func writeWebSocket(conn *websocket.Conn, msg wsServerMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)) //nolint:errcheck
+	return conn.WriteJSON(msg)
+}
+
+// drain discards every event currently queued for sub.
+func drain(sub *api.Subscriber) {
+	for {
+		select {
+		case <-sub.Events():
+		default:
+			return
+		}
+	}
+}
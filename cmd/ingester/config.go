@@ -1,5 +1,13 @@
 package main
 
+import (
+	"errors"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/ingester"
+	"github.com/sverdejot/beacon/internal/routing"
+)
+
 type config struct {
 	MQTTBroker         string `env:"MQTT_BROKER"         envDefault:"tcp://localhost:1883"`
 	ClickHouseAddr     string `env:"CLICKHOUSE_ADDR"     envDefault:"localhost:9000"`
@@ -11,4 +19,90 @@ type config struct {
 	RedisPassword      string `env:"REDIS_PASSWORD"      envDefault:""`
 	RedisDB            int    `env:"REDIS_DB"            envDefault:"0"`
 	MetricsPort        string `env:"METRICS_PORT"        envDefault:"9091"`
+
+	// QueueOverflow is what happens to MQTT messages when the worker queue
+	// is full: block, spill to QueueSpillDir, or drop_oldest. Deletions are
+	// never dropped.
+	WorkerCount     int                       `env:"WORKER_COUNT"      envDefault:"8"`
+	WorkerQueueSize int                       `env:"WORKER_QUEUE_SIZE" envDefault:"1024"`
+	QueueOverflow   ingester.OverflowStrategy `env:"QUEUE_OVERFLOW"    envDefault:"block"`
+	QueueSpillDir   string                    `env:"QUEUE_SPILL_DIR"   envDefault:"var/queue"`
+
+	// Failed inserts are retried, then spooled to disk and replayed in order
+	// once ClickHouse is back. An empty spool directory disables spooling.
+	ClickHouseMaxRetries   int           `env:"CLICKHOUSE_MAX_RETRIES"   envDefault:"3"`
+	ClickHouseRetryBackoff time.Duration `env:"CLICKHOUSE_RETRY_BACKOFF" envDefault:"500ms"`
+	ClickHouseSpoolDir     string        `env:"CLICKHOUSE_SPOOL_DIR"     envDefault:"var/spool"`
+
+	// Messages that cannot be processed are kept as dead letters in
+	// ClickHouse, or in DeadLetterDir while it is down, and can be listed and
+	// re-driven under /deadletters on AdminAddr. The admin routes are not
+	// authenticated, so they listen on loopback only by default; an empty
+	// address disables them.
+	DeadLetterDir           string        `env:"DEAD_LETTER_DIR"            envDefault:"var/deadletter"`
+	DeadLetterDrainInterval time.Duration `env:"DEAD_LETTER_DRAIN_INTERVAL" envDefault:"1m"`
+	AdminAddr               string        `env:"ADMIN_ADDR"                 envDefault:"127.0.0.1:9093"`
+
+	// RoutingBackends are tried in order: osrm, valhalla, graphhopper or
+	// great_circle, which needs no routing server.
+	RoutingBackends    []string `env:"ROUTING_BACKENDS"    envDefault:"osrm" envSeparator:","`
+	ValhallaURL        string   `env:"VALHALLA_URL"        envDefault:"http://localhost:8002"`
+	ValhallaCosting    string   `env:"VALHALLA_COSTING"    envDefault:"auto"`
+	GraphHopperURL     string   `env:"GRAPHHOPPER_URL"     envDefault:"http://localhost:8989"`
+	GraphHopperProfile string   `env:"GRAPHHOPPER_PROFILE" envDefault:"car"`
+	GraphHopperAPIKey  string   `env:"GRAPHHOPPER_API_KEY" envDefault:""`
+
+	RouteCacheTTL               time.Duration `env:"ROUTE_CACHE_TTL"                envDefault:"720h"`
+	RoutingVersionCheckInterval time.Duration `env:"ROUTING_VERSION_CHECK_INTERVAL" envDefault:"10m"`
+
+	RoutingTimeout          time.Duration `env:"ROUTING_TIMEOUT"           envDefault:"5s"`
+	RoutingMaxRetries       int           `env:"ROUTING_MAX_RETRIES"       envDefault:"2"`
+	RoutingRetryBackoff     time.Duration `env:"ROUTING_RETRY_BACKOFF"     envDefault:"200ms"`
+	RoutingMaxConcurrent    int           `env:"ROUTING_MAX_CONCURRENT"    envDefault:"8"`
+	RoutingBreakerThreshold int           `env:"ROUTING_BREAKER_THRESHOLD" envDefault:"5"`
+	RoutingBreakerCooldown  time.Duration `env:"ROUTING_BREAKER_COOLDOWN"  envDefault:"30s"`
+	RerouteInterval         time.Duration `env:"REROUTE_INTERVAL"          envDefault:"1m"`
+
+	// Incident coordinates are snapped onto the road they are reported on if
+	// one is within SnapMaxDistance meters.
+	SnapEnabled     bool    `env:"SNAP_ENABLED"      envDefault:"true"`
+	SnapMaxDistance float64 `env:"SNAP_MAX_DISTANCE" envDefault:"100"`
+
+	// KmIndexRefreshInterval is how often the km marker index used to locate
+	// records without coordinates is rebuilt from ClickHouse.
+	KmIndexRefreshInterval time.Duration `env:"KM_INDEX_REFRESH_INTERVAL" envDefault:"6h"`
+}
+
+// validate rejects settings the ingester cannot run with.
+func (c config) validate() error {
+	if c.WorkerCount <= 0 {
+		return errors.New("WORKER_COUNT must be positive")
+	}
+	if c.WorkerQueueSize <= 0 {
+		return errors.New("WORKER_QUEUE_SIZE must be positive")
+	}
+	if c.RoutingVersionCheckInterval <= 0 {
+		return errors.New("ROUTING_VERSION_CHECK_INTERVAL must be positive")
+	}
+	if c.RerouteInterval <= 0 {
+		return errors.New("REROUTE_INTERVAL must be positive")
+	}
+	if c.KmIndexRefreshInterval <= 0 {
+		return errors.New("KM_INDEX_REFRESH_INTERVAL must be positive")
+	}
+	if c.DeadLetterDrainInterval <= 0 {
+		return errors.New("DEAD_LETTER_DRAIN_INTERVAL must be positive")
+	}
+	return nil
+}
+
+func (c config) routeOptions() routing.RouteOptions {
+	return routing.RouteOptions{
+		Timeout:          c.RoutingTimeout,
+		MaxRetries:       c.RoutingMaxRetries,
+		RetryBackoff:     c.RoutingRetryBackoff,
+		MaxConcurrent:    c.RoutingMaxConcurrent,
+		BreakerThreshold: c.RoutingBreakerThreshold,
+		BreakerCooldown:  c.RoutingBreakerCooldown,
+	}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/ingester"
+)
+
+const (
+	defaultDeadLetterLimit = 100
+	maxDeadLetterLimit     = 1000
+)
+
+// errMissingID rejects messages that decode but cannot be tied to an
+// incident.
+var errMissingID = errors.New("missing incident id")
+
+// deadLetter keeps a message that could not be processed, so it can be
+// inspected and re-driven.
+func deadLetter(ctx context.Context, store *ingester.DeadLetterStore, topic string, payload []byte, cause error) {
+	if err := store.Add(ctx, topic, payload, cause); err != nil {
+		slog.Error("failed to store dead letter, message is lost",
+			slog.String("topic", topic),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// drainDeadLetters moves dead letters kept on disk while ClickHouse was down
+// into ClickHouse every interval.
+func drainDeadLetters(ctx context.Context, store *ingester.DeadLetterStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := store.Drain(ctx)
+		if err != nil {
+			slog.Warn("failed to drain dead letters", slog.String("error", err.Error()))
+		} else if n > 0 {
+			slog.Info("drained dead letters into clickhouse", slog.Int("count", n))
+		}
+	}
+}
+
+// handleDeadLetters serves the dead letter routes on mux:
+//
+//	GET  /deadletters                list newest first, filtered by topic, since, pending and limit
+//	GET  /deadletters/{id}           inspect one
+//	POST /deadletters/{id}/redrive   re-drive one
+//	POST /deadletters/redrive        re-drive the oldest pending letters matching the filter
+//
+// Re-driven letters go back through the worker queue, so they are processed
+// by the running code; those rejected again become new dead letters.
+func handleDeadLetters(mux *http.ServeMux, store *ingester.DeadLetterStore, queue *ingester.ShardedQueue) {
+	mux.HandleFunc("GET /deadletters", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseDeadLetterFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		letters, err := store.List(r.Context(), filter)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to list dead letters", slog.String("error", err.Error()))
+			writeJSONError(w, http.StatusInternalServerError, "failed to list dead letters")
+			return
+		}
+		if letters == nil {
+			letters = []ingester.DeadLetter{}
+		}
+		writeJSON(w, map[string]any{"data": letters})
+	})
+
+	mux.HandleFunc("GET /deadletters/{id}", func(w http.ResponseWriter, r *http.Request) {
+		dl, ok := getDeadLetter(w, r, store)
+		if !ok {
+			return
+		}
+		writeJSON(w, dl)
+	})
+
+	mux.HandleFunc("POST /deadletters/{id}/redrive", func(w http.ResponseWriter, r *http.Request) {
+		dl, ok := getDeadLetter(w, r, store)
+		if !ok {
+			return
+		}
+		if err := redrive(r.Context(), store, queue, dl); err != nil {
+			slog.ErrorContext(r.Context(), "failed to re-drive dead letter",
+				slog.String("dead_letter_id", dl.ID),
+				slog.String("error", err.Error()),
+			)
+			writeJSONError(w, http.StatusInternalServerError, "failed to re-drive dead letter")
+			return
+		}
+		writeJSON(w, dl)
+	})
+
+	mux.HandleFunc("POST /deadletters/redrive", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseDeadLetterFilter(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Oldest first, so each incident's messages are replayed in order
+		filter.Pending, filter.Oldest = true, true
+
+		letters, err := store.List(r.Context(), filter)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to list dead letters", slog.String("error", err.Error()))
+			writeJSONError(w, http.StatusInternalServerError, "failed to list dead letters")
+			return
+		}
+		redriven := 0
+		for i := range letters {
+			if err := redrive(r.Context(), store, queue, &letters[i]); err != nil {
+				slog.ErrorContext(r.Context(), "failed to re-drive dead letter",
+					slog.String("dead_letter_id", letters[i].ID),
+					slog.String("error", err.Error()),
+				)
+				break
+			}
+			redriven++
+		}
+		writeJSON(w, map[string]int{"redriven": redriven, "failed": len(letters) - redriven})
+	})
+}
+
+// redrive marks dl as re-driven and queues it for processing. It is marked
+// first, so a letter is never replayed without a record of it.
+func redrive(ctx context.Context, store *ingester.DeadLetterStore, queue *ingester.ShardedQueue, dl *ingester.DeadLetter) error {
+	if err := store.MarkRedriven(ctx, dl); err != nil {
+		return err
+	}
+	queue.Push(ingester.Message{Topic: dl.Topic, Payload: []byte(dl.Payload)})
+	ingester.DeadLettersRedriven.Inc()
+	slog.Info("re-driven dead letter",
+		slog.String("dead_letter_id", dl.ID),
+		slog.String("topic", dl.Topic),
+	)
+	return nil
+}
+
+func getDeadLetter(w http.ResponseWriter, r *http.Request, store *ingester.DeadLetterStore) (*ingester.DeadLetter, bool) {
+	dl, err := store.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ingester.ErrDeadLetterNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get dead letter", slog.String("error", err.Error()))
+		writeJSONError(w, http.StatusInternalServerError, "failed to get dead letter")
+		return nil, false
+	}
+	return dl, true
+}
+
+func parseDeadLetterFilter(q url.Values) (ingester.DeadLetterFilter, error) {
+	f := ingester.DeadLetterFilter{
+		Topic: q.Get("topic"),
+		Limit: defaultDeadLetterLimit,
+	}
+	if raw := q.Get("since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return f, fmt.Errorf("invalid since %q, expected RFC 3339", raw)
+		}
+		f.Since = since
+	}
+	if raw := q.Get("pending"); raw != "" {
+		pending, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, fmt.Errorf("invalid pending %q", raw)
+		}
+		f.Pending = pending
+	}
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxDeadLetterLimit {
+			return f, fmt.Errorf("invalid limit %q, expected 1 to %d", raw, maxDeadLetterLimit)
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+func writeJSON(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg}) //nolint:errcheck
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/ingester"
+)
+
+// refreshKmIndex rebuilds idx from ClickHouse now and then every interval,
+// picking up the references of incidents ingested since.
+func refreshKmIndex(ctx context.Context, ch *ingester.ClickHouseClient, idx *ingester.KmIndex, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		refs, err := ch.KmReferences(ctx)
+		if err != nil {
+			slog.Warn("failed to load km index", slog.String("error", err.Error()))
+		} else {
+			idx.Reset(refs)
+			slog.Info("loaded km index", slog.Int("references", len(refs)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
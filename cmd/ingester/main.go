@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
@@ -33,6 +34,10 @@ func main() {
 		slog.Error("failed to parse config", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+	if err := cfg.validate(); err != nil {
+		slog.Error("invalid config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
 
 	slog.Info("configuration loaded",
 		slog.String("mqtt_broker", cfg.MQTTBroker),
@@ -41,6 +46,7 @@ func main() {
 		slog.String("osrm_url", cfg.OSRMURL),
 		slog.String("redis_addr", cfg.RedisAddr),
 		slog.String("metrics_port", cfg.MetricsPort),
+		slog.String("admin_addr", cfg.AdminAddr),
 	)
 
 	// Start metrics server
@@ -61,7 +67,11 @@ func main() {
 
 	// Connect to ClickHouse
 	slog.Info("connecting to clickhouse", slog.String("addr", cfg.ClickHouseAddr))
-	ch, err := ingester.NewClickHouseClient(cfg.ClickHouseAddr, cfg.ClickHouseDatabase, cfg.ClickHouseUser, cfg.ClickHousePassword)
+	ch, err := ingester.NewClickHouseClient(cfg.ClickHouseAddr, cfg.ClickHouseDatabase, cfg.ClickHouseUser, cfg.ClickHousePassword, ingester.WriteOptions{
+		MaxRetries:   cfg.ClickHouseMaxRetries,
+		RetryBackoff: cfg.ClickHouseRetryBackoff,
+		SpoolDir:     cfg.ClickHouseSpoolDir,
+	})
 	if err != nil {
 		slog.Error("failed to connect to clickhouse", slog.String("error", err.Error()))
 		os.Exit(1)
@@ -69,10 +79,6 @@ func main() {
 	defer ch.Close() //nolint:errcheck
 	slog.Info("connected to clickhouse")
 
-	// Initialize OSRM
-	routeService := routing.NewRouteService(cfg.OSRMURL)
-	slog.Info("initialized osrm route service", slog.String("url", cfg.OSRMURL))
-
 	// Connect to Redis/Valkey
 	slog.Info("connecting to redis", slog.String("addr", cfg.RedisAddr))
 	mapCache, err := cache.NewCache(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
@@ -82,6 +88,30 @@ func main() {
 	}
 	slog.Info("connected to redis")
 
+	// Initialize routing, with computed routes cached in Valkey
+	chain, snapper, err := newRouteProvider(ctx, cfg, mapCache)
+	if err != nil {
+		slog.Error("failed to initialize routing", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	routeService := routing.NewSegmentRouter(chain, snapper)
+	go rerouteFallbacks(ctx, mapCache, ch, routeService, cfg.RerouteInterval)
+	slog.Info("initialized routing",
+		slog.Any("backends", chain.Names()),
+		slog.Duration("route_cache_ttl", cfg.RouteCacheTTL),
+		slog.Bool("snapping", snapper != nil),
+	)
+
+	kmIndex := ingester.NewKmIndex()
+	go refreshKmIndex(ctx, ch, kmIndex, cfg.KmIndexRefreshInterval)
+
+	deadLetters, err := ingester.NewDeadLetterStore(ch, cfg.DeadLetterDir)
+	if err != nil {
+		slog.Error("failed to open dead letter store", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	go drainDeadLetters(ctx, deadLetters, cfg.DeadLetterDrainInterval)
+
 	// Connect to MQTT
 	slog.Info("connecting to mqtt broker", slog.String("broker", cfg.MQTTBroker))
 	opts := mqtt.NewClientOptions().
@@ -95,48 +125,61 @@ func main() {
 	}
 	slog.Info("connected to mqtt broker")
 
-	// Worker pool for non-blocking MQTT message processing
-	const workerCount = 8
-	const queueSize = 1024
-
-	type mqttMsg struct {
-		topic   string
-		payload []byte
+	// Worker pool for MQTT message processing, sharded by incident so each
+	// incident's messages are processed in order
+	queue, err := ingester.NewShardedQueue(cfg.WorkerCount, cfg.WorkerQueueSize, cfg.QueueOverflow, cfg.QueueSpillDir)
+	if err != nil {
+		slog.Error("failed to create worker queue", slog.String("error", err.Error()))
+		os.Exit(1)
 	}
+	slog.Info("started worker pool",
+		slog.Int("workers", cfg.WorkerCount),
+		slog.Int("queue_size", cfg.WorkerQueueSize),
+		slog.String("overflow", string(cfg.QueueOverflow)),
+		slog.Int("spilled", queue.Spilled()),
+	)
 
-	workCh := make(chan mqttMsg, queueSize)
+	// Dead letters are served on their own listener, for operators only
+	if cfg.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		handleDeadLetters(adminMux, deadLetters, queue)
+		go func() {
+			slog.Info("starting admin server", slog.String("addr", cfg.AdminAddr))
+			if err := http.ListenAndServe(cfg.AdminAddr, adminMux); err != nil {
+				slog.Error("admin server failed", slog.String("error", err.Error()))
+			}
+		}()
+	}
 
 	// Start workers
 	var wg sync.WaitGroup
-	for i := range workerCount {
+	for i := range cfg.WorkerCount {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
 			slog.Debug("worker started", slog.Int("worker_id", id))
-			for msg := range workCh {
-				ingester.WorkerPoolQueueSize.Set(float64(len(workCh)))
-				processMessage(msg.topic, msg.payload, ch, mapCache, routeService)
+			shard := queue.Shard(id)
+			for {
+				msg, ok := shard.Pop()
+				if !ok {
+					break
+				}
+				processMessage(msg.Topic, msg.Payload, ch, mapCache, routeService, snapper, kmIndex, deadLetters)
 			}
 			slog.Debug("worker stopped", slog.Int("worker_id", id))
 		}(i)
 	}
 
 	tok := client.Subscribe("beacon/#", 1, func(c mqtt.Client, m mqtt.Message) {
-		msg := mqttMsg{
-			topic:   m.Topic(),
-			payload: make([]byte, len(m.Payload())),
-		}
-		copy(msg.payload, m.Payload())
-
-		select {
-		case workCh <- msg:
-			ingester.WorkerPoolQueueSize.Set(float64(len(workCh)))
-		default:
-			ingester.WorkerPoolDropped.Inc()
-			slog.Warn("worker pool full, dropping message",
-				slog.String("topic", msg.topic),
-			)
+		msg := ingester.Message{
+			Topic:   m.Topic(),
+			Payload: make([]byte, len(m.Payload())),
 		}
+		copy(msg.Payload, m.Payload())
+
+		// Depending on the overflow strategy this may block, holding up
+		// delivery until the workers catch up.
+		queue.Push(msg)
 	})
 
 	if tok.Wait() && tok.Error() != nil {
@@ -151,7 +194,9 @@ func main() {
 	client.Disconnect(250)
 	slog.Debug("disconnected from mqtt broker")
 
-	close(workCh)
+	if err := queue.Close(); err != nil {
+		slog.Error("failed to close worker queue", slog.String("error", err.Error()))
+	}
 	wg.Wait()
 	slog.Debug("worker pool drained")
 
@@ -164,7 +209,7 @@ func main() {
 	slog.Info("shutdown complete")
 }
 
-func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient, mapCache *cache.Cache, routeService *routing.RouteService) {
+func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient, mapCache *cache.Cache, routeService shared.RouteProvider, snapper *routing.Snapper, kmIndex *ingester.KmIndex, deadLetters *ingester.DeadLetterStore) {
 	msgCtx := context.Background()
 
 	slog.Debug("processing mqtt message",
@@ -176,12 +221,17 @@ func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient,
 		ingester.MQTTMessagesReceived.WithLabelValues("deletion").Inc()
 
 		var deletion datex.DeletionEvent
-		if err := json.Unmarshal(payload, &deletion); err != nil {
+		err := json.Unmarshal(payload, &deletion)
+		if err == nil && deletion.ID == "" {
+			err = errMissingID
+		}
+		if err != nil {
 			slog.Error("failed to unmarshal deletion message",
 				slog.String("topic", topic),
 				slog.String("error", err.Error()),
 			)
 			ingester.MQTTProcessingErrors.Inc()
+			deadLetter(msgCtx, deadLetters, topic, payload, err)
 			return
 		}
 
@@ -199,14 +249,9 @@ func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient,
 			slog.Debug("removed incident from cache", slog.String("incident_id", deletion.ID))
 		}
 
-		if err := ch.SetEndTimestamp(msgCtx, deletion.ID, deletion.DeletedAt); err != nil {
-			slog.Error("failed to set end timestamp in clickhouse",
-				slog.String("incident_id", deletion.ID),
-				slog.String("error", err.Error()),
-			)
-		} else {
-			slog.Debug("marked incident as ended in clickhouse", slog.String("incident_id", deletion.ID))
-		}
+		// Queued behind the incident's pending inserts, and retried or
+		// spooled with them
+		ch.SetEndTimestamp(msgCtx, deletion.ID, deletion.DeletedAt)
 
 		ingester.DeletionsProcessed.Inc()
 		return
@@ -216,12 +261,17 @@ func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient,
 
 	var record datex.Record
 	rawJSON := string(payload)
-	if err := json.Unmarshal(payload, &record); err != nil {
+	err := json.Unmarshal(payload, &record)
+	if err == nil && record.ID == "" {
+		err = errMissingID
+	}
+	if err != nil {
 		slog.Error("failed to unmarshal situation message",
 			slog.String("topic", topic),
 			slog.String("error", err.Error()),
 		)
 		ingester.MQTTProcessingErrors.Inc()
+		deadLetter(msgCtx, deadLetters, topic, payload, err)
 		return
 	}
 
@@ -233,19 +283,70 @@ func processMessage(topic string, payload []byte, ch *ingester.ClickHouseClient,
 		slog.String("severity", record.Severity),
 	)
 
-	loc := shared.RecordToMapLocation(&record, routeService, eventType)
+	// Records republished unchanged only refresh when the incident was last
+	// seen; they are not routed, cached, announced to the API or inserted
+	// again
+	digest := ingester.Digest(topic, &record)
+	unchanged, err := mapCache.TouchUnchanged(msgCtx, record.ID, digest, record.Validity)
+	switch {
+	case err != nil:
+		slog.Warn("failed to check for unchanged situation",
+			slog.String("incident_id", record.ID),
+			slog.String("error", err.Error()),
+		)
+		ingester.DedupeChecks.WithLabelValues("error").Inc()
+	case unchanged:
+		slog.Debug("skipped unchanged situation", slog.String("incident_id", record.ID))
+		ingester.DedupeChecks.WithLabelValues("hit").Inc()
+		return
+	default:
+		ingester.DedupeChecks.WithLabelValues("miss").Inc()
+	}
+
+	// Locate endpoints published with only km markers, then snap before
+	// routing so the route starts and ends on the road
+	estimated := ingester.EstimateCoordinates(&record, kmIndex)
+	snapFrom, snapTo := ingester.SnapRecord(&record, snapper)
+	if !estimated {
+		kmIndex.Observe(&record)
+	}
+
+	loc := shared.RecordToMapLocation(msgCtx, &record, routeService, eventType)
+	storeDigest := true
 	if loc != nil {
-		if err := mapCache.StoreMapLocation(msgCtx, loc, record.Validity); err != nil {
+		loc.Estimated = estimated
+		loc.Snap, loc.ToSnap = snapFrom, snapTo
+		loc.Province = datex.ExtractRegion(topic)
+		err := mapCache.StoreMapLocation(msgCtx, loc, record.Validity)
+		if errors.Is(err, cache.ErrStaleVersion) {
+			slog.Debug("skipped caching stale version",
+				slog.String("incident_id", record.ID),
+				slog.Int64("version", loc.Version),
+			)
+			storeDigest = false
+		} else if err != nil {
 			slog.Error("failed to store location in cache",
 				slog.String("incident_id", record.ID),
 				slog.String("error", err.Error()),
 			)
+			storeDigest = false
 		}
 	}
 
 	incident := ingester.RecordToIncidentWithRoute(&record, topic, rawJSON, loc)
 	ch.Insert(msgCtx, incident)
 
+	// A stale or uncached record is not remembered, so that it is processed
+	// again if republished
+	if storeDigest {
+		if err := mapCache.StoreDigest(msgCtx, record.ID, digest, loc != nil, record.Validity); err != nil {
+			slog.Warn("failed to store situation digest",
+				slog.String("incident_id", record.ID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
 	slog.Debug("incident processed",
 		slog.String("incident_id", record.ID),
 		slog.String("province", incident.Province),
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/cache"
+	"github.com/sverdejot/beacon/internal/ingester"
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// rerouteMaxAttempts bounds how often a segment a backend answered for but
+// could not route is retried; segments that failed because every backend was
+// down are not counted, since the job waits for one to be available.
+const rerouteMaxAttempts = 5
+
+// rerouteFallbacks periodically re-routes live segments whose path is only
+// approximate because no routing backend was available when they were
+// ingested, updating the cache and ClickHouse.
+func rerouteFallbacks(ctx context.Context, mapCache *cache.Cache, ch *ingester.ClickHouseClient, routes *routing.SegmentRouter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	attempts := make(map[string]int)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			locations, err := mapCache.GetAllMapLocations(ctx)
+			if err != nil {
+				slog.Warn("failed to load locations for rerouting", slog.String("error", err.Error()))
+				continue
+			}
+
+			pending := make(map[string]int, len(attempts))
+			fallbacks := 0
+			for i := range locations {
+				loc := &locations[i]
+				if !routing.IsApproximate(loc.RouteSource) || len(loc.Path) < 2 {
+					continue
+				}
+				fallbacks++
+				if attempts[loc.ID] >= rerouteMaxAttempts || !routes.Available() {
+					pending[loc.ID] = attempts[loc.ID]
+					continue
+				}
+
+				if rerouteLocation(ctx, mapCache, ch, routes, loc) {
+					fallbacks--
+				} else {
+					pending[loc.ID] = attempts[loc.ID] + 1
+				}
+			}
+			// Forget segments that ended or were re-routed.
+			attempts = pending
+			ingester.FallbackSegments.Set(float64(fallbacks))
+		}
+	}
+}
+
+// rerouteLocation routes loc between its endpoints and stores the result. It
+// reports whether loc no longer needs re-routing.
+func rerouteLocation(ctx context.Context, mapCache *cache.Cache, ch *ingester.ClickHouseClient, routes *routing.SegmentRouter, loc *shared.MapLocation) bool {
+	seg := routing.Segment{
+		From: loc.Path[0],
+		To:   loc.Path[len(loc.Path)-1],
+		Road: datex.RoadInfo{Number: loc.Road},
+	}
+	if loc.Expected != nil {
+		seg.Expected = *loc.Expected
+	}
+	result := routes.RouteSegment(ctx, seg)
+	if result.Approximate() {
+		ingester.FallbackReroutes.WithLabelValues("failed").Inc()
+		return false
+	}
+
+	loc.Path = result.Path
+	loc.Polylines = &result.Polylines
+	loc.Distance = result.Distance
+	loc.Duration = result.Duration
+	loc.RouteSource = result.Source
+	loc.RouteConfidence = result.Confidence
+
+	// A newer version ingested meanwhile was routed on its own; the expire
+	// check in ReplaceMapLocation only guards against ended incidents.
+	if current, err := mapCache.GetMapLocation(ctx, loc.ID); err == nil && !routing.IsApproximate(current.RouteSource) {
+		ingester.FallbackReroutes.WithLabelValues("gone").Inc()
+		return true
+	}
+
+	replaced, err := mapCache.ReplaceMapLocation(ctx, loc)
+	if err != nil {
+		slog.Error("failed to store rerouted location",
+			slog.String("incident_id", loc.ID),
+			slog.String("error", err.Error()),
+		)
+		ingester.FallbackReroutes.WithLabelValues("failed").Inc()
+		return false
+	}
+	if !replaced {
+		ingester.FallbackReroutes.WithLabelValues("gone").Inc()
+		return true
+	}
+
+	var length *float32
+	if l, ok := ingester.RoutedLength(loc); ok {
+		length = &l
+	}
+	ch.SetRoute(ctx, loc.ID, length, result.Source, ingester.RouteConfidence(loc), ingester.RoutePolyline(loc))
+
+	ingester.FallbackReroutes.WithLabelValues("success").Inc()
+	slog.Info("rerouted fallback segment",
+		slog.String("incident_id", loc.ID),
+		slog.String("backend", result.Source),
+		slog.Float64("distance", result.Distance),
+	)
+	return true
+}
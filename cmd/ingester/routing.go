@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sverdejot/beacon/internal/routing"
+)
+
+// newRouteProvider chains the configured routing backends. Backends with a
+// routing server get their routes cached in store. The snapper uses the first
+// backend that supports snapping and is nil if snapping is disabled or none
+// does.
+func newRouteProvider(ctx context.Context, cfg config, store routing.RouteStore) (*routing.Chain, *routing.Snapper, error) {
+	var (
+		routers []routing.Router
+		snapper *routing.Snapper
+	)
+	for _, name := range cfg.RoutingBackends {
+		var backend routing.Backend
+		switch strings.TrimSpace(name) {
+		case routing.RouteSourceOSRM:
+			backend = routing.NewOSRM(cfg.OSRMURL)
+		case routing.RouteSourceValhalla:
+			backend = routing.NewValhalla(cfg.ValhallaURL, cfg.ValhallaCosting)
+		case routing.RouteSourceGraphHopper:
+			backend = routing.NewGraphHopper(cfg.GraphHopperURL, cfg.GraphHopperProfile, cfg.GraphHopperAPIKey)
+		case routing.RouteSourceGreatCircle:
+			routers = append(routers, routing.GreatCircle{})
+			continue
+		case "":
+			continue
+		default:
+			return nil, nil, fmt.Errorf("unknown routing backend %q", name)
+		}
+
+		service := routing.NewRouteService(backend, cfg.routeOptions())
+		if cfg.SnapEnabled && snapper == nil && service.SupportsSnapping() {
+			snapper = routing.NewSnapper(service, cfg.SnapMaxDistance)
+		}
+
+		cached, err := routing.NewCachedRouteService(ctx, service, store, cfg.RouteCacheTTL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to initialize %s route cache: %w", backend.Name(), err)
+		}
+		go cached.WatchDatasetVersion(ctx, cfg.RoutingVersionCheckInterval)
+		routers = append(routers, cached)
+	}
+
+	if len(routers) == 0 {
+		return nil, nil, fmt.Errorf("no routing backends configured")
+	}
+	return routing.NewChain(routers...), snapper, nil
+}
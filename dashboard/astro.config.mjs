@@ -18,7 +18,9 @@ export default defineConfig({
     server: {
       proxy: {
         '/api': 'http://localhost:8081',
-        '/sse': 'http://localhost:8081'
+        '/sse': 'http://localhost:8081',
+        '/tiles': 'http://localhost:8081',
+        '/ws': { target: 'ws://localhost:8081', ws: true }
       }
     }
   }
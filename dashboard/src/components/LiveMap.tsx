@@ -1,5 +1,6 @@
 import { useEffect, useRef, useState, useCallback } from 'react';
 import type { MapLocation } from '../lib/types';
+import { decodePolyline } from '../lib/polyline';
 
 interface MapLocationWithId extends MapLocation {
   id: string;
@@ -43,13 +44,18 @@ export function LiveMap({ fullHeight = false }: LiveMapProps) {
     // eslint-disable-next-line @typescript-eslint/no-explicit-any
     let marker: any;
 
-    if (loc.type === 'segment' && loc.path) {
-      const coords = loc.path.map((p) => [p.lat, p.lon] as [number, number]);
+    const path = loc.polyline ? decodePolyline(loc.polyline) : loc.path;
 
+    if (loc.type === 'segment' && path && path.length > 0) {
+      const coords = path.map((p) => [p.lat, p.lon] as [number, number]);
+
+      // Approximate paths are drawn fainter until they are re-routed, and so
+      // are routes that disagree with the incident's declared length.
+      const fallback = isApproximate(loc) || isUnreliable(loc);
       const polyline = L.polyline(coords, {
-        color: '#FFCC00',
-        weight: 5,
-        dashArray: '10, 10',
+        color: fallback ? '#999999' : '#FFCC00',
+        weight: fallback ? 3 : 5,
+        dashArray: fallback ? '4, 8' : '10, 10',
         dashOffset: '0'
       }).addTo(mapInstanceRef.current);
 
@@ -177,12 +183,29 @@ export function LiveMap({ fullHeight = false }: LiveMapProps) {
       eventSource.addEventListener('update', (event) => {
         try {
           const loc = JSON.parse(event.data) as MapLocationWithId;
+          // Updates replace the incident, e.g. once a fallback is re-routed.
+          removeLocation(loc.id);
           addLocation(loc);
         } catch (e) {
           console.error('Failed to parse SSE update:', e);
         }
       });
 
+      // Sent on connect, or on reconnect when the missed events are no longer
+      // buffered server-side: drop anything the snapshot no longer contains.
+      eventSource.addEventListener('snapshot', (event) => {
+        try {
+          const locs = JSON.parse(event.data) as MapLocationWithId[];
+          const ids = new Set(locs.map((loc) => loc.id));
+          for (const id of Array.from(addedIdsRef.current)) {
+            if (!ids.has(id)) removeLocation(id);
+          }
+          locs.forEach((loc) => addLocation(loc));
+        } catch (e) {
+          console.error('Failed to parse SSE snapshot:', e);
+        }
+      });
+
       eventSource.addEventListener('delete', (event) => {
         try {
           const { id } = JSON.parse(event.data) as { id: string };
@@ -234,6 +257,17 @@ export function LiveMap({ fullHeight = false }: LiveMapProps) {
   );
 }
 
+function isApproximate(loc: MapLocation): boolean {
+  return loc.routeSource === 'fallback' || loc.routeSource === 'great_circle';
+}
+
+// Below this the route likely does not follow the incident (see routing.MinRouteConfidence).
+const MIN_ROUTE_CONFIDENCE = 0.5;
+
+function isUnreliable(loc: MapLocation): boolean {
+  return loc.routeConfidence !== undefined && loc.routeConfidence < MIN_ROUTE_CONFIDENCE;
+}
+
 function createPopupContent(loc: MapLocationWithId): string {
   const icon = loc.icon || '📍';
   const severity = loc.severity || 'Unknown';
@@ -248,6 +282,9 @@ function createPopupContent(loc: MapLocationWithId): string {
       <div style="color: #666; font-size: 12px;">
         <div><strong>Severity:</strong> ${severity.charAt(0).toUpperCase() + severity.slice(1)}</div>
         <div><strong>Type:</strong> ${loc.type}</div>
+        ${isApproximate(loc) ? '<div><em>Approximate path (not routed)</em></div>' : ''}
+        ${loc.estimated ? '<div><em>Location estimated from km markers</em></div>' : ''}
+        ${isUnreliable(loc) ? '<div><em>Path may not match the declared length</em></div>' : ''}
         <div><strong>ID:</strong> ${loc.id.slice(0, 8)}...</div>
       </div>
     </div>
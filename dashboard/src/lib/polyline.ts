@@ -0,0 +1,30 @@
+import type { Coordinates } from './types';
+
+// Decodes a precision-6 encoded polyline, as sent by the API for segment paths.
+// It must match DecodePolyline in internal/routing, and decode the vectors in
+// its tests the same way.
+export function decodePolyline(encoded: string): Coordinates[] {
+  const coords: Coordinates[] = [];
+  let index = 0;
+  let lat = 0;
+  let lon = 0;
+
+  const next = () => {
+    let result = 0;
+    let shift = 0;
+    let byte: number;
+    do {
+      byte = encoded.charCodeAt(index++) - 63;
+      result += (byte & 0x1f) * 2 ** shift;
+      shift += 5;
+    } while (byte >= 0x20 && index < encoded.length);
+    return result % 2 === 1 ? -(result + 1) / 2 : result / 2;
+  };
+
+  while (index < encoded.length) {
+    lat += next();
+    lon += next();
+    coords.push({ lat: lat / 1e6, lon: lon / 1e6 });
+  }
+  return coords;
+}
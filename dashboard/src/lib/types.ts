@@ -92,6 +92,10 @@ export interface MapLocation {
   eventType?: string;
   point?: Coordinates;
   path?: Coordinates[];
+  polyline?: string; // precision-6 encoded path, at the requested detail
+  routeSource?: 'osrm' | 'valhalla' | 'graphhopper' | 'great_circle' | 'fallback'; // great_circle and fallback don't follow roads
+  estimated?: boolean; // located from km markers, the record had no coordinates
+  routeConfidence?: number; // 0-1, how well the routed distance agrees with the declared length
 }
 
 export interface ImpactSummary {
@@ -0,0 +1,266 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const (
+	// clusterCellPixels is the side of a clustering cell in screen pixels
+	// (256px tiles), so clusters look the same size at every zoom.
+	clusterCellPixels = 64
+
+	// MaxClusterZoom is the highest zoom that is clustered. Above it every
+	// incident is returned individually.
+	MaxClusterZoom = 16
+	MaxMapZoom     = 22
+
+	maxMercatorLat = 85.05112878
+)
+
+// severityRank orders severities for breaking ties in a cluster's dominant
+// severity; more severe wins.
+var severityRank = map[string]int{
+	"highest": 6,
+	"high":    5,
+	"medium":  4,
+	"low":     3,
+	"lowest":  2,
+	"none":    1,
+	"unknown": 0,
+}
+
+type cellKey struct{ x, y int }
+
+type clusterCell struct {
+	members    map[string]struct{}
+	severities map[string]int
+	icons      map[string]int
+	sumLat     float64
+	sumLon     float64
+}
+
+// ClusterIndex groups active incidents into grid clusters for every zoom up
+// to MaxClusterZoom. Each incident is placed at its anchor (the point, or the
+// midpoint of a segment) and the per-zoom grids are updated incrementally, so
+// queries only walk the cells of the requested zoom.
+type ClusterIndex struct {
+	mu        sync.RWMutex
+	locations map[string]*shared.MapLocation
+	anchors   map[string]datex.Coordinates
+	grids     [MaxClusterZoom + 1]map[cellKey]*clusterCell
+
+	// seqs holds the ID of the last event applied for each incident,
+	// deletes included, until a Reset loaded after it.
+	seqs map[string]uint64
+}
+
+func NewClusterIndex() *ClusterIndex {
+	idx := &ClusterIndex{seqs: make(map[string]uint64)}
+	idx.reset()
+	return idx
+}
+
+func (idx *ClusterIndex) reset() {
+	idx.locations = make(map[string]*shared.MapLocation)
+	idx.anchors = make(map[string]datex.Coordinates)
+	for z := range idx.grids {
+		idx.grids[z] = make(map[cellKey]*clusterCell)
+	}
+}
+
+// Reset replaces the indexed incidents with locs. It is used to seed the index
+// and to periodically resync it with the cache, whose entries can expire
+// without a deletion event. locs must have been loaded after event since was
+// applied; incidents updated or deleted by a later event keep their current
+// state, as locs may predate it.
+func (idx *ClusterIndex) Reset(locs []shared.MapLocation, since uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	newer := make(map[string]*shared.MapLocation)
+	for id, seq := range idx.seqs {
+		if seq <= since {
+			delete(idx.seqs, id)
+			continue
+		}
+		newer[id] = idx.locations[id] // nil once deleted
+	}
+
+	idx.reset()
+	for i := range locs {
+		if _, ok := newer[locs[i].ID]; !ok {
+			idx.add(&locs[i])
+		}
+	}
+	for _, loc := range newer {
+		if loc != nil {
+			idx.add(loc)
+		}
+	}
+	ClusterIndexSize.Set(float64(len(idx.locations)))
+}
+
+// Apply updates the index with a hub event. It is meant to be registered with
+// Hub.Observe.
+func (idx *ClusterIndex) Apply(ev Event) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.seqs[ev.ID] = ev.Seq
+	idx.remove(ev.ID)
+	if ev.Type == EventUpdate && ev.Location != nil {
+		idx.add(ev.Location)
+	}
+	ClusterIndexSize.Set(float64(len(idx.locations)))
+}
+
+func (idx *ClusterIndex) add(loc *shared.MapLocation) {
+	anchor, ok := loc.Anchor()
+	if !ok {
+		return
+	}
+	idx.locations[loc.ID] = loc
+	idx.anchors[loc.ID] = anchor
+
+	for z := range idx.grids {
+		key := cellOf(anchor, z)
+		cell, ok := idx.grids[z][key]
+		if !ok {
+			cell = &clusterCell{
+				members:    make(map[string]struct{}),
+				severities: make(map[string]int),
+				icons:      make(map[string]int),
+			}
+			idx.grids[z][key] = cell
+		}
+		cell.members[loc.ID] = struct{}{}
+		cell.severities[loc.Severity]++
+		cell.icons[loc.Icon]++
+		cell.sumLat += anchor.Lat
+		cell.sumLon += anchor.Lon
+	}
+}
+
+func (idx *ClusterIndex) remove(id string) {
+	loc, ok := idx.locations[id]
+	if !ok {
+		return
+	}
+	anchor := idx.anchors[id]
+	delete(idx.locations, id)
+	delete(idx.anchors, id)
+
+	for z := range idx.grids {
+		key := cellOf(anchor, z)
+		cell, ok := idx.grids[z][key]
+		if !ok {
+			continue
+		}
+		delete(cell.members, id)
+		if len(cell.members) == 0 {
+			delete(idx.grids[z], key)
+			continue
+		}
+		decrement(cell.severities, loc.Severity)
+		decrement(cell.icons, loc.Icon)
+		cell.sumLat -= anchor.Lat
+		cell.sumLon -= anchor.Lon
+	}
+}
+
+func decrement(m map[string]int, k string) {
+	if m[k] <= 1 {
+		delete(m, k)
+		return
+	}
+	m[k]--
+}
+
+// Query returns the clusters and lone incidents whose position falls inside
+// bbox at zoom. Above MaxClusterZoom every incident intersecting bbox is
+// returned unclustered.
+func (idx *ClusterIndex) Query(bbox shared.BBox, zoom int) ([]Cluster, []shared.MapLocation) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	clusters := []Cluster{}
+	incidents := []shared.MapLocation{}
+
+	if zoom > MaxClusterZoom {
+		for _, loc := range idx.locations {
+			if b, ok := loc.Bounds(); ok && bbox.Intersects(b) {
+				incidents = append(incidents, *loc)
+			}
+		}
+	} else {
+		for key, cell := range idx.grids[zoom] {
+			n := len(cell.members)
+			center := datex.Coordinates{Lat: cell.sumLat / float64(n), Lon: cell.sumLon / float64(n)}
+			if n == 1 {
+				for id := range cell.members {
+					if bbox.Contains(idx.anchors[id]) {
+						incidents = append(incidents, *idx.locations[id])
+					}
+				}
+				continue
+			}
+			if !bbox.Contains(center) {
+				continue
+			}
+			clusters = append(clusters, Cluster{
+				ID:         fmt.Sprintf("%d/%d/%d", zoom, key.x, key.y),
+				Lat:        center.Lat,
+				Lon:        center.Lon,
+				Count:      n,
+				Severity:   dominantSeverity(cell.severities),
+				Severities: copyCounts(cell.severities),
+				Icons:      copyCounts(cell.icons),
+			})
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Count != clusters[j].Count {
+			return clusters[i].Count > clusters[j].Count
+		}
+		return clusters[i].ID < clusters[j].ID
+	})
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].ID < incidents[j].ID })
+	return clusters, incidents
+}
+
+func dominantSeverity(counts map[string]int) string {
+	var best string
+	bestCount := -1
+	for s, n := range counts {
+		if n > bestCount || (n == bestCount && severityRank[s] > severityRank[best]) {
+			best, bestCount = s, n
+		}
+	}
+	return best
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// cellOf returns the Web Mercator grid cell containing c at zoom z.
+func cellOf(c datex.Coordinates, z int) cellKey {
+	cells := (256 << z) / clusterCellPixels
+	world := float64(cells)
+	lat := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, c.Lat)) * math.Pi / 180
+
+	x := (c.Lon + 180) / 360 * world
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * world
+	return cellKey{x: int(math.Floor(x)), y: int(math.Floor(y))}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+func TestClusterIndexResetKeepsNewerEvents(t *testing.T) {
+	at := func(id string) shared.MapLocation {
+		return shared.MapLocation{ID: id, Point: &datex.Coordinates{Lat: 40.4, Lon: -3.7}}
+	}
+
+	hub := NewHub(8, 8)
+	idx := NewClusterIndex()
+	hub.Observe(idx.Apply)
+	hub.Publish(Event{Type: EventUpdate, ID: "old", Location: ptr(at("old"))})
+	hub.Publish(Event{Type: EventUpdate, ID: "deleted", Location: ptr(at("deleted"))})
+
+	// Loaded from the cache while "added" is published and "deleted" deleted
+	since := hub.Seq()
+	snapshot := []shared.MapLocation{at("old"), at("deleted")}
+	hub.Publish(Event{Type: EventUpdate, ID: "added", Location: ptr(at("added"))})
+	hub.Publish(Event{Type: EventDelete, ID: "deleted"})
+
+	idx.Reset(snapshot, since)
+
+	_, locs := idx.Query(shared.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}, MaxMapZoom)
+	got := make(map[string]bool)
+	for _, loc := range locs {
+		got[loc.ID] = true
+	}
+	for id, want := range map[string]bool{"old": true, "added": true, "deleted": false} {
+		if got[id] != want {
+			t.Errorf("incident %q indexed = %v, want %v", id, got[id], want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
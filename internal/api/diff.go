@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// FieldChange is a single leaf value that differs between two versions of an
+// incident. Field is a dotted path into the DATEX record, with array indexes
+// in brackets (e.g. "cause.subtypes[1]"). From or To is omitted when the field
+// was added or removed.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from,omitempty"`
+	To    any    `json:"to,omitempty"`
+}
+
+// diffJSON compares two JSON documents field by field. Documents that fail to
+// parse are treated as empty, so every field of the other shows as changed.
+func diffJSON(before, after string) []FieldChange {
+	a, b := map[string]any{}, map[string]any{}
+	flatten("", decodeJSON(before), a)
+	flatten("", decodeJSON(after), b)
+
+	fields := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		fields = append(fields, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	var changes []FieldChange
+	for _, f := range fields {
+		from, inA := a[f]
+		to, inB := b[f]
+		if inA && inB && reflect.DeepEqual(from, to) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: f, From: from, To: to})
+	}
+	return changes
+}
+
+func decodeJSON(s string) any {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+func flatten(prefix string, v any, out map[string]any) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flatten(path, child, out)
+		}
+	case []any:
+		for i, child := range t {
+			flatten(prefix+"["+strconv.Itoa(i)+"]", child, out)
+		}
+	case nil:
+		if prefix != "" {
+			out[prefix] = nil
+		}
+	default:
+		out[prefix] = t
+	}
+}
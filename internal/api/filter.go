@@ -0,0 +1,268 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image ships without a zoneinfo database
+
+	"github.com/sverdejot/beacon/internal/shared"
+)
+
+const (
+	defaultRange    = "7d"
+	defaultTimezone = "Europe/Madrid"
+	maxWindowDays   = 366
+	maxFilterValue  = 128
+)
+
+var ranges = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// timezones lists the zones the dashboard may group by. Peninsular Spain,
+// the Balearics, Ceuta and Melilla use Europe/Madrid; the Canary Islands run
+// one hour behind on Atlantic/Canary.
+var timezones = map[string]bool{
+	"Europe/Madrid":   true,
+	"Atlantic/Canary": true,
+	"UTC":             true,
+}
+
+var severities = map[string]bool{
+	"lowest":  true,
+	"low":     true,
+	"medium":  true,
+	"high":    true,
+	"highest": true,
+	"none":    true,
+	"unknown": true,
+}
+
+// Filter narrows dashboard queries to a time window and, optionally, a single
+// province, severity, cause type, road and bounding box. It is parsed once per
+// request and applied by every Repository method.
+//
+// The window is always resolved to absolute From/To instants, either from a
+// relative Range ending now or from explicit from/to parameters. Location is
+// the timezone used for day and hour boundaries.
+type Filter struct {
+	Range    string // empty when the window was given with from/to
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+	Province string
+	Severity string
+	Cause    string
+	Road     string
+	BBox     *shared.BBox
+}
+
+// ParseFilter builds a Filter from the query parameters sent by the dashboard
+// (range or from/to, tz, province, severity, cause, road, bbox). Unknown ranges,
+// timezones and severities are rejected so a typo never silently widens the
+// query.
+//
+// from and to accept RFC 3339 timestamps or plain dates. Dates are read in tz,
+// and a date-only to includes that whole day.
+func ParseFilter(q url.Values) (Filter, error) {
+	f := Filter{
+		Range:    strings.TrimSpace(q.Get("range")),
+		Province: strings.TrimSpace(q.Get("province")),
+		Severity: strings.ToLower(strings.TrimSpace(q.Get("severity"))),
+		Cause:    strings.TrimSpace(q.Get("cause")),
+		Road:     strings.TrimSpace(q.Get("road")),
+	}
+
+	tz := strings.TrimSpace(q.Get("tz"))
+	if tz == "" {
+		tz = defaultTimezone
+	}
+	if !timezones[tz] {
+		return Filter{}, fmt.Errorf("invalid tz %q", tz)
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return Filter{}, fmt.Errorf("failed to load tz %q: %w", tz, err)
+	}
+	f.Location = loc
+
+	if err := f.resolveWindow(q.Get("from"), q.Get("to"), time.Now()); err != nil {
+		return Filter{}, err
+	}
+
+	if f.Severity != "" && !severities[f.Severity] {
+		return Filter{}, fmt.Errorf("invalid severity %q", f.Severity)
+	}
+
+	for name, v := range map[string]string{"province": f.Province, "cause": f.Cause, "road": f.Road} {
+		if len(v) > maxFilterValue {
+			return Filter{}, fmt.Errorf("%s exceeds %d characters", name, maxFilterValue)
+		}
+	}
+
+	if raw := strings.TrimSpace(q.Get("bbox")); raw != "" {
+		bbox, err := shared.ParseBBox(raw)
+		if err != nil {
+			return Filter{}, err
+		}
+		f.BBox = &bbox
+	}
+
+	return f, nil
+}
+
+func (f *Filter) resolveWindow(from, to string, now time.Time) error {
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+
+	if from == "" && to == "" {
+		if f.Range == "" {
+			f.Range = defaultRange
+		}
+		d, ok := ranges[f.Range]
+		if !ok {
+			return fmt.Errorf("invalid range %q", f.Range)
+		}
+		f.From, f.To = now.Add(-d), now
+		return nil
+	}
+
+	if f.Range != "" {
+		return errors.New("range cannot be combined with from/to")
+	}
+	if from == "" {
+		return errors.New("from is required when to is set")
+	}
+
+	var err error
+	if f.From, err = parseInstant(from, f.Location, false); err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	f.To = now
+	if to != "" {
+		if f.To, err = parseInstant(to, f.Location, true); err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	if !f.From.Before(f.To) {
+		return errors.New("from must be before to")
+	}
+	// Counted in calendar days so a window spanning a DST change is not an
+	// hour over.
+	if f.To.After(f.From.In(f.Location).AddDate(0, 0, maxWindowDays)) {
+		return fmt.Errorf("window exceeds %d days", maxWindowDays)
+	}
+	return nil
+}
+
+// parseInstant reads an RFC 3339 timestamp, a local timestamp or a date in
+// loc. With endOfDay, a bare date resolves to the start of the following day
+// so the window includes the whole date.
+func parseInstant(s string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date or RFC 3339 timestamp", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// location returns the filter's timezone, falling back to the default zone for
+// filters not built by ParseFilter.
+func (f Filter) location() *time.Location {
+	if f.Location != nil {
+		return f.Location
+	}
+	if loc, err := time.LoadLocation(defaultTimezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// tz returns the IANA name of the filter's timezone, for use as the timezone
+// argument of ClickHouse date functions.
+func (f Filter) tz() string {
+	return f.location().String()
+}
+
+// today returns midnight of the current day in the filter's timezone.
+func (f Filter) today() time.Time {
+	loc := f.location()
+	y, m, d := time.Now().In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// Window returns the resolved window for echoing back in responses.
+func (f Filter) Window() Window {
+	loc := f.location()
+	return Window{
+		From:     f.From.In(loc),
+		To:       f.To.In(loc),
+		Range:    f.Range,
+		Timezone: loc.String(),
+	}
+}
+
+// todayWindow returns the window from midnight to now in the filter's
+// timezone, echoed by responses that are scoped to the current day.
+func (f Filter) todayWindow() Window {
+	today := f.today()
+	return Window{From: today, To: time.Now().In(today.Location()), Timezone: f.tz()}
+}
+
+// hasDimensions reports whether any filter other than the time window is set.
+func (f Filter) hasDimensions() bool {
+	return f.Province != "" || f.Severity != "" || f.Cause != "" || f.Road != "" || f.BBox != nil
+}
+
+// where renders the time window and dimension filters as SQL conditions joined
+// by AND, together with their positional arguments.
+func (f Filter) where() (string, []any) {
+	dims, args := f.dimensions()
+	return "timestamp >= ? AND timestamp < ? AND " + dims, append([]any{f.From, f.To}, args...)
+}
+
+// dimensions renders only the province/severity/cause/road/bbox conditions. It is
+// used by queries whose time window is fixed by their meaning (active
+// incidents, today's totals, anomaly baselines).
+func (f Filter) dimensions() (string, []any) {
+	conds := []string{"1 = 1"}
+	var args []any
+
+	if f.Province != "" {
+		conds = append(conds, "province = ?")
+		args = append(args, f.Province)
+	}
+	if f.Severity != "" {
+		conds = append(conds, "severity = ?")
+		args = append(args, f.Severity)
+	}
+	if f.Cause != "" {
+		conds = append(conds, "cause_type = ?")
+		args = append(args, f.Cause)
+	}
+	if f.Road != "" {
+		conds = append(conds, "(road_name = ? OR road_number = ?)")
+		args = append(args, f.Road, f.Road)
+	}
+	if f.BBox != nil {
+		conds = append(conds, "lat BETWEEN ? AND ? AND lon BETWEEN ? AND ?")
+		args = append(args, f.BBox.MinLat, f.BBox.MaxLat, f.BBox.MinLon, f.BBox.MaxLon)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
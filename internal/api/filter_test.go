@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestResolveWindow(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	utc := func(s string) time.Time {
+		t.Helper()
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	tests := []struct {
+		name     string
+		tz       string
+		rng      string
+		from, to string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  string
+	}{
+		{name: "default range ends now", tz: "Europe/Madrid",
+			wantFrom: now.Add(-7 * 24 * time.Hour), wantTo: now},
+		{name: "relative range ignores tz", tz: "Atlantic/Canary", rng: "24h",
+			wantFrom: now.Add(-24 * time.Hour), wantTo: now},
+		{name: "unknown range", tz: "Europe/Madrid", rng: "2d", wantErr: `invalid range "2d"`},
+
+		// Clocks go forward on 2026-03-29 at 01:00 UTC in both zones.
+		{name: "spring forward day in Madrid is 23 hours", tz: "Europe/Madrid", from: "2026-03-29", to: "2026-03-29",
+			wantFrom: utc("2026-03-28T23:00:00Z"), wantTo: utc("2026-03-29T22:00:00Z")},
+		{name: "spring forward day in the Canaries is 23 hours", tz: "Atlantic/Canary", from: "2026-03-29", to: "2026-03-29",
+			wantFrom: utc("2026-03-29T00:00:00Z"), wantTo: utc("2026-03-29T23:00:00Z")},
+		// And back on 2026-10-25 at 01:00 UTC.
+		{name: "fall back day in Madrid is 25 hours", tz: "Europe/Madrid", from: "2026-10-25", to: "2026-10-25",
+			wantFrom: utc("2026-10-24T22:00:00Z"), wantTo: utc("2026-10-25T23:00:00Z")},
+		{name: "fall back day in the Canaries is 25 hours", tz: "Atlantic/Canary", from: "2026-10-25", to: "2026-10-25",
+			wantFrom: utc("2026-10-24T23:00:00Z"), wantTo: utc("2026-10-26T00:00:00Z")},
+
+		{name: "local timestamps are read in tz", tz: "Atlantic/Canary", from: "2026-03-29T12:00:00", to: "2026-03-29T13:00:00",
+			wantFrom: utc("2026-03-29T11:00:00Z"), wantTo: utc("2026-03-29T12:00:00Z")},
+		{name: "RFC 3339 timestamps keep their offset", tz: "Europe/Madrid", from: "2026-03-29T12:00:00Z", to: "2026-03-29T15:00:00+02:00",
+			wantFrom: utc("2026-03-29T12:00:00Z"), wantTo: utc("2026-03-29T13:00:00Z")},
+		{name: "missing to ends now", tz: "Europe/Madrid", from: "2026-06-01",
+			wantFrom: utc("2026-05-31T22:00:00Z"), wantTo: now},
+
+		{name: "366 days", tz: "UTC", from: "2024-01-01", to: "2024-12-31",
+			wantFrom: utc("2024-01-01T00:00:00Z"), wantTo: utc("2025-01-01T00:00:00Z")},
+		{name: "367 days", tz: "UTC", from: "2024-01-01", to: "2025-01-01", wantErr: "window exceeds 366 days"},
+		{name: "366 days over a fall back in Madrid", tz: "Europe/Madrid", from: "2025-10-25", to: "2026-10-25",
+			wantFrom: utc("2025-10-24T22:00:00Z"), wantTo: utc("2026-10-25T23:00:00Z")},
+		{name: "366 days over a fall back in the Canaries", tz: "Atlantic/Canary", from: "2025-10-25", to: "2026-10-25",
+			wantFrom: utc("2025-10-24T23:00:00Z"), wantTo: utc("2026-10-26T00:00:00Z")},
+		{name: "367 days over a spring forward in Madrid", tz: "Europe/Madrid", from: "2025-03-29", to: "2026-03-30",
+			wantErr: "window exceeds 366 days"},
+
+		{name: "range with from", tz: "Europe/Madrid", rng: "7d", from: "2026-06-01", wantErr: "range cannot be combined with from/to"},
+		{name: "to without from", tz: "Europe/Madrid", to: "2026-06-01", wantErr: "from is required when to is set"},
+		{name: "unparseable from", tz: "Europe/Madrid", from: "01/06/2026", wantErr: "invalid from"},
+		{name: "to before from", tz: "Europe/Madrid", from: "2026-06-02", to: "2026-06-01T12:00:00", wantErr: "from must be before to"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Filter{Range: tt.rng, Location: mustLoadLocation(t, tt.tz)}
+			err := f.resolveWindow(tt.from, tt.to, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.From.Equal(tt.wantFrom) || !f.To.Equal(tt.wantTo) {
+				t.Errorf("got window %s to %s, want %s to %s", f.From.UTC(), f.To.UTC(), tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantTZ  string
+		wantErr string
+	}{
+		{name: "defaults to Madrid", query: url.Values{}, wantTZ: "Europe/Madrid"},
+		{name: "Canary Islands", query: url.Values{"tz": {"Atlantic/Canary"}}, wantTZ: "Atlantic/Canary"},
+		{name: "zone outside the list", query: url.Values{"tz": {"Europe/Lisbon"}}, wantErr: `invalid tz "Europe/Lisbon"`},
+		{name: "unknown severity", query: url.Values{"severity": {"severe"}}, wantErr: `invalid severity "severe"`},
+		{name: "severity is case-insensitive", query: url.Values{"severity": {"High"}}, wantTZ: "Europe/Madrid"},
+		{name: "overlong road", query: url.Values{"road": {strings.Repeat("a", maxFilterValue+1)}}, wantErr: "road exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilter(tt.query)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Location.String(); got != tt.wantTZ {
+				t.Errorf("got tz %s, want %s", got, tt.wantTZ)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const geoJSONContentType = "application/geo+json"
+
+// GeoJSONResponse is a FeatureCollection with the same window and paging
+// members as the JSON responses, kept as GeoJSON foreign members.
+type GeoJSONResponse struct {
+	shared.FeatureCollection
+	NextCursor string  `json:"next_cursor,omitempty"`
+	Window     *Window `json:"window,omitempty"`
+}
+
+// WantsGeoJSON reports whether the client asked for GeoJSON, either with
+// ?format=geojson or an Accept header listing application/geo+json. It marks
+// the response as varying on Accept.
+func WantsGeoJSON(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Accept")
+	if strings.EqualFold(r.URL.Query().Get("format"), "geojson") {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), geoJSONContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func WriteGeoJSON(w http.ResponseWriter, data GeoJSONResponse) {
+	w.Header().Set("Content-Type", geoJSONContentType)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error(fmt.Sprintf("failed to encode geojson response: %s", err))
+	}
+}
+
+// MapLocationFeatures converts map locations into features.
+func MapLocationFeatures(locations []shared.MapLocation) shared.FeatureCollection {
+	features := make([]shared.Feature, len(locations))
+	for i := range locations {
+		features[i] = locations[i].Feature()
+	}
+	return shared.NewFeatureCollection(features)
+}
+
+// NearbyLocationFeatures converts proximity results into features, adding
+// the distance from the search point as the proximity property.
+func NearbyLocationFeatures(nearby []shared.NearbyLocation) shared.FeatureCollection {
+	features := make([]shared.Feature, len(nearby))
+	for i := range nearby {
+		features[i] = nearby[i].Feature()
+		features[i].Properties["proximity"] = nearby[i].Proximity
+	}
+	return shared.NewFeatureCollection(features)
+}
+
+func hotspotFeatures(hotspots []Hotspot) shared.FeatureCollection {
+	features := make([]shared.Feature, len(hotspots))
+	for i, h := range hotspots {
+		features[i] = shared.NewFeature("", shared.PointGeometry(datex.Coordinates{Lat: h.Lat, Lon: h.Lon}), map[string]any{
+			"incident_count": h.IncidentCount,
+			"recurrence":     h.Recurrence,
+			"top_cause":      h.TopCause,
+			"avg_severity":   h.AvgSeverity,
+		})
+	}
+	return shared.NewFeatureCollection(features)
+}
+
+func heatmapFeatures(points []HeatmapPoint) shared.FeatureCollection {
+	features := make([]shared.Feature, len(points))
+	for i, p := range points {
+		features[i] = shared.NewFeature("", shared.PointGeometry(datex.Coordinates{Lat: p.Lat, Lon: p.Lon}), map[string]any{
+			"weight": p.Weight,
+		})
+	}
+	return shared.NewFeatureCollection(features)
+}
+
+func incidentFeatures(incidents []Incident) shared.FeatureCollection {
+	features := make([]shared.Feature, len(incidents))
+	for i, inc := range incidents {
+		// Routed segments are drawn along their stored path, the rest at
+		// their point.
+		var geometry *shared.Geometry
+		if path, err := routing.DecodePolyline(inc.Polyline); err == nil && len(path) > 1 {
+			geometry = shared.LineStringGeometry(path)
+		} else if c := (datex.Coordinates{Lat: inc.Lat, Lon: inc.Lon}); !c.Empty() {
+			geometry = shared.PointGeometry(c)
+		}
+
+		props := map[string]any{
+			"version":     inc.Version,
+			"timestamp":   inc.Timestamp,
+			"record_type": inc.RecordType,
+			"province":    inc.Province,
+		}
+		for k, v := range map[string]string{
+			"name":          inc.Name,
+			"municipality":  inc.Municipality,
+			"severity":      inc.Severity,
+			"cause_type":    inc.CauseType,
+			"mobility":      inc.Mobility,
+			"location_type": inc.LocationType,
+			"road_name":     inc.RoadName,
+			"road_number":   inc.RoadNumber,
+			"direction":     inc.Direction,
+		} {
+			if v != "" {
+				props[k] = v
+			}
+		}
+		if inc.EndTimestamp != nil {
+			props["end_timestamp"] = *inc.EndTimestamp
+		}
+		if len(inc.CauseSubtypes) > 0 {
+			props["cause_subtypes"] = inc.CauseSubtypes
+		}
+		if inc.LengthMeters > 0 {
+			props["length_meters"] = inc.LengthMeters
+		}
+		if inc.DelayMinutes > 0 {
+			props["delay_minutes"] = inc.DelayMinutes
+		}
+
+		features[i] = shared.NewFeature(inc.ID, geometry, props)
+	}
+	return shared.NewFeatureCollection(features)
+}
@@ -7,7 +7,11 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
 )
 
 // ActiveCounter provides the count of active incidents from cache.
@@ -15,12 +19,23 @@ type ActiveCounter interface {
 	GetActiveCount(ctx context.Context) (int64, error)
 }
 
+// LiveCache provides live incident data from cache.
+type LiveCache interface {
+	ActiveCounter
+	GetMapLocation(ctx context.Context, id string) (*shared.MapLocation, error)
+	GetMapLocationsInBBox(ctx context.Context, bbox shared.BBox) ([]shared.MapLocation, error)
+}
+
 type Handler struct {
 	repo  *Repository
-	cache ActiveCounter
+	cache LiveCache
+
+	// summarySeq numbers summary events. A summary is a full snapshot, so a
+	// reconnecting client is simply sent the latest one rather than a replay.
+	summarySeq atomic.Uint64
 }
 
-func NewHandler(repo *Repository, cache ActiveCounter) *Handler {
+func NewHandler(repo *Repository, cache LiveCache) *Handler {
 	return &Handler{repo: repo, cache: cache}
 }
 
@@ -43,6 +58,9 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/dashboard/patterns/rush-hour", h.handleRushHourComparison)
 	mux.HandleFunc("GET /api/dashboard/hotspots", h.handleHotspots)
 	mux.HandleFunc("GET /api/dashboard/anomalies", h.handleAnomalies)
+	mux.HandleFunc("GET /api/incidents", h.handleIncidents)
+	mux.HandleFunc("GET /api/incidents/{id}", h.handleIncident)
+	mux.HandleFunc("GET /tiles/{layer}/{z}/{x}/{y}", h.handleTile)
 }
 
 func (h *Handler) writeJSON(w http.ResponseWriter, data any) {
@@ -58,16 +76,33 @@ func (h *Handler) writeError(w http.ResponseWriter, msg string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg}) //nolint:errcheck
 }
 
+// parseFilter parses the dashboard filter from the query string, writing a
+// 400 response and returning false when it is invalid.
+func (h *Handler) parseFilter(w http.ResponseWriter, r *http.Request) (Filter, bool) {
+	f, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		h.writeError(w, err.Error(), http.StatusBadRequest)
+		return Filter{}, false
+	}
+	return f, true
+}
+
 func (h *Handler) handleSummary(w http.ResponseWriter, r *http.Request) {
-	summary, err := h.repo.GetSummary(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := h.repo.GetSummary(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get summary: %s", err))
 		h.writeError(w, "failed to get summary", http.StatusInternalServerError)
 		return
 	}
 
-	// Override active count from Valkey (source of truth for live data)
-	if h.cache != nil {
+	// Override active count from Valkey (source of truth for live data). The
+	// cache only knows the global count, so filtered requests keep ClickHouse's.
+	if h.cache != nil && !f.hasDimensions() {
 		count, err := h.cache.GetActiveCount(r.Context())
 		if err != nil {
 			slog.Warn(fmt.Sprintf("failed to get active count from cache, using clickhouse: %s", err))
@@ -80,56 +115,86 @@ func (h *Handler) handleSummary(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleHourlyTrend(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetHourlyTrend(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetHourlyTrend(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get hourly trend: %s", err))
 		h.writeError(w, "failed to get hourly trend", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, HourlyTrendResponse{Data: data})
+	h.writeJSON(w, HourlyTrendResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleDailyTrend(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetDailyTrend(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetDailyTrend(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get daily trend: %s", err))
 		h.writeError(w, "failed to get daily trend", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DailyTrendResponse{Data: data})
+	h.writeJSON(w, DailyTrendResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleSeverityDistribution(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetSeverityDistribution(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetSeverityDistribution(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get severity distribution: %s", err))
 		h.writeError(w, "failed to get severity distribution", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DistributionResponse{Data: data})
+	h.writeJSON(w, DistributionResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleCauseTypeDistribution(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetCauseTypeDistribution(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetCauseTypeDistribution(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get cause type distribution: %s", err))
 		h.writeError(w, "failed to get cause type distribution", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DistributionResponse{Data: data})
+	h.writeJSON(w, DistributionResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleProvinceDistribution(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetProvinceDistribution(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetProvinceDistribution(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get province distribution: %s", err))
 		h.writeError(w, "failed to get province distribution", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DistributionResponse{Data: data})
+	h.writeJSON(w, DistributionResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleTopRoads(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
 	limit := 10
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
@@ -137,16 +202,21 @@ func (h *Handler) handleTopRoads(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.repo.GetTopRoads(r.Context(), limit)
+	data, err := h.repo.GetTopRoads(r.Context(), f, limit)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get top roads: %s", err))
 		h.writeError(w, "failed to get top roads", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, TopRoadsResponse{Data: data})
+	h.writeJSON(w, TopRoadsResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleTopSubtypes(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
 	limit := 20
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
@@ -154,27 +224,42 @@ func (h *Handler) handleTopSubtypes(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.repo.GetTopSubtypes(r.Context(), limit)
+	data, err := h.repo.GetTopSubtypes(r.Context(), f, limit)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get top subtypes: %s", err))
 		h.writeError(w, "failed to get top subtypes", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, TopSubtypesResponse{Data: data})
+	h.writeJSON(w, TopSubtypesResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleHeatmap(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetHeatmapData(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetHeatmapData(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get heatmap data: %s", err))
 		h.writeError(w, "failed to get heatmap data", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, HeatmapResponse{Data: data})
+	window := f.Window()
+	if WantsGeoJSON(w, r) {
+		WriteGeoJSON(w, GeoJSONResponse{FeatureCollection: heatmapFeatures(data), Window: &window})
+		return
+	}
+	h.writeJSON(w, HeatmapResponse{Data: data, Window: window})
 }
 
 func (h *Handler) handleActiveIncidents(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetActiveIncidents(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetActiveIncidents(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get active incidents: %s", err))
 		h.writeError(w, "failed to get active incidents", http.StatusInternalServerError)
@@ -184,6 +269,11 @@ func (h *Handler) handleActiveIncidents(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *Handler) handleSSE(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
 	SSEConnectionsTotal.Inc()
 	SSEConnectionsActive.Inc()
 	defer SSEConnectionsActive.Dec()
@@ -194,7 +284,7 @@ func (h *Handler) handleSSE(w http.ResponseWriter, r *http.Request) {
 
 	rc := http.NewResponseController(w)
 
-	if err := h.sendSummaryEvent(r.Context(), w, rc); err != nil {
+	if err := h.sendSummaryEvent(r.Context(), w, rc, f); err != nil {
 		slog.Error(fmt.Sprintf("failed to send initial summary: %s", err))
 		return
 	}
@@ -207,7 +297,7 @@ func (h *Handler) handleSSE(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			return
 		case <-ticker.C:
-			if err := h.sendSummaryEvent(r.Context(), w, rc); err != nil {
+			if err := h.sendSummaryEvent(r.Context(), w, rc, f); err != nil {
 				slog.Error(fmt.Sprintf("failed to send summary event: %s", err))
 				return
 			}
@@ -215,14 +305,14 @@ func (h *Handler) handleSSE(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) sendSummaryEvent(ctx context.Context, w http.ResponseWriter, rc *http.ResponseController) error {
-	summary, err := h.repo.GetSummary(ctx)
+func (h *Handler) sendSummaryEvent(ctx context.Context, w http.ResponseWriter, rc *http.ResponseController, f Filter) error {
+	summary, err := h.repo.GetSummary(ctx, f)
 	if err != nil {
 		return err
 	}
 
 	// Override active count from Valkey (source of truth for live data)
-	if h.cache != nil {
+	if h.cache != nil && !f.hasDimensions() {
 		count, err := h.cache.GetActiveCount(ctx)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("failed to get active count from cache: %s", err))
@@ -236,32 +326,47 @@ func (h *Handler) sendSummaryEvent(ctx context.Context, w http.ResponseWriter, r
 		return err
 	}
 
-	fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data) //nolint:errcheck
+	fmt.Fprintf(w, "id: %d\nevent: summary\ndata: %s\n\n", h.summarySeq.Add(1), data) //nolint:errcheck
 	SSEEventsTotal.WithLabelValues("summary").Inc()
 	return rc.Flush()
 }
 
 func (h *Handler) handleImpactSummary(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetImpactSummary(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetImpactSummary(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get impact summary: %s", err))
 		h.writeError(w, "failed to get impact summary", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, ImpactSummaryResponse{Data: data})
+	h.writeJSON(w, ImpactSummaryResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleDurationDistribution(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetDurationDistribution(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetDurationDistribution(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get duration distribution: %s", err))
 		h.writeError(w, "failed to get duration distribution", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DurationDistributionResponse{Data: data})
+	h.writeJSON(w, DurationDistributionResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleRouteAnalysis(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
 	limit := 20
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
@@ -269,36 +374,51 @@ func (h *Handler) handleRouteAnalysis(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.repo.GetRouteAnalysis(r.Context(), limit)
+	data, err := h.repo.GetRouteAnalysis(r.Context(), f, limit)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get route analysis: %s", err))
 		h.writeError(w, "failed to get route analysis", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, RouteAnalysisResponse{Data: data})
+	h.writeJSON(w, RouteAnalysisResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleDirectionAnalysis(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetDirectionAnalysis(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetDirectionAnalysis(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get direction analysis: %s", err))
 		h.writeError(w, "failed to get direction analysis", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, DirectionAnalysisResponse{Data: data})
+	h.writeJSON(w, DirectionAnalysisResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleRushHourComparison(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetRushHourComparison(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetRushHourComparison(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get rush hour comparison: %s", err))
 		h.writeError(w, "failed to get rush hour comparison", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, RushHourResponse{Data: data})
+	h.writeJSON(w, RushHourResponse{Data: data, Window: f.Window()})
 }
 
 func (h *Handler) handleHotspots(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
 	limit := 50
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
@@ -306,21 +426,103 @@ func (h *Handler) handleHotspots(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.repo.GetHotspots(r.Context(), limit)
+	data, err := h.repo.GetHotspots(r.Context(), f, limit)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get hotspots: %s", err))
 		h.writeError(w, "failed to get hotspots", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, HotspotsResponse{Data: data})
+	window := f.Window()
+	if WantsGeoJSON(w, r) {
+		WriteGeoJSON(w, GeoJSONResponse{FeatureCollection: hotspotFeatures(data), Window: &window})
+		return
+	}
+	h.writeJSON(w, HotspotsResponse{Data: data, Window: window})
 }
 
 func (h *Handler) handleAnomalies(w http.ResponseWriter, r *http.Request) {
-	data, err := h.repo.GetAnomalies(r.Context())
+	f, ok := h.parseFilter(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.repo.GetAnomalies(r.Context(), f)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to get anomalies: %s", err))
 		h.writeError(w, "failed to get anomalies", http.StatusInternalServerError)
 		return
 	}
-	h.writeJSON(w, AnomaliesResponse{Data: data})
+	h.writeJSON(w, AnomaliesResponse{Data: data, Window: f.todayWindow()})
+}
+
+func (h *Handler) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	iq, err := ParseIncidentQuery(r.URL.Query())
+	if err != nil {
+		h.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, more, err := h.repo.SearchIncidents(r.Context(), iq)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to search incidents: %s", err))
+		h.writeError(w, "failed to search incidents", http.StatusInternalServerError)
+		return
+	}
+
+	resp := IncidentsResponse{Data: data, Window: iq.Window()}
+	if more {
+		resp.NextCursor = iq.nextCursor(data[len(data)-1])
+	}
+	if WantsGeoJSON(w, r) {
+		WriteGeoJSON(w, GeoJSONResponse{
+			FeatureCollection: incidentFeatures(data),
+			NextCursor:        resp.NextCursor,
+			Window:            &resp.Window,
+		})
+		return
+	}
+	h.writeJSON(w, resp)
+}
+
+func (h *Handler) handleIncident(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" || len(id) > maxFilterValue {
+		h.writeError(w, "invalid incident id", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := h.repo.GetIncidentVersions(r.Context(), id)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to get incident versions: %s", err))
+		h.writeError(w, "failed to get incident", http.StatusInternalServerError)
+		return
+	}
+
+	detail := &IncidentDetail{ID: id, Versions: versions}
+	for i := 1; i < len(versions); i++ {
+		versions[i].Changes = diffJSON(versions[i-1].RawJSON, versions[i].RawJSON)
+	}
+	if len(versions) > 0 {
+		var record datex.Record
+		if err := json.Unmarshal([]byte(versions[len(versions)-1].RawJSON), &record); err != nil {
+			slog.Warn(fmt.Sprintf("failed to decode stored record %s: %s", id, err))
+		} else {
+			detail.Record = &record
+		}
+	}
+
+	// The cache only holds live incidents; ended ones have no geometry.
+	if h.cache != nil {
+		if loc, err := h.cache.GetMapLocation(r.Context(), id); err == nil {
+			loc.Polylines = nil // the full path is already included
+			detail.Location = loc
+		}
+	}
+
+	if len(versions) == 0 && detail.Location == nil {
+		h.writeError(w, "incident not found", http.StatusNotFound)
+		return
+	}
+
+	h.writeJSON(w, IncidentDetailResponse{Data: detail})
 }
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/shared"
+)
+
+const (
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Event is a live map change fanned out to every subscriber of a Hub.
+type Event struct {
+	Seq      uint64              // monotonic event ID, sent to SSE clients as id:
+	Type     string              // EventUpdate or EventDelete
+	ID       string              // incident ID
+	Location *shared.MapLocation // nil for deletes
+	Previous *shared.MapLocation // last location the hub published for ID, if any
+}
+
+// Hub fans live map events out to every connected client. Each subscriber
+// gets its own bounded queue; a subscriber whose queue is full when an event
+// is published is evicted rather than allowed to stall the others.
+//
+// The hub remembers the last location published for every active incident so
+// filtered subscribers can be told when an incident leaves their view, and
+// keeps the most recent events in a bounded buffer so reconnecting clients can
+// resume from their last event ID.
+//
+// Event IDs start at the hub's creation time in microseconds, so IDs issued
+// before a restart are always older than the replay buffer and fall back to a
+// snapshot instead of being mistaken for recent ones.
+type Hub struct {
+	mu        sync.RWMutex
+	subs      map[*Subscriber]struct{}
+	queueSize int
+	seq       uint64
+	replay    []Event // ring buffer ordered by Seq, oldest at head
+	replayCap int
+	head      int
+	last      map[string]lastLocation
+	observers []func(Event)
+}
+
+func NewHub(queueSize, replaySize int) *Hub {
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	return &Hub{
+		subs:      make(map[*Subscriber]struct{}),
+		queueSize: queueSize,
+		seq:       uint64(time.Now().UnixMicro()),
+		replay:    make([]Event, 0, max(replaySize, 0)),
+		replayCap: max(replaySize, 0),
+		last:      make(map[string]lastLocation),
+	}
+}
+
+// lastLocation is the last location the hub published for an incident, and
+// the ID of the event that did.
+type lastLocation struct {
+	loc *shared.MapLocation
+	seq uint64
+}
+
+// Subscriber is a single client's view of the hub.
+type Subscriber struct {
+	events    chan Event
+	evicted   chan struct{}
+	once      sync.Once
+	delivered atomic.Int64
+	start     uint64
+
+	filterMu sync.RWMutex
+	filter   StreamFilter
+	paused   bool
+}
+
+// Events returns the subscriber's queue.
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Evicted is closed when the hub drops the subscriber for falling behind.
+func (s *Subscriber) Evicted() <-chan struct{} {
+	return s.evicted
+}
+
+// Delivered returns how many events were queued for the subscriber.
+func (s *Subscriber) Delivered() int64 {
+	return s.delivered.Load()
+}
+
+// Start returns the ID of the last event published before the subscriber
+// joined. A snapshot sent to the subscriber should carry this ID.
+func (s *Subscriber) Start() uint64 {
+	return s.start
+}
+
+// Filter returns the subscriber's current filter.
+func (s *Subscriber) Filter() StreamFilter {
+	s.filterMu.RLock()
+	defer s.filterMu.RUnlock()
+	return s.filter
+}
+
+// SetFilter replaces the subscriber's filter and resumes delivery if it was
+// paused. Events already queued were routed with the previous filter.
+func (s *Subscriber) SetFilter(f StreamFilter) {
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+	s.filter = f
+	s.paused = false
+}
+
+// Pause stops delivery to the subscriber until the next SetFilter, without
+// giving up its place in the hub.
+func (s *Subscriber) Pause() {
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+	s.paused = true
+}
+
+func (s *Subscriber) route(ev Event) (Event, bool) {
+	s.filterMu.RLock()
+	defer s.filterMu.RUnlock()
+	if s.paused {
+		return ev, false
+	}
+	return s.filter.route(ev)
+}
+
+// Seed records the currently active locations, typically loaded from the
+// cache at startup, so deletes for them can be routed to filtered subscribers.
+func (h *Hub) Seed(locs []shared.MapLocation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range locs {
+		h.last[locs[i].ID] = lastLocation{loc: &locs[i], seq: h.seq}
+	}
+}
+
+// Seq returns the ID of the last event published.
+func (h *Hub) Seq() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.seq
+}
+
+// Prune forgets the incidents missing from active, such as those whose cache
+// entry expired without a deletion event. active must have been loaded after
+// event since was published; incidents published later are kept, as active
+// may predate them.
+func (h *Hub) Prune(active []shared.MapLocation, since uint64) int {
+	ids := make(map[string]struct{}, len(active))
+	for i := range active {
+		ids[active[i].ID] = struct{}{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pruned := 0
+	for id, last := range h.last {
+		if _, ok := ids[id]; !ok && last.seq <= since {
+			delete(h.last, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Observe registers fn to be called with every published event, in order,
+// before it is fanned out. fn runs under the hub's lock and must not block or
+// call back into the hub.
+func (h *Hub) Observe(fn func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observers = append(h.observers, fn)
+}
+
+// Subscribe registers a subscriber. When lastEventID names an event still in
+// the replay buffer, every later event that passes filter is queued before
+// any live event and resumed is true. Otherwise the caller should send a
+// snapshot first.
+func (h *Hub) Subscribe(filter StreamFilter, lastEventID string) (s *Subscriber, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s = &Subscriber{
+		events:  make(chan Event, h.queueSize),
+		evicted: make(chan struct{}),
+		start:   h.seq,
+		filter:  filter,
+	}
+
+	if missed, ok := h.since(lastEventID); ok {
+		var routed []Event
+		for _, ev := range missed {
+			if r, ok := filter.route(ev); ok {
+				routed = append(routed, r)
+			}
+		}
+		if len(routed) <= h.queueSize {
+			for _, ev := range routed {
+				s.events <- ev
+			}
+			s.delivered.Add(int64(len(routed)))
+			resumed = true
+		}
+	}
+
+	h.subs[s] = struct{}{}
+	HubSubscribers.Set(float64(len(h.subs)))
+	return s, resumed
+}
+
+// since returns the buffered events after lastEventID, or false when the ID
+// is missing, malformed or older than the buffer.
+func (h *Hub) since(lastEventID string) ([]Event, bool) {
+	if lastEventID == "" {
+		return nil, false
+	}
+	last, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil || last > h.seq {
+		return nil, false
+	}
+	if last == h.seq {
+		return nil, true
+	}
+
+	n := len(h.replay)
+	if n == 0 || last < h.replay[h.head].Seq-1 {
+		return nil, false
+	}
+
+	var missed []Event
+	for i := range n {
+		ev := h.replay[(h.head+i)%n]
+		if ev.Seq > last {
+			missed = append(missed, ev)
+		}
+	}
+	return missed, true
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	n := len(h.subs)
+	h.mu.Unlock()
+
+	HubSubscribers.Set(float64(n))
+}
+
+// Publish assigns ev the next event ID and queues it for every subscriber
+// whose filter routes it, without blocking. Subscribers whose queue is full
+// are evicted.
+func (h *Hub) Publish(ev Event) {
+	var slow []*Subscriber
+
+	h.mu.Lock()
+	h.seq++
+	ev.Seq = h.seq
+	ev.Previous = h.last[ev.ID].loc
+	if ev.Type == EventDelete {
+		delete(h.last, ev.ID)
+	} else {
+		h.last[ev.ID] = lastLocation{loc: ev.Location, seq: ev.Seq}
+	}
+	h.remember(ev)
+	for _, fn := range h.observers {
+		fn(ev)
+	}
+
+	for s := range h.subs {
+		routed, ok := s.route(ev)
+		if !ok {
+			continue
+		}
+		HubSubscriberQueueLength.Observe(float64(len(s.events)))
+		select {
+		case s.events <- routed:
+			s.delivered.Add(1)
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range slow {
+		h.evict(s)
+	}
+}
+
+func (h *Hub) remember(ev Event) {
+	if h.replayCap == 0 {
+		return
+	}
+	if len(h.replay) < h.replayCap {
+		h.replay = append(h.replay, ev)
+		return
+	}
+	h.replay[h.head] = ev
+	h.head = (h.head + 1) % h.replayCap
+}
+
+func (h *Hub) evict(s *Subscriber) {
+	h.Unsubscribe(s)
+	s.once.Do(func() {
+		close(s.evicted)
+		HubSubscriberEvictions.Inc()
+		slog.Warn("evicting slow stream subscriber",
+			slog.Int("queue_size", h.queueSize),
+			slog.Int64("delivered", s.delivered.Load()),
+		)
+	})
+}
@@ -55,13 +55,64 @@ var (
 		Help: "Number of incidents returned in last map request",
 	})
 
-	MQTTStreamMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_mqtt_stream_messages_total",
-		Help: "Total number of MQTT messages processed for streaming",
-	}, []string{"type"}) // type: update, deletion
-
-	SSEEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
-		Name: metricsPrefix + "_sse_events_dropped_total",
-		Help: "Total number of SSE events dropped due to slow consumers",
+	MapNearbyRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_map_nearby_requests_total",
+		Help: "Total number of nearby map incidents requests",
 	})
+
+	ClusterIndexSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_cluster_index_incidents",
+		Help: "Number of active incidents in the map cluster index",
+	})
+
+	TilesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_tiles_served_total",
+		Help: "Total number of vector tiles served",
+	}, []string{"layer"})
+
+	LocationChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_location_changes_total",
+		Help: "Total number of cached location changes processed for streaming",
+	}, []string{"type"}) // type: update, delete
+
+	HubSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_hub_subscribers",
+		Help: "Number of clients subscribed to the live event hub",
+	})
+
+	HubSubscriberQueueLength = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "_hub_subscriber_queue_length",
+		Help:    "Per-subscriber queue length observed when an event is published",
+		Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250},
+	})
+
+	HubSubscriberEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_hub_subscriber_evictions_total",
+		Help: "Total number of subscribers disconnected for falling behind",
+	})
+
+	WebSocketConnectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_websocket_connections_active",
+		Help: "Number of active WebSocket connections",
+	})
+
+	WebSocketConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_websocket_connections_total",
+		Help: "Total number of WebSocket connections established",
+	})
+
+	WebSocketEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_websocket_events_total",
+		Help: "Total number of WebSocket events sent",
+	}, []string{"type"}) // type: update, delete, snapshot
+
+	WebSocketMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_websocket_messages_total",
+		Help: "Total number of WebSocket messages received from clients",
+	}, []string{"type"}) // type: subscribe, unsubscribe, invalid
+
+	StreamResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_stream_resumes_total",
+		Help: "Total number of stream connections by how they were brought up to date",
+	}, []string{"result"}) // result: replayed, snapshot
 )
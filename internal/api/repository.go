@@ -64,50 +64,57 @@ func (r *Repository) recordQueryError(queryName string) {
 	ClickHouseQueryErrors.WithLabelValues(queryName).Inc()
 }
 
-func (r *Repository) GetSummary(ctx context.Context) (*Summary, error) {
+func (r *Repository) GetSummary(ctx context.Context, f Filter) (*Summary, error) {
 	defer r.observeQuery("summary")()
-	summary := &Summary{}
+	today := f.today()
+	summary := &Summary{Window: f.todayWindow()}
+	dims, args := f.dimensions()
+	todayArgs := append([]any{today}, args...)
 
-	err := r.conn.QueryRow(ctx, `
+	err := r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT toInt32(count()) AS active_count
 		FROM beacon.traffic_incidents
-		WHERE end_timestamp = toDateTime(0) OR end_timestamp > now()
-	`).Scan(&summary.ActiveIncidents)
+		WHERE (end_timestamp = toDateTime(0) OR end_timestamp > now())
+		  AND %s
+	`, dims), args...).Scan(&summary.ActiveIncidents)
 	if err != nil {
 		r.recordQueryError("summary")
 		return nil, fmt.Errorf("failed to get active incidents: %w", err)
 	}
 
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT toInt32(count()) AS severe_count
 		FROM beacon.traffic_incidents
 		WHERE (end_timestamp = toDateTime(0) OR end_timestamp > now())
 		  AND severity IN ('high', 'highest')
-	`).Scan(&summary.SevereIncidents)
+		  AND %s
+	`, dims), args...).Scan(&summary.SevereIncidents)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get severe incidents: %w", err)
 	}
 
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT toInt32(count()) AS todays_total
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today()
-	`).Scan(&summary.TodaysTotal)
+		WHERE timestamp >= ?
+		  AND %s
+	`, dims), todayArgs...).Scan(&summary.TodaysTotal)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get today's total: %w", err)
 	}
 
 	// Peak hour today (hour with most incidents)
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT
-			toInt32(toHour(timestamp)) AS hour,
+			toInt32(toHour(timestamp, ?)) AS hour,
 			toInt32(count()) AS cnt
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today()
+		WHERE timestamp >= ?
+		  AND %s
 		GROUP BY hour
 		ORDER BY cnt DESC
 		LIMIT 1
-	`).Scan(&summary.PeakHour, &summary.PeakHourCount)
+	`, dims), append([]any{f.tz()}, todayArgs...)...).Scan(&summary.PeakHour, &summary.PeakHourCount)
 	if err != nil {
 		// Not fatal - might be no incidents today
 		summary.PeakHour = -1
@@ -117,15 +124,16 @@ func (r *Repository) GetSummary(ctx context.Context) (*Summary, error) {
 	return summary, nil
 }
 
-func (r *Repository) GetHourlyTrend(ctx context.Context) ([]HourlyDataPoint, error) {
+func (r *Repository) GetHourlyTrend(ctx context.Context, f Filter) ([]HourlyDataPoint, error) {
 	defer r.observeQuery("hourly_trend")()
-	rows, err := r.conn.Query(ctx, `
-		SELECT toStartOfHour(timestamp) AS hour, toInt32(count()) AS count
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
+		SELECT toStartOfHour(timestamp, ?) AS hour, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= now() - INTERVAL 24 HOUR
+		WHERE %s
 		GROUP BY hour
 		ORDER BY hour
-	`)
+	`, where), append([]any{f.tz()}, args...)...)
 	if err != nil {
 		r.recordQueryError("hourly_trend")
 		return nil, fmt.Errorf("failed to get hourly trend: %w", err)
@@ -144,18 +152,19 @@ func (r *Repository) GetHourlyTrend(ctx context.Context) ([]HourlyDataPoint, err
 	return data, nil
 }
 
-func (r *Repository) GetDailyTrend(ctx context.Context) ([]DailyDataPoint, error) {
+func (r *Repository) GetDailyTrend(ctx context.Context, f Filter) ([]DailyDataPoint, error) {
 	defer r.observeQuery("daily_trend")()
-	rows, err := r.conn.Query(ctx, `
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
-			toStartOfDay(timestamp) AS date,
+			toStartOfDay(timestamp, ?) AS date,
 			toInt32(count()) AS count,
 			toInt32(countIf(severity IN ('high', 'highest'))) AS severe_count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 30 DAY
+		WHERE %s
 		GROUP BY date
 		ORDER BY date
-	`)
+	`, where), append([]any{f.tz()}, args...)...)
 	if err != nil {
 		r.recordQueryError("daily_trend")
 		return nil, fmt.Errorf("failed to get daily trend: %w", err)
@@ -174,15 +183,16 @@ func (r *Repository) GetDailyTrend(ctx context.Context) ([]DailyDataPoint, error
 	return data, nil
 }
 
-func (r *Repository) GetSeverityDistribution(ctx context.Context) ([]DistributionItem, error) {
-	rows, err := r.conn.Query(ctx, `
+func (r *Repository) GetSeverityDistribution(ctx context.Context, f Filter) ([]DistributionItem, error) {
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT severity, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND severity <> ''
 		GROUP BY severity
 		ORDER BY count DESC
-	`)
+	`, where), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get severity distribution: %w", err)
 	}
@@ -200,15 +210,16 @@ func (r *Repository) GetSeverityDistribution(ctx context.Context) ([]Distributio
 	return data, nil
 }
 
-func (r *Repository) GetCauseTypeDistribution(ctx context.Context) ([]DistributionItem, error) {
-	rows, err := r.conn.Query(ctx, `
+func (r *Repository) GetCauseTypeDistribution(ctx context.Context, f Filter) ([]DistributionItem, error) {
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT cause_type, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND cause_type <> ''
 		GROUP BY cause_type
 		ORDER BY count DESC
-	`)
+	`, where), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cause type distribution: %w", err)
 	}
@@ -226,15 +237,16 @@ func (r *Repository) GetCauseTypeDistribution(ctx context.Context) ([]Distributi
 	return data, nil
 }
 
-func (r *Repository) GetProvinceDistribution(ctx context.Context) ([]DistributionItem, error) {
-	rows, err := r.conn.Query(ctx, `
+func (r *Repository) GetProvinceDistribution(ctx context.Context, f Filter) ([]DistributionItem, error) {
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT province, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND province <> ''
 		GROUP BY province
 		ORDER BY count DESC
-	`)
+	`, where), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get province distribution: %w", err)
 	}
@@ -252,20 +264,21 @@ func (r *Repository) GetProvinceDistribution(ctx context.Context) ([]Distributio
 	return data, nil
 }
 
-func (r *Repository) GetTopRoads(ctx context.Context, limit int) ([]TopRoad, error) {
+func (r *Repository) GetTopRoads(ctx context.Context, f Filter, limit int) ([]TopRoad, error) {
 	if limit <= 0 {
 		limit = 10
 	}
 
-	rows, err := r.conn.Query(ctx, `
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT road_name, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND road_name <> ''
 		GROUP BY road_name
 		ORDER BY count DESC
 		LIMIT ?
-	`, limit)
+	`, where), append(args, limit)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get top roads: %w", err)
 	}
@@ -283,31 +296,33 @@ func (r *Repository) GetTopRoads(ctx context.Context, limit int) ([]TopRoad, err
 	return data, nil
 }
 
-func (r *Repository) GetTopSubtypes(ctx context.Context, limit int) ([]TopSubtype, error) {
+func (r *Repository) GetTopSubtypes(ctx context.Context, f Filter, limit int) ([]TopSubtype, error) {
 	if limit <= 0 {
 		limit = 20
 	}
 
+	where, args := f.where()
+
 	var total int32
-	err := r.conn.QueryRow(ctx, `
+	err := r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT toInt32(count())
 		FROM beacon.traffic_incidents
 		ARRAY JOIN cause_subtypes AS subtype
-		WHERE timestamp >= today() - INTERVAL 7 DAY
-	`).Scan(&total)
+		WHERE %s
+	`, where), args...).Scan(&total)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get total subtypes: %w", err)
 	}
 
-	rows, err := r.conn.Query(ctx, `
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT subtype, toInt32(count()) AS count
 		FROM beacon.traffic_incidents
 		ARRAY JOIN cause_subtypes AS subtype
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		GROUP BY subtype
 		ORDER BY count DESC
 		LIMIT ?
-	`, limit)
+	`, where), append(args, limit)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get top subtypes: %w", err)
 	}
@@ -328,20 +343,21 @@ func (r *Repository) GetTopSubtypes(ctx context.Context, limit int) ([]TopSubtyp
 	return data, nil
 }
 
-func (r *Repository) GetHeatmapData(ctx context.Context) ([]HeatmapPoint, error) {
+func (r *Repository) GetHeatmapData(ctx context.Context, f Filter) ([]HeatmapPoint, error) {
 	defer r.observeQuery("heatmap")()
-	rows, err := r.conn.Query(ctx, `
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			round(lat, 2) AS lat,
 			round(lon, 2) AS lon,
 			toInt32(count()) AS weight
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND lat != 0 AND lon != 0
 		GROUP BY lat, lon
 		ORDER BY weight DESC
 		LIMIT 1000
-	`)
+	`, where), args...)
 	if err != nil {
 		r.recordQueryError("heatmap")
 		return nil, fmt.Errorf("failed to get heatmap data: %w", err)
@@ -360,9 +376,46 @@ func (r *Repository) GetHeatmapData(ctx context.Context) ([]HeatmapPoint, error)
 	return data, nil
 }
 
-func (r *Repository) GetActiveIncidents(ctx context.Context) ([]ActiveIncident, error) {
+// GetHeatmapGrid aggregates incidents into square cells of cell degrees, so
+// callers can match the resolution to a map zoom level.
+func (r *Repository) GetHeatmapGrid(ctx context.Context, f Filter, cell float64, limit int) ([]HeatmapPoint, error) {
+	defer r.observeQuery("heatmap_grid")()
+	where, args := f.where()
+	args = append([]any{cell, cell, cell, cell}, args...)
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
+		SELECT
+			round(lat / ?) * ? AS cell_lat,
+			round(lon / ?) * ? AS cell_lon,
+			toInt32(count()) AS weight
+		FROM beacon.traffic_incidents
+		WHERE %s
+		  AND lat != 0 AND lon != 0
+		GROUP BY cell_lat, cell_lon
+		ORDER BY weight DESC
+		LIMIT ?
+	`, where), append(args, limit)...)
+	if err != nil {
+		r.recordQueryError("heatmap_grid")
+		return nil, fmt.Errorf("failed to get heatmap grid: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var data []HeatmapPoint
+	for rows.Next() {
+		var point HeatmapPoint
+		if err := rows.Scan(&point.Lat, &point.Lon, &point.Weight); err != nil {
+			return nil, fmt.Errorf("failed to scan heatmap grid row: %w", err)
+		}
+		data = append(data, point)
+	}
+
+	return data, nil
+}
+
+func (r *Repository) GetActiveIncidents(ctx context.Context, f Filter) ([]ActiveIncident, error) {
 	defer r.observeQuery("active_incidents")()
-	rows, err := r.conn.Query(ctx, `
+	dims, args := f.dimensions()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			id,
 			timestamp,
@@ -380,9 +433,10 @@ func (r *Repository) GetActiveIncidents(ctx context.Context) ([]ActiveIncident,
 			WHERE end_timestamp = toDateTime(0) OR end_timestamp > now()
 			GROUP BY id
 		  )
+		  AND %s
 		ORDER BY timestamp DESC
 		LIMIT 100
-	`)
+	`, dims), args...)
 	if err != nil {
 		r.recordQueryError("active_incidents")
 		return nil, fmt.Errorf("failed to get active incidents: %w", err)
@@ -412,17 +466,135 @@ func (r *Repository) GetActiveIncidents(ctx context.Context) ([]ActiveIncident,
 	return data, nil
 }
 
-func (r *Repository) GetImpactSummary(ctx context.Context) (*ImpactSummary, error) {
+// searchColumns are the columns SearchIncidents returns, in scan order.
+const searchColumns = `
+			id, version, timestamp, end_timestamp, name, record_type,
+			province, municipality, severity, cause_type, cause_subtypes,
+			mobility, location_type, road_name, road_number, direction,
+			lat, lon, length_meters, delay_minutes, route_polyline`
+
+// SearchIncidents returns one page of incidents whose latest version starts
+// in the query's window and matches its filters. more reports whether another
+// page follows.
+func (r *Repository) SearchIncidents(ctx context.Context, iq IncidentQuery) (data []Incident, more bool, err error) {
+	defer r.observeQuery("search_incidents")()
+	conds, condArgs, err := iq.conditions()
+	if err != nil {
+		return nil, false, err
+	}
+	args := append([]any{iq.From, iq.To}, condArgs...)
+	args = append(args, iq.Limit+1)
+
+	// Only the returned columns are read; they also cover every filter and
+	// sort, so raw_json and the rest are never loaded for the window.
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
+		SELECT %s
+		FROM (
+			SELECT %s
+			FROM beacon.traffic_incidents
+			WHERE timestamp >= ? AND timestamp < ?
+			ORDER BY id, version DESC, timestamp DESC
+			LIMIT 1 BY id
+		)
+		WHERE %s
+		ORDER BY %s
+		LIMIT ?
+	`, searchColumns, searchColumns, conds, iq.orderBy()), args...)
+	if err != nil {
+		r.recordQueryError("search_incidents")
+		return nil, false, fmt.Errorf("failed to search incidents: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	for rows.Next() {
+		var (
+			inc Incident
+			end time.Time
+		)
+		if err := rows.Scan(
+			&inc.ID,
+			&inc.Version,
+			&inc.Timestamp,
+			&end,
+			&inc.Name,
+			&inc.RecordType,
+			&inc.Province,
+			&inc.Municipality,
+			&inc.Severity,
+			&inc.CauseType,
+			&inc.CauseSubtypes,
+			&inc.Mobility,
+			&inc.LocationType,
+			&inc.RoadName,
+			&inc.RoadNumber,
+			&inc.Direction,
+			&inc.Lat,
+			&inc.Lon,
+			&inc.LengthMeters,
+			&inc.DelayMinutes,
+			&inc.Polyline,
+		); err != nil {
+			return nil, false, fmt.Errorf("failed to scan incident row: %w", err)
+		}
+		if end.Unix() > 0 {
+			inc.EndTimestamp = &end
+		}
+		data = append(data, inc)
+	}
+
+	if len(data) > iq.Limit {
+		return data[:iq.Limit], true, nil
+	}
+	return data, false, nil
+}
+
+// GetIncidentVersions returns every stored version of an incident, oldest
+// first. Rows re-ingested with the same version are collapsed to one.
+func (r *Repository) GetIncidentVersions(ctx context.Context, id string) ([]IncidentVersion, error) {
+	defer r.observeQuery("incident_versions")()
+	rows, err := r.conn.Query(ctx, `
+		SELECT version, timestamp, end_timestamp, raw_json
+		FROM beacon.traffic_incidents
+		WHERE id = ?
+		ORDER BY version ASC, timestamp DESC
+		LIMIT 1 BY version
+	`, id)
+	if err != nil {
+		r.recordQueryError("incident_versions")
+		return nil, fmt.Errorf("failed to get incident versions: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var data []IncidentVersion
+	for rows.Next() {
+		var (
+			v   IncidentVersion
+			end time.Time
+		)
+		if err := rows.Scan(&v.Version, &v.Timestamp, &end, &v.RawJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan incident version row: %w", err)
+		}
+		if end.Unix() > 0 {
+			v.EndTimestamp = &end
+		}
+		data = append(data, v)
+	}
+
+	return data, nil
+}
+
+func (r *Repository) GetImpactSummary(ctx context.Context, f Filter) (*ImpactSummary, error) {
 	summary := &ImpactSummary{}
+	where, args := f.where()
 
-	err := r.conn.QueryRow(ctx, `
+	err := r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT
 			toFloat64(sum(length_meters) / 1000) AS total_km,
 			toFloat64(if(countIf(length_meters > 0) > 0, sum(length_meters) / countIf(length_meters > 0) / 1000, 0)) AS avg_km,
 			toInt32(countIf(length_meters > 0)) AS incidents_with_km
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
-	`).Scan(
+		WHERE %s
+	`, where), args...).Scan(
 		&summary.TotalAffectedKm,
 		&summary.AvgAffectedKm,
 		&summary.IncidentsWithKm,
@@ -431,37 +603,37 @@ func (r *Repository) GetImpactSummary(ctx context.Context) (*ImpactSummary, erro
 		return nil, fmt.Errorf("failed to get km metrics: %w", err)
 	}
 
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT province, toInt32(count()) AS cnt
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND province <> ''
 		GROUP BY province
 		ORDER BY cnt DESC
 		LIMIT 1
-	`).Scan(&summary.TopProvince, &summary.TopProvinceCount)
+	`, where), args...).Scan(&summary.TopProvince, &summary.TopProvinceCount)
 	if err != nil {
 		summary.TopProvince = "N/A"
 		summary.TopProvinceCount = 0
 	}
 
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT 
 			if(road_number <> '', road_number, road_name) AS road,
 			toInt32(count()) AS cnt
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND (road_number <> '' OR road_name <> '')
 		GROUP BY road
 		ORDER BY cnt DESC
 		LIMIT 1
-	`).Scan(&summary.TopRoad, &summary.TopRoadCount)
+	`, where), args...).Scan(&summary.TopRoad, &summary.TopRoadCount)
 	if err != nil {
 		summary.TopRoad = "N/A"
 		summary.TopRoadCount = 0
 	}
 
-	err = r.conn.QueryRow(ctx, `
+	err = r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT
 			toInt32(count()) AS total,
 			toInt32(countIf(
@@ -471,8 +643,8 @@ func (r *Repository) GetImpactSummary(ctx context.Context) (*ImpactSummary, erro
 				]) OR cause_type = 'poorEnvironment'
 			)) AS weather_count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
-	`).Scan(&summary.TotalIncidents, &summary.WeatherIncidents)
+		WHERE %s
+	`, where), args...).Scan(&summary.TotalIncidents, &summary.WeatherIncidents)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get weather impact: %w", err)
 	}
@@ -484,8 +656,9 @@ func (r *Repository) GetImpactSummary(ctx context.Context) (*ImpactSummary, erro
 	return summary, nil
 }
 
-func (r *Repository) GetDurationDistribution(ctx context.Context) ([]DurationBucket, error) {
-	rows, err := r.conn.Query(ctx, `
+func (r *Repository) GetDurationDistribution(ctx context.Context, f Filter) ([]DurationBucket, error) {
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			multiIf(
 				duration_mins < 15, '0-15',
@@ -502,7 +675,7 @@ func (r *Repository) GetDurationDistribution(ctx context.Context) ([]DurationBuc
 			FROM beacon.traffic_incidents
 			WHERE end_timestamp > toDateTime(0)
 			  AND end_timestamp > timestamp
-			  AND timestamp >= today() - INTERVAL 7 DAY
+			  AND %s
 		)
 		GROUP BY bucket
 		ORDER BY
@@ -514,7 +687,7 @@ func (r *Repository) GetDurationDistribution(ctx context.Context) ([]DurationBuc
 				WHEN '120-240' THEN 5
 				ELSE 6
 			END
-	`)
+	`, where), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get duration distribution: %w", err)
 	}
@@ -532,12 +705,13 @@ func (r *Repository) GetDurationDistribution(ctx context.Context) ([]DurationBuc
 	return data, nil
 }
 
-func (r *Repository) GetRouteAnalysis(ctx context.Context, limit int) ([]RouteIncidentStats, error) {
+func (r *Repository) GetRouteAnalysis(ctx context.Context, f Filter, limit int) ([]RouteIncidentStats, error) {
 	if limit <= 0 {
 		limit = 20
 	}
 
-	rows, err := r.conn.Query(ctx, `
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			road_number,
 			any(road_name) AS road_name,
@@ -554,12 +728,12 @@ func (r *Repository) GetRouteAnalysis(ctx context.Context, limit int) ([]RouteIn
 			toFloat64(sum(length_meters) / 1000) AS total_length_km,
 			groupArray(3)(cause_type) AS common_causes
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND road_number <> ''
 		GROUP BY road_number
 		ORDER BY incident_count DESC
 		LIMIT ?
-	`, limit)
+	`, where), append(args, limit)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get route analysis: %w", err)
 	}
@@ -584,28 +758,30 @@ func (r *Repository) GetRouteAnalysis(ctx context.Context, limit int) ([]RouteIn
 	return data, nil
 }
 
-func (r *Repository) GetDirectionAnalysis(ctx context.Context) ([]DirectionStats, error) {
+func (r *Repository) GetDirectionAnalysis(ctx context.Context, f Filter) ([]DirectionStats, error) {
+	where, args := f.where()
+
 	var total int32
-	err := r.conn.QueryRow(ctx, `
+	err := r.conn.QueryRow(ctx, fmt.Sprintf(`
 		SELECT toInt32(count())
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND direction <> ''
-	`).Scan(&total)
+	`, where), args...).Scan(&total)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get direction total: %w", err)
 	}
 
-	rows, err := r.conn.Query(ctx, `
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			direction,
 			toInt32(count()) AS incident_count
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		  AND direction <> ''
 		GROUP BY direction
 		ORDER BY incident_count DESC
-	`)
+	`, where), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get direction analysis: %w", err)
 	}
@@ -626,12 +802,13 @@ func (r *Repository) GetDirectionAnalysis(ctx context.Context) ([]DirectionStats
 	return data, nil
 }
 
-func (r *Repository) GetRushHourComparison(ctx context.Context) ([]RushHourStats, error) {
-	rows, err := r.conn.Query(ctx, `
+func (r *Repository) GetRushHourComparison(ctx context.Context, f Filter) ([]RushHourStats, error) {
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			multiIf(
-				toHour(timestamp) IN (7, 8, 9), 'morning_rush',
-				toHour(timestamp) IN (17, 18, 19, 20), 'evening_rush',
+				toHour(timestamp, ?) IN (7, 8, 9), 'morning_rush',
+				toHour(timestamp, ?) IN (17, 18, 19, 20), 'evening_rush',
 				'off_peak'
 			) AS period,
 			toInt32(count()) AS incident_count,
@@ -650,7 +827,7 @@ func (r *Repository) GetRushHourComparison(ctx context.Context) ([]RushHourStats
 				0
 			)) AS avg_duration
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 7 DAY
+		WHERE %s
 		GROUP BY period
 		ORDER BY
 			CASE period
@@ -658,7 +835,7 @@ func (r *Repository) GetRushHourComparison(ctx context.Context) ([]RushHourStats
 				WHEN 'evening_rush' THEN 2
 				ELSE 3
 			END
-	`)
+	`, where), append([]any{f.tz(), f.tz()}, args...)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get rush hour comparison: %w", err)
 	}
@@ -676,17 +853,18 @@ func (r *Repository) GetRushHourComparison(ctx context.Context) ([]RushHourStats
 	return data, nil
 }
 
-func (r *Repository) GetHotspots(ctx context.Context, limit int) ([]Hotspot, error) {
+func (r *Repository) GetHotspots(ctx context.Context, f Filter, limit int) ([]Hotspot, error) {
 	if limit <= 0 {
 		limit = 50
 	}
 
-	rows, err := r.conn.Query(ctx, `
+	where, args := f.where()
+	rows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		SELECT
 			round(lat, 3) AS lat,
 			round(lon, 3) AS lon,
 			toInt32(count()) AS incident_count,
-			toInt32(uniq(toDate(timestamp))) AS recurrence,
+			toInt32(uniq(toDate(timestamp, ?))) AS recurrence,
 			topK(1)(cause_type)[1] AS top_cause,
 			toFloat64(avg(
 				CASE severity
@@ -698,13 +876,13 @@ func (r *Repository) GetHotspots(ctx context.Context, limit int) ([]Hotspot, err
 				END
 			)) AS avg_severity
 		FROM beacon.traffic_incidents
-		WHERE timestamp >= today() - INTERVAL 30 DAY
+		WHERE %s
 		  AND lat != 0 AND lon != 0
 		GROUP BY lat, lon
 		HAVING incident_count >= 3 AND recurrence >= 2
 		ORDER BY recurrence DESC, incident_count DESC
 		LIMIT ?
-	`, limit)
+	`, where), append(append([]any{f.tz()}, args...), limit)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hotspots: %w", err)
 	}
@@ -729,24 +907,30 @@ func (r *Repository) GetHotspots(ctx context.Context, limit int) ([]Hotspot, err
 	return data, nil
 }
 
-func (r *Repository) GetAnomalies(ctx context.Context) ([]Anomaly, error) {
+func (r *Repository) GetAnomalies(ctx context.Context, f Filter) ([]Anomaly, error) {
 	var anomalies []Anomaly
+	today := f.today()
+	dims, args := f.dimensions()
+	cteArgs := append(append([]any{today}, args...), today.AddDate(0, 0, -7), today)
+	cteArgs = append(cteArgs, args...)
 
-	provinceRows, err := r.conn.Query(ctx, `
+	provinceRows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		WITH
 			today_data AS (
 				SELECT province, toInt32(count()) AS today_count
 				FROM beacon.traffic_incidents
-				WHERE timestamp >= today()
+				WHERE timestamp >= ?
 				  AND province <> ''
+				  AND %[1]s
 				GROUP BY province
 			),
 			baseline_data AS (
 				SELECT province, toFloat64(count()) / 7 AS avg_count
 				FROM beacon.traffic_incidents
-				WHERE timestamp >= today() - INTERVAL 7 DAY
-				  AND timestamp < today()
+				WHERE timestamp >= ?
+				  AND timestamp < ?
 				  AND province <> ''
+				  AND %[1]s
 				GROUP BY province
 			)
 		SELECT
@@ -760,7 +944,7 @@ func (r *Repository) GetAnomalies(ctx context.Context) ([]Anomaly, error) {
 		WHERE b.avg_count > 0 AND abs((t.today_count - b.avg_count) / b.avg_count) > 0.5
 		ORDER BY abs(deviation) DESC
 		LIMIT 10
-	`)
+	`, dims), cteArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get province anomalies: %w", err)
 	}
@@ -775,21 +959,23 @@ func (r *Repository) GetAnomalies(ctx context.Context) ([]Anomaly, error) {
 		anomalies = append(anomalies, a)
 	}
 
-	causeRows, err := r.conn.Query(ctx, `
+	causeRows, err := r.conn.Query(ctx, fmt.Sprintf(`
 		WITH
 			today_data AS (
 				SELECT cause_type, toInt32(count()) AS today_count
 				FROM beacon.traffic_incidents
-				WHERE timestamp >= today()
+				WHERE timestamp >= ?
 				  AND cause_type <> ''
+				  AND %[1]s
 				GROUP BY cause_type
 			),
 			baseline_data AS (
 				SELECT cause_type, toFloat64(count()) / 7 AS avg_count
 				FROM beacon.traffic_incidents
-				WHERE timestamp >= today() - INTERVAL 7 DAY
-				  AND timestamp < today()
+				WHERE timestamp >= ?
+				  AND timestamp < ?
 				  AND cause_type <> ''
+				  AND %[1]s
 				GROUP BY cause_type
 			)
 		SELECT
@@ -803,7 +989,7 @@ func (r *Repository) GetAnomalies(ctx context.Context) ([]Anomaly, error) {
 		WHERE b.avg_count > 0 AND abs((t.today_count - b.avg_count) / b.avg_count) > 0.5
 		ORDER BY abs(deviation) DESC
 		LIMIT 10
-	`)
+	`, dims), cteArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cause type anomalies: %w", err)
 	}
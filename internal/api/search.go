@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// sortColumns maps the sort parameter to the column it orders by. Every sort
+// is tie-broken by id so cursors are stable.
+var sortColumns = map[string]string{
+	"timestamp":     "timestamp",
+	"end_timestamp": "end_timestamp",
+	"delay":         "delay_minutes",
+	"length":        "length_meters",
+}
+
+// IncidentQuery is a historical incident search. It extends the dashboard
+// Filter (window, province, severity, cause, road) with the remaining
+// searchable columns, a sort order and a page cursor.
+type IncidentQuery struct {
+	Filter
+	Municipality string
+	Subtype      string
+	Mobility     string
+	LocationType string
+	Text         string // matched against name and road_name, case-insensitively
+	Sort         string
+	Desc         bool
+	Limit        int
+	After        *searchCursor
+}
+
+// searchCursor points just past the last row of a page. It records the sort it
+// was issued for so it cannot be replayed against a different ordering.
+type searchCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// ParseIncidentQuery reads the dashboard filter parameters plus municipality,
+// subtype, mobility, location_type, q, sort (timestamp, end_timestamp, delay,
+// length), order (asc, desc), limit and cursor.
+func ParseIncidentQuery(q url.Values) (IncidentQuery, error) {
+	f, err := ParseFilter(q)
+	if err != nil {
+		return IncidentQuery{}, err
+	}
+
+	iq := IncidentQuery{
+		Filter:       f,
+		Municipality: strings.TrimSpace(q.Get("municipality")),
+		Subtype:      strings.TrimSpace(q.Get("subtype")),
+		Mobility:     strings.TrimSpace(q.Get("mobility")),
+		LocationType: strings.TrimSpace(q.Get("location_type")),
+		Text:         strings.TrimSpace(q.Get("q")),
+		Sort:         strings.TrimSpace(q.Get("sort")),
+		Desc:         true,
+		Limit:        defaultSearchLimit,
+	}
+
+	for name, v := range map[string]string{
+		"municipality":  iq.Municipality,
+		"subtype":       iq.Subtype,
+		"mobility":      iq.Mobility,
+		"location_type": iq.LocationType,
+		"q":             iq.Text,
+	} {
+		if len(v) > maxFilterValue {
+			return IncidentQuery{}, fmt.Errorf("%s exceeds %d characters", name, maxFilterValue)
+		}
+	}
+
+	if iq.Sort == "" {
+		iq.Sort = "timestamp"
+	}
+	if _, ok := sortColumns[iq.Sort]; !ok {
+		return IncidentQuery{}, fmt.Errorf("invalid sort %q", iq.Sort)
+	}
+
+	switch order := strings.ToLower(strings.TrimSpace(q.Get("order"))); order {
+	case "", "desc":
+	case "asc":
+		iq.Desc = false
+	default:
+		return IncidentQuery{}, fmt.Errorf("invalid order %q", order)
+	}
+
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return IncidentQuery{}, fmt.Errorf("invalid limit %q", l)
+		}
+		iq.Limit = min(n, maxSearchLimit)
+	}
+
+	if c := q.Get("cursor"); c != "" {
+		cur, err := decodeCursor(c)
+		if err != nil {
+			return IncidentQuery{}, err
+		}
+		if cur.Sort != iq.Sort || cur.Desc != iq.Desc {
+			return IncidentQuery{}, errors.New("cursor was issued for a different sort order")
+		}
+		iq.After = cur
+		if _, err := iq.cursorValue(); err != nil {
+			return IncidentQuery{}, err
+		}
+	}
+
+	return iq, nil
+}
+
+func decodeCursor(s string) (*searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cur searchCursor
+	if err := json.Unmarshal(raw, &cur); err != nil || cur.ID == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cur, nil
+}
+
+// nextCursor returns the cursor for the page following inc.
+func (iq IncidentQuery) nextCursor(inc Incident) string {
+	var v string
+	switch iq.Sort {
+	case "timestamp":
+		v = strconv.FormatInt(inc.Timestamp.Unix(), 10)
+	case "end_timestamp":
+		var end int64
+		if inc.EndTimestamp != nil {
+			end = inc.EndTimestamp.Unix()
+		}
+		v = strconv.FormatInt(end, 10)
+	case "delay":
+		v = strconv.FormatFloat(float64(inc.DelayMinutes), 'g', -1, 64)
+	case "length":
+		v = strconv.FormatFloat(float64(inc.LengthMeters), 'g', -1, 64)
+	}
+
+	raw, _ := json.Marshal(searchCursor{Sort: iq.Sort, Desc: iq.Desc, Value: v, ID: inc.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// cursorValue converts the cursor's sort value back into a query argument.
+func (iq IncidentQuery) cursorValue() (any, error) {
+	switch iq.Sort {
+	case "timestamp", "end_timestamp":
+		sec, err := strconv.ParseInt(iq.After.Value, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		return time.Unix(sec, 0), nil
+	default:
+		f, err := strconv.ParseFloat(iq.After.Value, 64)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		return f, nil
+	}
+}
+
+// conditions renders the filters applied after deduplication, including the
+// cursor position, with their positional arguments.
+func (iq IncidentQuery) conditions() (string, []any, error) {
+	dims, args := iq.dimensions()
+	conds := []string{dims}
+
+	if iq.Municipality != "" {
+		conds = append(conds, "municipality = ?")
+		args = append(args, iq.Municipality)
+	}
+	if iq.Subtype != "" {
+		conds = append(conds, "has(cause_subtypes, ?)")
+		args = append(args, iq.Subtype)
+	}
+	if iq.Mobility != "" {
+		conds = append(conds, "mobility = ?")
+		args = append(args, iq.Mobility)
+	}
+	if iq.LocationType != "" {
+		conds = append(conds, "location_type = ?")
+		args = append(args, iq.LocationType)
+	}
+	if iq.Text != "" {
+		conds = append(conds, "(positionCaseInsensitiveUTF8(name, ?) > 0 OR positionCaseInsensitiveUTF8(road_name, ?) > 0)")
+		args = append(args, iq.Text, iq.Text)
+	}
+
+	if iq.After != nil {
+		v, err := iq.cursorValue()
+		if err != nil {
+			return "", nil, err
+		}
+		op := ">"
+		if iq.Desc {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("(%s, id) %s (?, ?)", sortColumns[iq.Sort], op))
+		args = append(args, v, iq.After.ID)
+	}
+
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// orderBy renders the ORDER BY clause for the query's sort.
+func (iq IncidentQuery) orderBy() string {
+	dir := "ASC"
+	if iq.Desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf("%s %s, id %s", sortColumns[iq.Sort], dir, dir)
+}
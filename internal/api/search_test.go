@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	ts := time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC)
+	end := ts.Add(2 * time.Hour)
+	inc := Incident{ID: "inc-1", Timestamp: ts, EndTimestamp: &end, DelayMinutes: 12.5, LengthMeters: 1500}
+
+	tests := []struct {
+		sort  string
+		order string
+		inc   Incident
+		want  any
+	}{
+		{"timestamp", "desc", inc, ts},
+		{"timestamp", "asc", inc, ts},
+		{"end_timestamp", "desc", inc, end},
+		{"end_timestamp", "asc", Incident{ID: "inc-2", Timestamp: ts}, time.Unix(0, 0)},
+		{"delay", "desc", inc, 12.5},
+		{"length", "asc", inc, 1500.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort+" "+tt.order, func(t *testing.T) {
+			q := url.Values{"sort": {tt.sort}, "order": {tt.order}}
+			first, err := ParseIncidentQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q.Set("cursor", first.nextCursor(tt.inc))
+			next, err := ParseIncidentQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.After == nil || next.After.ID != tt.inc.ID {
+				t.Fatalf("got cursor %+v, want one after %s", next.After, tt.inc.ID)
+			}
+			v, err := next.cursorValue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := v.(time.Time); ok {
+				if !got.Equal(tt.want.(time.Time)) {
+					t.Errorf("got cursor value %v, want %v", got, tt.want)
+				}
+			} else if v != tt.want {
+				t.Errorf("got cursor value %v, want %v", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIncidentQueryRejectsCursor(t *testing.T) {
+	issued, err := ParseIncidentQuery(url.Values{"sort": {"delay"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := issued.nextCursor(Incident{ID: "inc-1", DelayMinutes: 5})
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantErr string
+	}{
+		{"different sort", url.Values{"sort": {"length"}, "cursor": {cursor}}, "cursor was issued for a different sort order"},
+		{"different order", url.Values{"sort": {"delay"}, "order": {"asc"}, "cursor": {cursor}}, "cursor was issued for a different sort order"},
+		{"default sort", url.Values{"cursor": {cursor}}, "cursor was issued for a different sort order"},
+		{"not base64", url.Values{"sort": {"delay"}, "cursor": {"%%%"}}, "invalid cursor"},
+		{"not json", url.Values{"sort": {"delay"}, "cursor": {encode("delay")}}, "invalid cursor"},
+		{"no id", url.Values{"sort": {"delay"}, "cursor": {encode(`{"s":"delay","d":true,"v":"5"}`)}}, "invalid cursor"},
+		{"value of the wrong type", url.Values{"cursor": {encode(`{"s":"timestamp","d":true,"v":"5.5","id":"inc-1"}`)}}, "invalid cursor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseIncidentQuery(tt.query)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIncidentQueryConditionsFollowSortDirection(t *testing.T) {
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{"desc", "(delay_minutes, id) < (?, ?)"},
+		{"asc", "(delay_minutes, id) > (?, ?)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			q := url.Values{"sort": {"delay"}, "order": {tt.order}}
+			first, err := ParseIncidentQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Set("cursor", first.nextCursor(Incident{ID: "inc-1", DelayMinutes: 5}))
+			next, err := ParseIncidentQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conds, args, err := next.conditions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(conds, tt.want) {
+				t.Errorf("got conditions %q, want them to end with %q", conds, tt.want)
+			}
+			if n := len(args); n < 2 || args[n-2] != 5.0 || args[n-1] != "inc-1" {
+				t.Errorf("got arguments %v, want them to end with the cursor's 5 and inc-1", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sverdejot/beacon/internal/shared"
+)
+
+// StreamFilter selects which live map events a subscriber receives. Each set
+// is a list of accepted values; an empty set accepts everything.
+type StreamFilter struct {
+	Provinces  map[string]bool
+	EventTypes map[string]bool
+	Severities map[string]bool
+	Roads      map[string]bool
+	BBox       *shared.BBox
+}
+
+// ParseStreamFilter reads province, eventType, severity, road and bbox query
+// parameters. All but bbox accept comma-separated lists.
+func ParseStreamFilter(q url.Values) (StreamFilter, error) {
+	f := StreamFilter{
+		Provinces:  parseSet(q.Get("province"), strings.ToLower),
+		EventTypes: parseSet(q.Get("eventType"), strings.TrimSpace),
+		Severities: parseSet(q.Get("severity"), strings.ToLower),
+		Roads:      parseSet(q.Get("road"), strings.ToUpper),
+	}
+
+	for s := range f.Severities {
+		if !severities[s] {
+			return StreamFilter{}, fmt.Errorf("invalid severity %q", s)
+		}
+	}
+
+	if raw := strings.TrimSpace(q.Get("bbox")); raw != "" {
+		bbox, err := shared.ParseBBox(raw)
+		if err != nil {
+			return StreamFilter{}, err
+		}
+		f.BBox = &bbox
+	}
+
+	return f, nil
+}
+
+func parseSet(raw string, normalize func(string) string) map[string]bool {
+	if raw == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(raw, ",") {
+		if v = normalize(strings.TrimSpace(v)); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// Empty reports whether the filter accepts every event.
+func (f StreamFilter) Empty() bool {
+	return len(f.Provinces) == 0 && len(f.EventTypes) == 0 && len(f.Severities) == 0 &&
+		len(f.Roads) == 0 && f.BBox == nil
+}
+
+// Match reports whether loc passes every part of the filter.
+func (f StreamFilter) Match(loc *shared.MapLocation) bool {
+	if loc == nil {
+		return f.Empty()
+	}
+	if len(f.Provinces) > 0 && !f.Provinces[strings.ToLower(loc.Province)] {
+		return false
+	}
+	if len(f.EventTypes) > 0 && !f.EventTypes[loc.EventType] {
+		return false
+	}
+	if len(f.Severities) > 0 && !f.Severities[loc.Severity] {
+		return false
+	}
+	if len(f.Roads) > 0 && !f.Roads[strings.ToUpper(loc.Road)] {
+		return false
+	}
+	if f.BBox != nil {
+		bounds, ok := loc.Bounds()
+		if !ok || !f.BBox.Intersects(bounds) {
+			return false
+		}
+	}
+	return true
+}
+
+// route decides what a subscriber with this filter should receive for ev.
+// Updates that stop matching become deletes for clients that had the
+// incident, and deletes are only sent for incidents the client could have
+// seen.
+func (f StreamFilter) route(ev Event) (Event, bool) {
+	if f.Empty() {
+		return ev, true
+	}
+
+	switch ev.Type {
+	case EventUpdate:
+		if f.Match(ev.Location) {
+			return ev, true
+		}
+		if ev.Previous != nil && f.Match(ev.Previous) {
+			return Event{Seq: ev.Seq, Type: EventDelete, ID: ev.ID, Previous: ev.Previous}, true
+		}
+	case EventDelete:
+		if ev.Previous != nil && f.Match(ev.Previous) {
+			return ev, true
+		}
+	}
+	return ev, false
+}
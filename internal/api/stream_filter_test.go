@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+func TestRouteUpdateLeavingFilterKeepsEventID(t *testing.T) {
+	filter, err := ParseStreamFilter(url.Values{"province": {"madrid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub(8, 8)
+	sub, _ := hub.Subscribe(filter, "")
+	defer hub.Unsubscribe(sub)
+
+	point := &datex.Coordinates{Lat: 40.4, Lon: -3.7}
+	hub.Publish(Event{Type: EventUpdate, ID: "a", Location: &shared.MapLocation{ID: "a", Province: "madrid", Point: point}})
+	hub.Publish(Event{Type: EventUpdate, ID: "a", Location: &shared.MapLocation{ID: "a", Province: "toledo", Point: point}})
+	moved := hub.Seq()
+
+	<-sub.Events()
+	ev := <-sub.Events()
+	if ev.Type != EventDelete {
+		t.Fatalf("got %s event, want %s", ev.Type, EventDelete)
+	}
+	if ev.Seq != moved {
+		t.Fatalf("got event ID %d, want %d", ev.Seq, moved)
+	}
+
+	// A client resuming from the synthesized delete must not need a snapshot.
+	resumed, ok := hub.Subscribe(filter, strconv.FormatUint(ev.Seq, 10))
+	defer hub.Unsubscribe(resumed)
+	if !ok {
+		t.Fatal("could not resume from the synthesized delete")
+	}
+}
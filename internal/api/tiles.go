@@ -0,0 +1,238 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/simplify"
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/sverdejot/beacon/internal/shared"
+)
+
+const (
+	maxTileZoom = 20
+
+	// tileBuffer is how many pixels (of the 4096 extent) of geometry are kept
+	// past each tile edge so lines and markers don't break at tile seams.
+	tileBuffer = 64
+
+	// tileTolerance is the Douglas-Peucker tolerance in tile pixels. Applied
+	// after projection, it simplifies paths more the further out the zoom.
+	tileTolerance = 1.0
+
+	// heatmapCellsPerTile sets the heatmap grid resolution: each tile is
+	// split into this many cells per side, whatever its zoom.
+	heatmapCellsPerTile = 64
+	maxHeatmapCells     = 10000
+	maxTileHotspots     = 1000
+)
+
+const (
+	TileLayerIncidents = "incidents" // live point incidents
+	TileLayerSegments  = "segments"  // live routed segments
+	TileLayerHeatmap   = "heatmap"   // historical incident density
+	TileLayerHotspots  = "hotspots"  // historical recurring locations
+)
+
+var errTileNotFound = errors.New("tile not found")
+
+// handleTile serves /tiles/{layer}/{z}/{x}/{y}.mvt. Live layers read from the
+// map cache and accept the /sse filter parameters; historical layers read
+// from ClickHouse and accept the dashboard filter parameters.
+func (h *Handler) handleTile(w http.ResponseWriter, r *http.Request) {
+	tile, err := parseTile(r.PathValue("z"), r.PathValue("x"), r.PathValue("y"))
+	if err != nil {
+		h.writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	layer := r.PathValue("layer")
+	bound := tile.Bound(float64(tileBuffer) / mvt.DefaultExtent)
+	bbox := shared.BBox{MinLon: bound.Min.Lon(), MinLat: bound.Min.Lat(), MaxLon: bound.Max.Lon(), MaxLat: bound.Max.Lat()}
+
+	var (
+		fc     *geojson.FeatureCollection
+		maxAge int
+	)
+	switch layer {
+	case TileLayerIncidents, TileLayerSegments:
+		fc, err = h.liveTileFeatures(r, layer, bbox)
+		maxAge = 15
+	case TileLayerHeatmap, TileLayerHotspots:
+		fc, err = h.historicalTileFeatures(r, layer, tile, bbox)
+		maxAge = 300
+	default:
+		err = errTileNotFound
+	}
+	if err != nil {
+		var badRequest badTileRequest
+		switch {
+		case errors.Is(err, errTileNotFound):
+			h.writeError(w, fmt.Sprintf("unknown tile layer %q", layer), http.StatusNotFound)
+		case errors.As(err, &badRequest):
+			h.writeError(w, err.Error(), http.StatusBadRequest)
+		default:
+			slog.Error(fmt.Sprintf("failed to build %s tile %d/%d/%d: %s", layer, tile.Z, tile.X, tile.Y, err))
+			h.writeError(w, "failed to build tile", http.StatusInternalServerError)
+		}
+		return
+	}
+	TilesServed.WithLabelValues(layer).Inc()
+
+	layers := mvt.Layers{mvt.NewLayer(layer, fc)}
+	layers.ProjectToTile(tile)
+	layers.Clip(orb.Bound{
+		Min: orb.Point{-tileBuffer, -tileBuffer},
+		Max: orb.Point{mvt.DefaultExtent + tileBuffer, mvt.DefaultExtent + tileBuffer},
+	})
+	layers.Simplify(simplify.DouglasPeucker(tileTolerance))
+	layers.RemoveEmpty(tileTolerance, tileTolerance)
+
+	gzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	var data []byte
+	if gzipped {
+		data, err = mvt.MarshalGzipped(layers)
+	} else {
+		data, err = mvt.Marshal(layers)
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to encode %s tile: %s", layer, err))
+		h.writeError(w, "failed to build tile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Write(data) //nolint:errcheck
+}
+
+type badTileRequest struct{ error }
+
+func parseTile(z, x, y string) (maptile.Tile, error) {
+	y, ok := strings.CutSuffix(y, ".mvt")
+	if !ok {
+		return maptile.Tile{}, errors.New("tile must end in .mvt")
+	}
+
+	zoom, errZ := strconv.ParseUint(z, 10, 32)
+	tx, errX := strconv.ParseUint(x, 10, 32)
+	ty, errY := strconv.ParseUint(y, 10, 32)
+	if errZ != nil || errX != nil || errY != nil || zoom > maxTileZoom {
+		return maptile.Tile{}, errors.New("invalid tile coordinates")
+	}
+
+	tile := maptile.New(uint32(tx), uint32(ty), maptile.Zoom(zoom))
+	if !tile.Valid() {
+		return maptile.Tile{}, errors.New("tile outside zoom level")
+	}
+	return tile, nil
+}
+
+func (h *Handler) liveTileFeatures(r *http.Request, layer string, bbox shared.BBox) (*geojson.FeatureCollection, error) {
+	if h.cache == nil {
+		return nil, errors.New("map cache unavailable")
+	}
+	filter, err := ParseStreamFilter(r.URL.Query())
+	if err != nil {
+		return nil, badTileRequest{err}
+	}
+
+	locations, err := h.cache.GetMapLocationsInBBox(r.Context(), bbox)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for i := range locations {
+		loc := &locations[i]
+		if !filter.Match(loc) {
+			continue
+		}
+
+		var g orb.Geometry
+		switch {
+		case layer == TileLayerIncidents && loc.Point != nil:
+			g = orb.Point{loc.Point.Lon, loc.Point.Lat}
+		case layer == TileLayerSegments && len(loc.Path) > 1:
+			ls := make(orb.LineString, len(loc.Path))
+			for j, c := range loc.Path {
+				ls[j] = orb.Point{c.Lon, c.Lat}
+			}
+			g = ls
+		default:
+			continue
+		}
+
+		f := geojson.NewFeature(g)
+		f.Properties = geojson.Properties{
+			"id":        loc.ID,
+			"icon":      loc.Icon,
+			"severity":  loc.Severity,
+			"eventType": loc.EventType,
+		}
+		if loc.Road != "" {
+			f.Properties["road"] = loc.Road
+		}
+		if layer == TileLayerSegments {
+			f.Properties["distance"] = loc.Distance
+			f.Properties["duration"] = loc.Duration
+			f.Properties["approximate"] = routing.IsApproximate(loc.RouteSource)
+			if loc.RouteConfidence != nil {
+				f.Properties["confidence"] = *loc.RouteConfidence
+			}
+		}
+		fc.Append(f)
+	}
+	return fc, nil
+}
+
+func (h *Handler) historicalTileFeatures(r *http.Request, layer string, tile maptile.Tile, bbox shared.BBox) (*geojson.FeatureCollection, error) {
+	f, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		return nil, badTileRequest{err}
+	}
+	f.BBox = &bbox
+
+	fc := geojson.NewFeatureCollection()
+	switch layer {
+	case TileLayerHeatmap:
+		// Size the grid to the tile so every zoom gets about the same number of cells.
+		cell := 360.0 / float64(uint64(1)<<tile.Z) / heatmapCellsPerTile
+		points, err := h.repo.GetHeatmapGrid(r.Context(), f, cell, maxHeatmapCells)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			feat := geojson.NewFeature(orb.Point{p.Lon, p.Lat})
+			feat.Properties = geojson.Properties{"weight": p.Weight}
+			fc.Append(feat)
+		}
+	case TileLayerHotspots:
+		hotspots, err := h.repo.GetHotspots(r.Context(), f, maxTileHotspots)
+		if err != nil {
+			return nil, err
+		}
+		for _, hs := range hotspots {
+			feat := geojson.NewFeature(orb.Point{hs.Lon, hs.Lat})
+			feat.Properties = geojson.Properties{
+				"incident_count": hs.IncidentCount,
+				"recurrence":     hs.Recurrence,
+				"top_cause":      hs.TopCause,
+				"avg_severity":   hs.AvgSeverity,
+			}
+			fc.Append(feat)
+		}
+	}
+	return fc, nil
+}
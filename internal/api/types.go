@@ -2,14 +2,27 @@ package api
 
 import (
 	"time"
+
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
 )
 
+// Window is the absolute time window a response was computed over, as
+// resolved from the request's range or from/to parameters.
+type Window struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Range    string    `json:"range,omitempty"`
+	Timezone string    `json:"tz"`
+}
+
 type Summary struct {
 	ActiveIncidents int32  `json:"active_incidents"`
 	SevereIncidents int32  `json:"severe_incidents"`
 	TodaysTotal     int32  `json:"todays_total"`
 	PeakHour        int32  `json:"peak_hour"`        // 0-23, hour with most incidents today
 	PeakHourCount   int32  `json:"peak_hour_count"`  // incident count during peak hour
+	Window          Window `json:"window"`           // today, in the requested timezone
 }
 
 type ImpactSummary struct {
@@ -26,7 +39,8 @@ type ImpactSummary struct {
 }
 
 type ImpactSummaryResponse struct {
-	Data *ImpactSummary `json:"data"`
+	Data   *ImpactSummary `json:"data"`
+	Window Window         `json:"window"`
 }
 
 type DurationBucket struct {
@@ -36,7 +50,8 @@ type DurationBucket struct {
 }
 
 type DurationDistributionResponse struct {
-	Data []DurationBucket `json:"data"`
+	Data   []DurationBucket `json:"data"`
+	Window Window           `json:"window"`
 }
 
 type RouteIncidentStats struct {
@@ -49,7 +64,8 @@ type RouteIncidentStats struct {
 }
 
 type RouteAnalysisResponse struct {
-	Data []RouteIncidentStats `json:"data"`
+	Data   []RouteIncidentStats `json:"data"`
+	Window Window               `json:"window"`
 }
 
 type DirectionStats struct {
@@ -59,7 +75,8 @@ type DirectionStats struct {
 }
 
 type DirectionAnalysisResponse struct {
-	Data []DirectionStats `json:"data"`
+	Data   []DirectionStats `json:"data"`
+	Window Window           `json:"window"`
 }
 
 type RushHourStats struct {
@@ -70,7 +87,8 @@ type RushHourStats struct {
 }
 
 type RushHourResponse struct {
-	Data []RushHourStats `json:"data"`
+	Data   []RushHourStats `json:"data"`
+	Window Window          `json:"window"`
 }
 
 type Hotspot struct {
@@ -83,7 +101,8 @@ type Hotspot struct {
 }
 
 type HotspotsResponse struct {
-	Data []Hotspot `json:"data"`
+	Data   []Hotspot `json:"data"`
+	Window Window    `json:"window"`
 }
 
 type Anomaly struct {
@@ -96,7 +115,8 @@ type Anomaly struct {
 }
 
 type AnomaliesResponse struct {
-	Data []Anomaly `json:"data"`
+	Data   []Anomaly `json:"data"`
+	Window Window    `json:"window"`
 }
 
 type HourlyDataPoint struct {
@@ -146,27 +166,33 @@ type ActiveIncident struct {
 }
 
 type HourlyTrendResponse struct {
-	Data []HourlyDataPoint `json:"data"`
+	Data   []HourlyDataPoint `json:"data"`
+	Window Window            `json:"window"`
 }
 
 type DailyTrendResponse struct {
-	Data []DailyDataPoint `json:"data"`
+	Data   []DailyDataPoint `json:"data"`
+	Window Window           `json:"window"`
 }
 
 type DistributionResponse struct {
-	Data []DistributionItem `json:"data"`
+	Data   []DistributionItem `json:"data"`
+	Window Window             `json:"window"`
 }
 
 type TopRoadsResponse struct {
-	Data []TopRoad `json:"data"`
+	Data   []TopRoad `json:"data"`
+	Window Window    `json:"window"`
 }
 
 type TopSubtypesResponse struct {
-	Data []TopSubtype `json:"data"`
+	Data   []TopSubtype `json:"data"`
+	Window Window       `json:"window"`
 }
 
 type HeatmapResponse struct {
-	Data []HeatmapPoint `json:"data"`
+	Data   []HeatmapPoint `json:"data"`
+	Window Window         `json:"window"`
 }
 
 type ActiveIncidentsResponse struct {
@@ -187,3 +213,73 @@ type MapIncident struct {
 type MapIncidentsResponse struct {
 	Data []MapIncident `json:"data"`
 }
+
+// IncidentVersion is one stored version of an incident. Changes lists the
+// fields that differ from the previous version and is empty for the first.
+type IncidentVersion struct {
+	Version      int32         `json:"version"`
+	Timestamp    time.Time     `json:"timestamp"`
+	EndTimestamp *time.Time    `json:"end_timestamp,omitempty"`
+	RawJSON      string        `json:"raw_json"`
+	Changes      []FieldChange `json:"changes,omitempty"`
+}
+
+type IncidentDetail struct {
+	ID       string              `json:"id"`
+	Record   *datex.Record       `json:"record"`             // latest stored version
+	Location *shared.MapLocation `json:"location,omitempty"` // routed geometry, while the incident is live
+	Versions []IncidentVersion   `json:"versions"`           // oldest first
+}
+
+type IncidentDetailResponse struct {
+	Data *IncidentDetail `json:"data"`
+}
+
+// Incident is the latest stored version of an incident, as returned by the
+// historical search.
+type Incident struct {
+	ID            string     `json:"id"`
+	Version       int32      `json:"version"`
+	Timestamp     time.Time  `json:"timestamp"`
+	EndTimestamp  *time.Time `json:"end_timestamp,omitempty"`
+	Name          string     `json:"name,omitempty"`
+	RecordType    string     `json:"record_type"`
+	Province      string     `json:"province"`
+	Municipality  string     `json:"municipality,omitempty"`
+	Severity      string     `json:"severity,omitempty"`
+	CauseType     string     `json:"cause_type,omitempty"`
+	CauseSubtypes []string   `json:"cause_subtypes,omitempty"`
+	Mobility      string     `json:"mobility,omitempty"`
+	LocationType  string     `json:"location_type,omitempty"`
+	RoadName      string     `json:"road_name,omitempty"`
+	RoadNumber    string     `json:"road_number,omitempty"`
+	Direction     string     `json:"direction,omitempty"`
+	Lat           float64    `json:"lat"`
+	Lon           float64    `json:"lon"`
+	LengthMeters  float32    `json:"length_meters,omitempty"`
+	DelayMinutes  float32    `json:"delay_minutes,omitempty"`
+	Polyline      string     `json:"polyline,omitempty"` // routed path of a segment, precision-6 encoded
+}
+
+type IncidentsResponse struct {
+	Data       []Incident `json:"data"`
+	NextCursor string     `json:"next_cursor,omitempty"` // absent on the last page
+	Window     Window     `json:"window"`
+}
+
+// Cluster is a group of nearby active incidents at a given zoom level.
+type Cluster struct {
+	ID         string         `json:"id"` // "zoom/x/y" of the clustering cell
+	Lat        float64        `json:"lat"`
+	Lon        float64        `json:"lon"`
+	Count      int            `json:"count"`
+	Severity   string         `json:"severity"` // most common severity, the more severe on ties
+	Severities map[string]int `json:"severities"`
+	Icons      map[string]int `json:"icons"`
+}
+
+type ClustersResponse struct {
+	Zoom      int                  `json:"zoom"`
+	Clusters  []Cluster            `json:"clusters"`
+	Incidents []shared.MapLocation `json:"incidents"` // incidents not clustered at this zoom
+}
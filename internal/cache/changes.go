@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/valkey-io/valkey-go"
+)
+
+// mapIncidentsChangedChannel carries the ID of every incident whose location
+// is stored, replaced or removed, once the change is in the cache.
+const mapIncidentsChangedChannel = "map:incidents:changed"
+
+// ErrLocationNotFound is returned for an incident that is not cached, such as
+// one that has ended or been deleted.
+var ErrLocationNotFound = errors.New("location not found")
+
+// ReplaceMapLocation overwrites the location of a live incident, keeping its
+// expiry, and announces the change. It returns false without writing if the
+// incident is no longer cached or a newer version has been stored.
+func (c *Cache) ReplaceMapLocation(ctx context.Context, loc *shared.MapLocation) (bool, error) {
+	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("replace"))
+	defer timer.ObserveDuration()
+
+	data, err := json.Marshal(loc.Compact())
+	if err != nil {
+		CacheOperations.WithLabelValues("replace", "error").Inc()
+		return false, fmt.Errorf("failed to marshal location: %w", err)
+	}
+
+	replaced, err := replaceLocationScript.Exec(ctx, c.client,
+		[]string{mapIncidentsKey, expireKey(loc.ID), versionKey(loc.ID)},
+		[]string{loc.ID, string(data), strconv.FormatInt(loc.Version, 10), mapIncidentsChangedChannel},
+	).AsInt64()
+	if err != nil {
+		CacheOperations.WithLabelValues("replace", "error").Inc()
+		return false, fmt.Errorf("failed to replace location: %w", err)
+	}
+	if replaced == 0 {
+		return false, nil
+	}
+
+	if err := c.indexLocation(ctx, loc); err != nil {
+		CacheOperations.WithLabelValues("replace", "error").Inc()
+		return false, err
+	}
+
+	CacheOperations.WithLabelValues("replace", "success").Inc()
+	return true, nil
+}
+
+// SubscribeMapLocationChanges calls fn with the ID of every incident stored,
+// replaced or removed. It blocks until ctx is done or the subscription fails.
+func (c *Cache) SubscribeMapLocationChanges(ctx context.Context, fn func(id string)) error {
+	req := c.client.B().Subscribe().Channel(mapIncidentsChangedChannel).Build()
+	err := c.client.Receive(ctx, req, func(msg valkey.PubSubMessage) {
+		fn(msg.Message)
+	})
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to subscribe to location changes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sverdejot/beacon/pkg/datex"
+	"github.com/valkey-io/valkey-go"
+)
+
+// The digest of the last record ingested for each incident is kept along
+// with when it was last seen, so records republished unchanged can be
+// skipped. The digest lives as long as the incident's location.
+func digestKey(id string) string {
+	return fmt.Sprintf("map:incident:%s:digest", id)
+}
+
+// touchDigestScript marks an incident as seen if its digest is unchanged,
+// extending the life of its cached location as a store would have.
+// KEYS: digest key, expire key, version key.
+// ARGV: digest, seen (unix seconds), ttl, version ttl (seconds).
+var touchDigestScript = valkey.NewLuaScript(`
+local current = redis.call('HMGET', KEYS[1], 'digest', 'cached')
+if current[1] ~= ARGV[1] then
+	return 0
+end
+if current[2] == '1' then
+	if redis.call('EXPIRE', KEYS[2], ARGV[3]) == 0 then
+		return 0
+	end
+	redis.call('EXPIRE', KEYS[3], ARGV[4])
+end
+redis.call('HSET', KEYS[1], 'seen', ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// TouchUnchanged refreshes the last-seen time of an incident and returns
+// true if digest matches the last record stored for it. It returns false if
+// the record changed, or if its cached location has since expired and has
+// to be stored again.
+func (c *Cache) TouchUnchanged(ctx context.Context, id, digest string, validity *datex.Validity) (bool, error) {
+	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("touch"))
+	defer timer.ObserveDuration()
+
+	ttl := c.calculateTTL(validity)
+
+	touched, err := touchDigestScript.Exec(ctx, c.client,
+		[]string{digestKey(id), expireKey(id), versionKey(id)},
+		[]string{
+			digest,
+			strconv.FormatInt(time.Now().Unix(), 10),
+			strconv.FormatInt(int64(ttl.Seconds()), 10),
+			strconv.FormatInt(int64((ttl + versionTombstoneTTL).Seconds()), 10),
+		},
+	).AsInt64()
+	if err != nil {
+		CacheOperations.WithLabelValues("touch", "error").Inc()
+		return false, fmt.Errorf("failed to touch incident: %w", err)
+	}
+
+	CacheOperations.WithLabelValues("touch", "success").Inc()
+	return touched == 1, nil
+}
+
+// StoreDigest records digest as the last record ingested for an incident.
+// cached tells whether its location was stored, in which case later touches
+// only match while that location is alive.
+func (c *Cache) StoreDigest(ctx context.Context, id, digest string, cached bool, validity *datex.Validity) error {
+	ttl := c.calculateTTL(validity)
+	flag := "0"
+	if cached {
+		flag = "1"
+	}
+
+	cmds := valkey.Commands{
+		c.client.B().
+			Hset().
+			Key(digestKey(id)).
+			FieldValue().
+			FieldValue("digest", digest).
+			FieldValue("seen", strconv.FormatInt(time.Now().Unix(), 10)).
+			FieldValue("cached", flag).
+			Build(),
+		c.client.B().Expire().Key(digestKey(id)).Seconds(int64(ttl.Seconds())).Build(),
+	}
+	for _, resp := range c.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return fmt.Errorf("failed to store digest: %w", err)
+		}
+	}
+	return nil
+}
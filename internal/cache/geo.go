@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+	"github.com/valkey-io/valkey-go"
+)
+
+// The GEO index stores every active incident at its anchor (the point, or the
+// midpoint of a segment). Segments reach beyond their anchor, so the extent
+// set records how far each one does; searches widen by the largest extent and
+// then filter on the real geometry.
+const (
+	mapIncidentsGeoKey    = "map:incidents:geo"
+	mapIncidentsExtentKey = "map:incidents:extent"
+)
+
+// indexLocation adds loc to the GEO index, replacing any previous position.
+func (c *Cache) indexLocation(ctx context.Context, loc *shared.MapLocation) error {
+	anchor, ok := loc.Anchor()
+	if !ok {
+		return c.unindexLocation(ctx, loc.ID)
+	}
+
+	cmds := valkey.Commands{
+		c.client.B().
+			Geoadd().
+			Key(mapIncidentsGeoKey).
+			LongitudeLatitudeMember().
+			LongitudeLatitudeMember(anchor.Lon, anchor.Lat, loc.ID).
+			Build(),
+		c.client.B().
+			Zadd().
+			Key(mapIncidentsExtentKey).
+			ScoreMember().
+			ScoreMember(loc.Extent(), loc.ID).
+			Build(),
+	}
+	for _, resp := range c.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return fmt.Errorf("failed to index location: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Cache) unindexLocation(ctx context.Context, ids ...string) error {
+	cmds := valkey.Commands{
+		c.client.B().Zrem().Key(mapIncidentsGeoKey).Member(ids...).Build(),
+		c.client.B().Zrem().Key(mapIncidentsExtentKey).Member(ids...).Build(),
+	}
+	for _, resp := range c.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return fmt.Errorf("failed to unindex location: %w", err)
+		}
+	}
+	return nil
+}
+
+// maxExtent returns the farthest any indexed geometry reaches from its anchor.
+func (c *Cache) maxExtent(ctx context.Context) (float64, error) {
+	req := c.client.B().
+		Zrange().
+		Key(mapIncidentsExtentKey).
+		Min("0").
+		Max("0").
+		Rev().
+		Withscores().
+		Build()
+
+	scores, err := c.client.Do(ctx, req).AsZScores()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get max extent: %w", err)
+	}
+	if len(scores) == 0 {
+		return 0, nil
+	}
+	return scores[0].Score, nil
+}
+
+// RebuildGeoIndex indexes every location in the map hash. It backfills the
+// index for incidents stored before it existed and is safe to run at startup.
+func (c *Cache) RebuildGeoIndex(ctx context.Context) (int, error) {
+	locations, err := c.GetAllMapLocations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := range locations {
+		if err := c.indexLocation(ctx, &locations[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(locations), nil
+}
+
+// GetMapLocationsInBBox returns the active incidents whose geometry intersects
+// bbox, ordered by distance from its center.
+func (c *Cache) GetMapLocationsInBBox(ctx context.Context, bbox shared.BBox) ([]shared.MapLocation, error) {
+	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("geo_bbox"))
+	defer timer.ObserveDuration()
+
+	pad, err := c.maxExtent(ctx)
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_bbox", "error").Inc()
+		return nil, err
+	}
+
+	center := datex.Coordinates{Lat: (bbox.MinLat + bbox.MaxLat) / 2, Lon: (bbox.MinLon + bbox.MaxLon) / 2}
+	// The box is widest at the latitude closest to the equator.
+	refLat := bbox.MinLat
+	if math.Abs(bbox.MaxLat) < math.Abs(refLat) {
+		refLat = bbox.MaxLat
+	}
+	if bbox.MinLat < 0 && bbox.MaxLat > 0 {
+		refLat = 0
+	}
+	width := shared.Haversine(datex.Coordinates{Lat: refLat, Lon: bbox.MinLon}, datex.Coordinates{Lat: refLat, Lon: bbox.MaxLon})
+	height := shared.Haversine(datex.Coordinates{Lat: bbox.MinLat, Lon: center.Lon}, datex.Coordinates{Lat: bbox.MaxLat, Lon: center.Lon})
+
+	req := c.client.B().
+		Geosearch().
+		Key(mapIncidentsGeoKey).
+		Fromlonlat(center.Lon, center.Lat).
+		Bybox(width + 2*pad + 1).
+		Height(height + 2*pad + 1).
+		M().
+		Asc().
+		Build()
+
+	ids, err := c.client.Do(ctx, req).AsStrSlice()
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_bbox", "error").Inc()
+		return nil, fmt.Errorf("failed to search geo index: %w", err)
+	}
+
+	candidates, err := c.getMapLocations(ctx, ids)
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_bbox", "error").Inc()
+		return nil, err
+	}
+
+	locations := make([]shared.MapLocation, 0, len(candidates))
+	for _, loc := range candidates {
+		if b, ok := loc.Bounds(); ok && bbox.Intersects(b) {
+			locations = append(locations, loc)
+		}
+	}
+
+	CacheOperations.WithLabelValues("geo_bbox", "success").Inc()
+	return locations, nil
+}
+
+// GetNearbyMapLocations returns up to limit active incidents whose geometry
+// passes within radius meters of center, nearest first.
+func (c *Cache) GetNearbyMapLocations(ctx context.Context, center datex.Coordinates, radius float64, limit int) ([]shared.NearbyLocation, error) {
+	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("geo_nearby"))
+	defer timer.ObserveDuration()
+
+	pad, err := c.maxExtent(ctx)
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_nearby", "error").Inc()
+		return nil, err
+	}
+
+	req := c.client.B().
+		Geosearch().
+		Key(mapIncidentsGeoKey).
+		Fromlonlat(center.Lon, center.Lat).
+		Byradius(radius + pad).
+		M().
+		Asc().
+		Build()
+
+	ids, err := c.client.Do(ctx, req).AsStrSlice()
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_nearby", "error").Inc()
+		return nil, fmt.Errorf("failed to search geo index: %w", err)
+	}
+
+	candidates, err := c.getMapLocations(ctx, ids)
+	if err != nil {
+		CacheOperations.WithLabelValues("geo_nearby", "error").Inc()
+		return nil, err
+	}
+
+	nearby := make([]shared.NearbyLocation, 0, len(candidates))
+	for _, loc := range candidates {
+		if d := loc.DistanceTo(center); d <= radius {
+			nearby = append(nearby, shared.NearbyLocation{MapLocation: loc, Proximity: d})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool {
+		return nearby[i].Proximity < nearby[j].Proximity
+	})
+	if limit > 0 && len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+
+	CacheOperations.WithLabelValues("geo_nearby", "success").Inc()
+	return nearby, nil
+}
+
+// getMapLocations loads the given incidents in order, skipping those that have
+// expired or been removed. Expired ones are dropped from the cache on the way.
+func (c *Cache) getMapLocations(ctx context.Context, ids []string) ([]shared.MapLocation, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmds := make(valkey.Commands, 0, len(ids)+1)
+	cmds = append(cmds, c.client.B().Hmget().Key(mapIncidentsKey).Field(ids...).Build())
+	for _, id := range ids {
+		cmds = append(cmds, c.client.B().Exists().Key(expireKey(id)).Build())
+	}
+	resps := c.client.DoMulti(ctx, cmds...)
+
+	values, err := resps[0].ToArray()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get locations: %w", err)
+	}
+
+	var (
+		locations []shared.MapLocation
+		stale     []string
+	)
+	for i, id := range ids {
+		raw, err := values[i].ToString()
+		if err != nil {
+			stale = append(stale, id) // removed from the hash but still indexed
+			continue
+		}
+		if exists, err := resps[i+1].AsInt64(); err == nil && exists == 0 {
+			stale = append(stale, id)
+			continue
+		}
+
+		loc, err := decodeMapLocation(raw)
+		if err != nil {
+			continue // skip invalid entries
+		}
+		locations = append(locations, loc)
+	}
+
+	if len(stale) > 0 {
+		c.client.Do(ctx, c.client.B().Hdel().Key(mapIncidentsKey).Field(stale...).Build()) //nolint:errcheck
+		c.unindexLocation(ctx, stale...)                                                   //nolint:errcheck
+		CacheCleanupExpired.Add(float64(len(stale)))
+	}
+
+	return locations, nil
+}
@@ -11,7 +11,7 @@ var (
 	CacheOperations = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: metricsPrefix + "_cache_operations_total",
 		Help: "Total number of cache operations",
-	}, []string{"operation", "status"}) // operation: store, remove, get, get_all; status: success, error
+	}, []string{"operation", "status"}) // operation: store, replace, remove, touch, get, get_all, count, geo_bbox, geo_nearby; status: success, error, stale
 
 	CacheOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    metricsPrefix + "_cache_operation_duration_seconds",
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Routes are stored under route:{backend}:{dataset version}:{endpoints}. The
+// current version of each backend is kept in route:{backend}:version so every
+// ingester agrees on it.
+const (
+	unversionedRoutes = "unversioned" // datasets that report no version
+	routeScanCount    = 1000
+)
+
+// cachedRoute is the stored form of a routing.RouteResult; the path is kept
+// only as polylines.
+type cachedRoute struct {
+	Polylines routing.Polylines `json:"polylines"`
+	Distance  float64           `json:"distance"`
+	Duration  float64           `json:"duration"`
+	Source    string            `json:"source,omitempty"`
+}
+
+func routeCacheKey(backend, version, key string) string {
+	if version == "" {
+		version = unversionedRoutes
+	}
+	return fmt.Sprintf("route:%s:%s:%s", backend, version, key)
+}
+
+func routeVersionKey(backend string) string {
+	return fmt.Sprintf("route:%s:version", backend)
+}
+
+func (c *Cache) GetRoute(ctx context.Context, backend, version, key string) (routing.RouteResult, bool, error) {
+	req := c.client.B().Get().Key(routeCacheKey(backend, version, key)).Build()
+	raw, err := c.client.Do(ctx, req).ToString()
+	if valkey.IsValkeyNil(err) {
+		return routing.RouteResult{}, false, nil
+	}
+	if err != nil {
+		return routing.RouteResult{}, false, fmt.Errorf("failed to get route: %w", err)
+	}
+
+	var cr cachedRoute
+	if err := json.Unmarshal([]byte(raw), &cr); err != nil {
+		return routing.RouteResult{}, false, fmt.Errorf("failed to unmarshal route: %w", err)
+	}
+	path, err := routing.DecodePolyline(cr.Polylines.Full)
+	if err != nil {
+		return routing.RouteResult{}, false, fmt.Errorf("failed to decode route: %w", err)
+	}
+
+	return routing.RouteResult{
+		Path:      path,
+		Polylines: cr.Polylines,
+		Distance:  cr.Distance,
+		Duration:  cr.Duration,
+		Source:    cmp.Or(cr.Source, backend),
+	}, true, nil
+}
+
+func (c *Cache) StoreRoute(ctx context.Context, backend, version, key string, route routing.RouteResult, ttl time.Duration) error {
+	data, err := json.Marshal(cachedRoute{
+		Polylines: route.Polylines,
+		Distance:  route.Distance,
+		Duration:  route.Duration,
+		Source:    route.Source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal route: %w", err)
+	}
+
+	req := c.client.B().
+		Set().
+		Key(routeCacheKey(backend, version, key)).
+		Value(string(data)).
+		Ex(ttl).
+		Build()
+	if err := c.client.Do(ctx, req).Error(); err != nil {
+		return fmt.Errorf("failed to store route: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) RouteDatasetVersion(ctx context.Context, backend string) (string, error) {
+	req := c.client.B().Get().Key(routeVersionKey(backend)).Build()
+	version, err := c.client.Do(ctx, req).ToString()
+	if valkey.IsValkeyNil(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get route dataset version: %w", err)
+	}
+	return version, nil
+}
+
+func (c *Cache) SetRouteDatasetVersion(ctx context.Context, backend, version string) (bool, error) {
+	req := c.client.B().Set().Key(routeVersionKey(backend)).Value(version).Get().Build()
+	previous, err := c.client.Do(ctx, req).ToString()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return false, fmt.Errorf("failed to set route dataset version: %w", err)
+	}
+	if previous == version {
+		return false, nil
+	}
+
+	if err := c.deleteMatching(ctx, routeCacheKey(backend, previous, "*")); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// deleteMatching unlinks every key matching pattern.
+func (c *Cache) deleteMatching(ctx context.Context, pattern string) error {
+	var cursor uint64
+	for {
+		req := c.client.B().Scan().Cursor(cursor).Match(pattern).Count(routeScanCount).Build()
+		entry, err := c.client.Do(ctx, req).AsScanEntry()
+		if err != nil {
+			return fmt.Errorf("failed to scan keys: %w", err)
+		}
+		if len(entry.Elements) > 0 {
+			if err := c.client.Do(ctx, c.client.B().Unlink().Key(entry.Elements...).Build()).Error(); err != nil {
+				return fmt.Errorf("failed to delete keys: %w", err)
+			}
+		}
+		if entry.Cursor == 0 {
+			return nil
+		}
+		cursor = entry.Cursor
+	}
+}
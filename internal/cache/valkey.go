@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -55,11 +56,15 @@ func (c *Cache) Ping(ctx context.Context) error {
 	return c.client.Do(ctx, req).Error()
 }
 
+// StoreMapLocation caches loc until its validity ends. It returns
+// ErrStaleVersion without writing if a newer version of the incident is
+// cached, or its version was deleted.
 func (c *Cache) StoreMapLocation(ctx context.Context, loc *shared.MapLocation, validity *datex.Validity) error {
 	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("store"))
 	defer timer.ObserveDuration()
 
-	data, err := json.Marshal(loc)
+	// Segment paths are stored as encoded polylines only.
+	data, err := json.Marshal(loc.Compact())
 	if err != nil {
 		CacheOperations.WithLabelValues("store", "error").Inc()
 		return fmt.Errorf("failed to marshal location: %w", err)
@@ -67,35 +72,37 @@ func (c *Cache) StoreMapLocation(ctx context.Context, loc *shared.MapLocation, v
 
 	ttl := c.calculateTTL(validity)
 
-	req := c.client.B().
-		Hset().
-		Key(mapIncidentsKey).
-		FieldValue().
-		FieldValue(loc.ID, string(data)).
-		Build()
-
-	if err := c.client.Do(ctx, req).Error(); err != nil {
+	stored, err := storeLocationScript.Exec(ctx, c.client,
+		[]string{mapIncidentsKey, expireKey(loc.ID), versionKey(loc.ID)},
+		[]string{
+			loc.ID,
+			string(data),
+			strconv.FormatInt(loc.Version, 10),
+			strconv.FormatInt(int64(ttl.Seconds()), 10),
+			strconv.FormatInt(int64((ttl + versionTombstoneTTL).Seconds()), 10),
+			mapIncidentsChangedChannel,
+		},
+	).AsInt64()
+	if err != nil {
 		CacheOperations.WithLabelValues("store", "error").Inc()
 		return fmt.Errorf("failed to store location: %w", err)
 	}
+	if stored == 0 {
+		CacheOperations.WithLabelValues("store", "stale").Inc()
+		return ErrStaleVersion
+	}
 
-	expireKey := fmt.Sprintf("map:incident:%s:expire", loc.ID)
-	req = c.client.B().
-		Set().
-		Key(expireKey).
-		Value(loc.ID).
-		Ex(ttl).
-		Build()
-
-	if err := c.client.Do(ctx, req).Error(); err != nil {
+	if err := c.indexLocation(ctx, loc); err != nil {
 		CacheOperations.WithLabelValues("store", "error").Inc()
-		return fmt.Errorf("failed to set expiration: %w", err)
+		return err
 	}
 
 	CacheOperations.WithLabelValues("store", "success").Inc()
 	return nil
 }
 
+// GetMapLocation returns the cached location of an incident, or
+// ErrLocationNotFound if it is not cached.
 func (c *Cache) GetMapLocation(ctx context.Context, id string) (*shared.MapLocation, error) {
 	req := c.client.B().
 		Hget().
@@ -104,18 +111,23 @@ func (c *Cache) GetMapLocation(ctx context.Context, id string) (*shared.MapLocat
 		Build()
 
 	result, err := c.client.Do(ctx, req).ToString()
+	if valkey.IsValkeyNil(err) {
+		return nil, ErrLocationNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get location: %w", err)
 	}
 
-	var loc shared.MapLocation
-	if err := json.Unmarshal([]byte(result), &loc); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal location: %w", err)
+	loc, err := decodeMapLocation(result)
+	if err != nil {
+		return nil, err
 	}
 
 	return &loc, nil
 }
 
+// RemoveMapLocation removes the location of an ended or deleted incident and
+// announces the change.
 func (c *Cache) RemoveMapLocation(ctx context.Context, id string) error {
 	timer := prometheus.NewTimer(CacheOperationDuration.WithLabelValues("remove"))
 	defer timer.ObserveDuration()
@@ -131,13 +143,22 @@ func (c *Cache) RemoveMapLocation(ctx context.Context, id string) error {
 		return fmt.Errorf("failed to remove location: %w", err)
 	}
 
-	expireKey := fmt.Sprintf("map:incident:%s:expire", id)
-	req = c.client.B().
-		Del().
-		Key(expireKey).
-		Build()
+	// Keep the version as a tombstone, so that the deleted version cannot
+	// be stored again.
+	cmds := valkey.Commands{
+		c.client.B().Del().Key(expireKey(id)).Build(),
+		c.client.B().Hset().Key(versionKey(id)).FieldValue().FieldValue("deleted", "1").Build(),
+		c.client.B().Expire().Key(versionKey(id)).Seconds(int64(versionTombstoneTTL.Seconds())).Build(),
+		c.client.B().Del().Key(digestKey(id)).Build(),
+	}
+	c.client.DoMulti(ctx, cmds...) //nolint:errcheck
+	c.unindexLocation(ctx, id)     //nolint:errcheck
 
-	c.client.Do(ctx, req) //nolint:errcheck
+	req = c.client.B().Publish().Channel(mapIncidentsChangedChannel).Message(id).Build()
+	if err := c.client.Do(ctx, req).Error(); err != nil {
+		CacheOperations.WithLabelValues("remove", "error").Inc()
+		return fmt.Errorf("failed to announce removed location: %w", err)
+	}
 
 	CacheOperations.WithLabelValues("remove", "success").Inc()
 	return nil
@@ -167,8 +188,8 @@ func (c *Cache) GetAllMapLocations(ctx context.Context) ([]shared.MapLocation, e
 
 	locations := make([]shared.MapLocation, 0, len(result))
 	for _, v := range result {
-		var loc shared.MapLocation
-		if err := json.Unmarshal([]byte(v), &loc); err != nil {
+		loc, err := decodeMapLocation(v)
+		if err != nil {
 			continue // skip invalid entries
 		}
 		locations = append(locations, loc)
@@ -204,6 +225,18 @@ func (c *Cache) GetActiveCount(ctx context.Context) (int64, error) {
 	return count, nil
 }
 
+// decodeMapLocation parses a stored location and restores its path.
+func decodeMapLocation(raw string) (shared.MapLocation, error) {
+	var loc shared.MapLocation
+	if err := json.Unmarshal([]byte(raw), &loc); err != nil {
+		return shared.MapLocation{}, fmt.Errorf("failed to unmarshal location: %w", err)
+	}
+	if err := loc.Expand(); err != nil {
+		return shared.MapLocation{}, err
+	}
+	return loc, nil
+}
+
 func (c *Cache) calculateTTL(validity *datex.Validity) time.Duration {
 	if validity == nil || validity.EndTime == nil {
 		return defaultTTL
@@ -236,10 +269,9 @@ func (c *Cache) cleanupExpired(ctx context.Context) error {
 	}
 
 	for _, id := range ids {
-		expireKey := fmt.Sprintf("map:incident:%s:expire", id)
 		req = c.client.B().
 			Exists().
-			Key(expireKey).
+			Key(expireKey(id)).
 			Build()
 
 		exists, err := c.client.Do(ctx, req).
@@ -255,7 +287,8 @@ func (c *Cache) cleanupExpired(ctx context.Context) error {
 				Key(mapIncidentsKey).
 				Field(id).
 				Build()
-			c.client.Do(ctx, req) //nolint:errcheck
+			c.client.Do(ctx, req)      //nolint:errcheck
+			c.unindexLocation(ctx, id) //nolint:errcheck
 			CacheCleanupExpired.Inc()
 		}
 	}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Each incident's version is kept next to its location, and outlives it by
+// versionTombstoneTTL once the incident ends or is deleted, so a late or
+// replayed message about an older version cannot bring it back.
+const versionTombstoneTTL = 24 * time.Hour
+
+// ErrStaleVersion is returned when storing a location older than the one
+// cached, or no newer than the version deleted.
+var ErrStaleVersion = errors.New("stale incident version")
+
+func expireKey(id string) string {
+	return fmt.Sprintf("map:incident:%s:expire", id)
+}
+
+func versionKey(id string) string {
+	return fmt.Sprintf("map:incident:%s:version", id)
+}
+
+// storeLocationScript stores a location unless a newer version is cached,
+// and announces the change.
+// KEYS: locations hash, expire key, version key.
+// ARGV: id, location, version, ttl, version ttl (seconds), channel.
+var storeLocationScript = valkey.NewLuaScript(`
+local current = redis.call('HMGET', KEYS[3], 'version', 'deleted')
+local stored = tonumber(current[1])
+local version = tonumber(ARGV[3])
+if stored and (version < stored or (version == stored and current[2] == '1')) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('SET', KEYS[2], ARGV[1], 'EX', ARGV[4])
+redis.call('DEL', KEYS[3])
+redis.call('HSET', KEYS[3], 'version', ARGV[3])
+redis.call('EXPIRE', KEYS[3], ARGV[5])
+redis.call('PUBLISH', ARGV[6], ARGV[1])
+return 1
+`)
+
+// replaceLocationScript overwrites the location of a live incident unless a
+// newer version has been stored since, and announces the change.
+// KEYS: locations hash, expire key, version key.
+// ARGV: id, location, version, channel.
+var replaceLocationScript = valkey.NewLuaScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return 0
+end
+local stored = tonumber(redis.call('HGET', KEYS[3], 'version'))
+if stored and tonumber(ARGV[3]) < stored then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('PUBLISH', ARGV[4], ARGV[1])
+return 1
+`)
@@ -10,6 +10,7 @@ import (
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sverdejot/beacon/internal/routing"
 )
 
 const (
@@ -17,17 +18,58 @@ const (
 	flushInterval = 5 * time.Second
 )
 
+// Write is one change to traffic_incidents: a row to insert, or an update to
+// the rows of an incident. Writes are queued, retried and spooled together,
+// so an update is never applied before the rows it is meant for are
+// inserted. Exactly one field is set.
+type Write struct {
+	Insert *Incident    `json:"insert,omitempty"`
+	End    *EndUpdate   `json:"end,omitempty"`
+	Route  *RouteUpdate `json:"route,omitempty"`
+}
+
+// EndUpdate marks an incident as ended.
+type EndUpdate struct {
+	ID      string    `json:"id"`
+	EndTime time.Time `json:"endTime"`
+}
+
+// RouteUpdate records the route of a re-routed segment.
+type RouteUpdate struct {
+	ID           string   `json:"id"`
+	LengthMeters *float32 `json:"lengthMeters,omitempty"`
+	Source       string   `json:"source"`
+	Confidence   *float32 `json:"confidence,omitempty"`
+	Polyline     string   `json:"polyline"`
+}
+
+// WriteOptions configures how batches that fail to insert are handled.
+type WriteOptions struct {
+	MaxRetries   int           // retries of a failed insert before spooling it
+	RetryBackoff time.Duration // wait before the first retry, doubled on each one
+	SpoolDir     string        // where batches are kept while ClickHouse is down; empty disables spooling
+}
+
 type ClickHouseClient struct {
 	conn          driver.Conn
-	batch         []Incident
+	batch         []Write
 	batchMu       sync.Mutex
 	batchSize     int
 	flushInterval time.Duration
+	flushCh       chan struct{}
 	cancel        context.CancelFunc
 	done          chan struct{}
+
+	// writeMu serializes writes so batches reach ClickHouse in order.
+	writeMu sync.Mutex
+	opts    WriteOptions
+	spool   *Spool
+
+	// applier applies writes to ClickHouse: apply, or a fake in tests.
+	applier func(ctx context.Context, batch []Write) (int, error)
 }
 
-func NewClickHouseClient(addr, database, user, password string) (*ClickHouseClient, error) {
+func NewClickHouseClient(addr, database, user, password string, opts WriteOptions) (*ClickHouseClient, error) {
 	slog.Debug("creating clickhouse client",
 		slog.String("addr", addr),
 		slog.String("database", database),
@@ -54,49 +96,231 @@ func NewClickHouseClient(addr, database, user, password string) (*ClickHouseClie
 		return nil, fmt.Errorf("failed to ping clickhouse: %w", err)
 	}
 
+	var spool *Spool
+	if opts.SpoolDir != "" {
+		if spool, err = OpenSpool(opts.SpoolDir); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	client := &ClickHouseClient{
 		conn:          conn,
-		batch:         make([]Incident, 0, batchSize),
+		batch:         make([]Write, 0, batchSize),
 		batchSize:     batchSize,
 		flushInterval: flushInterval,
+		flushCh:       make(chan struct{}, 1),
 		cancel:        cancel,
 		done:          make(chan struct{}),
+		opts:          opts,
+		spool:         spool,
 	}
+	client.applier = client.apply
 
 	go client.periodicFlush(ctx)
 
-	slog.Info("clickhouse client initialized",
+	attrs := []any{
 		slog.Int("batch_size", batchSize),
 		slog.Duration("flush_interval", flushInterval),
-	)
+	}
+	if spool != nil {
+		attrs = append(attrs, slog.String("spool_dir", opts.SpoolDir), slog.Int("spooled_batches", spool.Len()))
+	}
+	slog.Info("clickhouse client initialized", attrs...)
 
 	return client, nil
 }
 
+// Insert queues inc for the next batch. Full batches are flushed in the
+// background, so a slow or unavailable ClickHouse never blocks the caller.
 func (c *ClickHouseClient) Insert(ctx context.Context, inc *Incident) {
+	c.enqueue(Write{Insert: inc})
+}
+
+// SetEndTimestamp queues marking the incident as ended at endTime, behind
+// any of its rows still waiting to be inserted.
+func (c *ClickHouseClient) SetEndTimestamp(ctx context.Context, id string, endTime time.Time) {
+	c.enqueue(Write{End: &EndUpdate{ID: id, EndTime: endTime}})
+}
+
+// SetRoute queues recording a segment's routed length, source, confidence
+// and path once it has been re-routed, for versions still stored with an
+// approximate path. A nil length keeps the stored one.
+func (c *ClickHouseClient) SetRoute(ctx context.Context, id string, lengthMeters *float32, source string, confidence *float32, polyline string) {
+	c.enqueue(Write{Route: &RouteUpdate{
+		ID:           id,
+		LengthMeters: lengthMeters,
+		Source:       source,
+		Confidence:   confidence,
+		Polyline:     polyline,
+	}})
+}
+
+func (c *ClickHouseClient) enqueue(w Write) {
 	c.batchMu.Lock()
-	c.batch = append(c.batch, *inc)
+	c.batch = append(c.batch, w)
 	shouldFlush := len(c.batch) >= c.batchSize
 	ClickHousePendingBatch.Set(float64(len(c.batch)))
 	c.batchMu.Unlock()
 
 	if shouldFlush {
-		c.Flush(ctx)
+		select {
+		case c.flushCh <- struct{}{}:
+		default: // a flush is already pending
+		}
 	}
 }
 
+// Flush writes the pending batch, after replaying any spooled ones.
 func (c *ClickHouseClient) Flush(ctx context.Context) {
 	c.batchMu.Lock()
-	if len(c.batch) == 0 {
-		c.batchMu.Unlock()
-		return
-	}
-	toInsert := c.batch
-	c.batch = make([]Incident, 0, 100)
+	toWrite := c.batch
+	c.batch = make([]Write, 0, c.batchSize)
 	ClickHousePendingBatch.Set(0)
 	c.batchMu.Unlock()
 
+	c.write(ctx, toWrite)
+}
+
+// write applies batch, retrying with backoff, and spools what is left of it
+// if ClickHouse stays unavailable. While earlier batches are spooled, batch
+// is queued behind them so history is written in order.
+func (c *ClickHouseClient) write(ctx context.Context, batch []Write) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.spool != nil {
+		c.spool.updateMetrics()
+		if c.replay(ctx) != nil {
+			c.spoolBatch(batch)
+			return
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	n, err := c.applier(ctx, batch)
+	for attempt := 0; err != nil && attempt < c.opts.MaxRetries; attempt++ {
+		ClickHouseRetries.Inc()
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.opts.RetryBackoff << attempt):
+		}
+		batch = batch[n:]
+		n, err = c.applier(ctx, batch)
+	}
+	if err == nil {
+		return
+	}
+	batch = batch[n:]
+
+	if c.spool == nil {
+		slog.ErrorContext(ctx, "dropping batch after failed retries",
+			slog.String("error", err.Error()),
+			slog.Int("batch_size", len(batch)),
+		)
+		return
+	}
+	c.spoolBatch(batch)
+}
+
+// replay applies the spooled batches oldest first, stopping at the first
+// that fails. A batch that fails part way is replaced by what is left of it.
+func (c *ClickHouseClient) replay(ctx context.Context) error {
+	for {
+		name, batch, ok := c.spool.Peek()
+		if !ok {
+			return nil
+		}
+		if n, err := c.applier(ctx, batch); err != nil {
+			if n > 0 {
+				if rerr := c.spool.Replace(name, batch[n:]); rerr != nil {
+					slog.ErrorContext(ctx, "failed to trim partly replayed batch in spool",
+						slog.String("file", name),
+						slog.String("error", rerr.Error()),
+					)
+				}
+			}
+			return err
+		}
+		if err := c.spool.Remove(name); err != nil {
+			// Left in place, the batch would be inserted again.
+			slog.ErrorContext(ctx, "failed to remove replayed batch from spool",
+				slog.String("file", name),
+				slog.String("error", err.Error()),
+			)
+			return err
+		}
+		ClickHouseReplayedBatches.Inc()
+		slog.InfoContext(ctx, "replayed spooled batch",
+			slog.String("file", name),
+			slog.Int("count", len(batch)),
+			slog.Int("remaining", c.spool.Len()),
+		)
+	}
+}
+
+func (c *ClickHouseClient) spoolBatch(batch []Write) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := c.spool.Push(batch); err != nil {
+		slog.Error("failed to spool batch, dropping it",
+			slog.String("error", err.Error()),
+			slog.Int("batch_size", len(batch)),
+		)
+		ClickHouseErrors.WithLabelValues("spool").Inc()
+		return
+	}
+	ClickHouseSpooledBatches.Inc()
+	slog.Warn("clickhouse unavailable, spooled batch",
+		slog.Int("batch_size", len(batch)),
+		slog.Int("spooled_batches", c.spool.Len()),
+	)
+}
+
+// apply writes batch in order, sending each run of inserts as a single
+// batch. It returns how many writes were applied before the first that
+// failed.
+func (c *ClickHouseClient) apply(ctx context.Context, batch []Write) (int, error) {
+	done := 0
+	for done < len(batch) {
+		if batch[done].Insert == nil {
+			if err := c.update(ctx, batch[done]); err != nil {
+				return done, err
+			}
+			done++
+			continue
+		}
+
+		end := done
+		var rows []Incident
+		for end < len(batch) && batch[end].Insert != nil {
+			rows = append(rows, *batch[end].Insert)
+			end++
+		}
+		if err := c.insert(ctx, rows); err != nil {
+			return done, err
+		}
+		done = end
+	}
+	return done, nil
+}
+
+// update applies a write that changes rows already inserted.
+func (c *ClickHouseClient) update(ctx context.Context, w Write) error {
+	switch {
+	case w.End != nil:
+		return c.setEndTimestamp(ctx, w.End)
+	case w.Route != nil:
+		return c.setRoute(ctx, w.Route)
+	}
+	return nil
+}
+
+// insert writes toInsert in a single batch.
+func (c *ClickHouseClient) insert(ctx context.Context, toInsert []Incident) error {
 	timer := prometheus.NewTimer(ClickHouseFlushDuration)
 	defer timer.ObserveDuration()
 
@@ -108,7 +332,10 @@ func (c *ClickHouseClient) Flush(ctx context.Context) {
 			severity, probability, lat, lon, km, cause_type, cause_subtypes,
 			road_name, road_number, raw_json, location_type,
 			name, direction, length_meters, to_lat, to_lon, to_km,
-			municipality, autonomous_community, delay_minutes, mobility, road_destination
+			municipality, autonomous_community, delay_minutes, mobility, road_destination,
+			route_source, original_lat, original_lon, original_to_lat, original_to_lon,
+			snap_distance, to_snap_distance, route_confidence, route_polyline,
+			estimated_location
 		)
 	`)
 	if err != nil {
@@ -117,7 +344,7 @@ func (c *ClickHouseClient) Flush(ctx context.Context) {
 			slog.Int("batch_size", len(toInsert)),
 		)
 		ClickHouseErrors.WithLabelValues("prepare_batch").Inc()
-		return
+		return fmt.Errorf("failed to prepare batch: %w", err)
 	}
 
 	for _, inc := range toInsert {
@@ -170,6 +397,16 @@ func (c *ClickHouseClient) Flush(ctx context.Context) {
 			inc.DelayMinutes,
 			inc.Mobility,
 			inc.RoadDestination,
+			inc.RouteSource,
+			inc.OriginalLat,
+			inc.OriginalLon,
+			inc.OriginalToLat,
+			inc.OriginalToLon,
+			inc.SnapDistance,
+			inc.ToSnapDistance,
+			inc.RouteConfidence,
+			inc.RoutePolyline,
+			inc.EstimatedLocation,
 		)
 		if err != nil {
 			slog.ErrorContext(ctx, "failed to append incident to batch",
@@ -186,11 +423,12 @@ func (c *ClickHouseClient) Flush(ctx context.Context) {
 			slog.Int("batch_size", len(toInsert)),
 		)
 		ClickHouseErrors.WithLabelValues("send").Inc()
-		return
+		return fmt.Errorf("failed to send batch: %w", err)
 	}
 
 	ClickHouseInserts.Add(float64(len(toInsert)))
 	slog.InfoContext(ctx, "batch inserted to clickhouse", slog.Int("count", len(toInsert)))
+	return nil
 }
 
 func (c *ClickHouseClient) periodicFlush(ctx context.Context) {
@@ -203,10 +441,14 @@ func (c *ClickHouseClient) periodicFlush(ctx context.Context) {
 			return
 		case <-ticker.C:
 			c.Flush(context.Background())
+		case <-c.flushCh:
+			c.Flush(context.Background())
 		}
 	}
 }
 
+// Close stops the periodic flush and writes the pending batch, spooling it
+// if ClickHouse is unavailable so it is replayed on the next start.
 func (c *ClickHouseClient) Close() error {
 	slog.Debug("closing clickhouse client, stopping periodic flush")
 	c.cancel()
@@ -216,10 +458,10 @@ func (c *ClickHouseClient) Close() error {
 	return c.conn.Close()
 }
 
-func (c *ClickHouseClient) SetEndTimestamp(ctx context.Context, id string, endTime time.Time) error {
+func (c *ClickHouseClient) setEndTimestamp(ctx context.Context, u *EndUpdate) error {
 	slog.DebugContext(ctx, "setting end timestamp for incident",
-		slog.String("incident_id", id),
-		slog.Time("end_time", endTime),
+		slog.String("incident_id", u.ID),
+		slog.Time("end_time", u.EndTime),
 	)
 
 	query := `
@@ -227,13 +469,68 @@ func (c *ClickHouseClient) SetEndTimestamp(ctx context.Context, id string, endTi
 		UPDATE end_timestamp = ?
 		WHERE id = ? AND (end_timestamp = toDateTime('1970-01-01 00:00:00') OR end_timestamp > ?)
 	`
-	err := c.conn.Exec(ctx, query, endTime, id, endTime)
+	err := c.conn.Exec(ctx, query, u.EndTime, u.ID, u.EndTime)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to set end timestamp",
-			slog.String("incident_id", id),
+			slog.String("incident_id", u.ID),
+			slog.String("error", err.Error()),
+		)
+		ClickHouseErrors.WithLabelValues("update").Inc()
+		return fmt.Errorf("failed to set end timestamp: %w", err)
+	}
+	return nil
+}
+
+func (c *ClickHouseClient) setRoute(ctx context.Context, u *RouteUpdate) error {
+	query := `
+		ALTER TABLE traffic_incidents
+		UPDATE length_meters = coalesce(?, length_meters), route_source = ?, route_confidence = ?, route_polyline = ?
+		WHERE id = ? AND route_source IN (?, ?)
+	`
+	err := c.conn.Exec(ctx, query, u.LengthMeters, u.Source, u.Confidence, u.Polyline, u.ID, routing.RouteSourceFallback, routing.RouteSourceGreatCircle)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to set route",
+			slog.String("incident_id", u.ID),
 			slog.String("error", err.Error()),
 		)
 		ClickHouseErrors.WithLabelValues("update").Inc()
+		return fmt.Errorf("failed to set route: %w", err)
+	}
+	return nil
+}
+
+// KmReferences returns the km markers located by stored incidents, one per
+// road and kmBin, at the median of the coordinates reported for it.
+// Estimated locations are left out so errors don't feed back into the index.
+func (c *ClickHouseClient) KmReferences(ctx context.Context) ([]KmReference, error) {
+	rows, err := c.conn.Query(ctx, `
+		SELECT road_number, round(k / ?) * ? AS bin, median(la), median(lo)
+		FROM (
+			SELECT road_number, toFloat64(km) AS k, lat AS la, lon AS lo
+			FROM traffic_incidents
+			WHERE km > 0 AND lat != 0 AND lon != 0
+			  AND road_number != '' AND NOT estimated_location
+			UNION ALL
+			SELECT road_number, toFloat64(to_km), to_lat, to_lon
+			FROM traffic_incidents
+			WHERE to_km > 0 AND to_lat != 0 AND to_lon != 0
+			  AND road_number != '' AND NOT estimated_location
+		)
+		GROUP BY road_number, bin
+	`, kmBin, kmBin)
+	if err != nil {
+		ClickHouseErrors.WithLabelValues("query").Inc()
+		return nil, fmt.Errorf("failed to query km references: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var refs []KmReference
+	for rows.Next() {
+		var ref KmReference
+		if err := rows.Scan(&ref.Road, &ref.Km, &ref.Coordinates.Lat, &ref.Coordinates.Lon); err != nil {
+			return nil, fmt.Errorf("failed to scan km reference: %w", err)
+		}
+		refs = append(refs, ref)
 	}
-	return err
+	return refs, rows.Err()
 }
@@ -0,0 +1,167 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeApplier applies writes until its budget runs out, then fails like an
+// unavailable ClickHouse.
+type fakeApplier struct {
+	applied []string
+	budget  int // writes left to apply; negative for no limit
+}
+
+func (f *fakeApplier) apply(_ context.Context, batch []Write) (int, error) {
+	for i, w := range batch {
+		if f.budget == 0 {
+			return i, errors.New("clickhouse unavailable")
+		}
+		f.budget--
+		f.applied = append(f.applied, writeID(w))
+	}
+	return len(batch), nil
+}
+
+func writeID(w Write) string {
+	switch {
+	case w.Insert != nil:
+		return "insert " + w.Insert.ID
+	case w.End != nil:
+		return "end " + w.End.ID
+	case w.Route != nil:
+		return "route " + w.Route.ID
+	}
+	return ""
+}
+
+func inserts(ids ...string) []Write {
+	batch := make([]Write, len(ids))
+	for i, id := range ids {
+		batch[i] = Write{Insert: &Incident{ID: id}}
+	}
+	return batch
+}
+
+func newTestClient(t *testing.T, fake *fakeApplier) *ClickHouseClient {
+	t.Helper()
+	spool, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ClickHouseClient{
+		opts:    WriteOptions{MaxRetries: 1, RetryBackoff: time.Millisecond},
+		spool:   spool,
+		applier: fake.apply,
+	}
+}
+
+func TestWriteSpoolsWhatIsLeftAndReplaysInOrder(t *testing.T) {
+	fake := &fakeApplier{budget: 2}
+	c := newTestClient(t, fake)
+	ctx := context.Background()
+
+	first := append(inserts("a", "b", "c"), Write{End: &EndUpdate{ID: "a"}}, Write{Route: &RouteUpdate{ID: "b"}})
+	c.write(ctx, first)
+	// Written behind the spooled batch, though ClickHouse is back for it.
+	fake.budget = 0
+	c.write(ctx, inserts("d"))
+
+	if c.spool.Len() != 2 {
+		t.Fatalf("got %d spooled batches, want 2", c.spool.Len())
+	}
+	_, batch, _ := c.spool.Peek()
+	if len(batch) != 3 {
+		t.Fatalf("got %d writes spooled from the first batch, want the 3 not applied", len(batch))
+	}
+
+	fake.budget = -1
+	c.write(ctx, inserts("e"))
+
+	want := []string{"insert a", "insert b", "insert c", "end a", "route b", "insert d", "insert e"}
+	if !slices.Equal(fake.applied, want) {
+		t.Errorf("got writes applied %v, want %v", fake.applied, want)
+	}
+	if c.spool.Len() != 0 {
+		t.Errorf("got %d spooled batches left, want 0", c.spool.Len())
+	}
+}
+
+func TestReplayKeepsPartlyAppliedBatchFirst(t *testing.T) {
+	fake := &fakeApplier{budget: 0}
+	c := newTestClient(t, fake)
+	ctx := context.Background()
+
+	c.write(ctx, inserts("a", "b", "c"))
+	c.write(ctx, inserts("d", "e"))
+	oldest, _, _ := c.spool.Peek()
+
+	fake.budget = 1
+	c.write(ctx, nil)
+
+	name, batch, ok := c.spool.Peek()
+	if !ok || name != oldest {
+		t.Fatalf("got oldest batch %q, want %q kept in place", name, oldest)
+	}
+	if ids := batchIDs(batch); !slices.Equal(ids, []string{"insert b", "insert c"}) {
+		t.Fatalf("got %v left in the oldest batch, want the writes not applied", ids)
+	}
+	if c.spool.Len() != 2 {
+		t.Fatalf("got %d spooled batches, want 2", c.spool.Len())
+	}
+
+	fake.budget = -1
+	c.write(ctx, nil)
+
+	want := []string{"insert a", "insert b", "insert c", "insert d", "insert e"}
+	if !slices.Equal(fake.applied, want) {
+		t.Errorf("got writes applied %v, want %v", fake.applied, want)
+	}
+}
+
+func TestPeekSetsAsideCorruptBatches(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"0000000000000000001.jsonl": "not json\n",
+		"0000000000000000002.jsonl": "{}\n",
+		"0000000000000000003.jsonl": `{"insert":{"ID":"a"}}` + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, batch, ok := spool.Peek()
+	if !ok || name != "0000000000000000003.jsonl" {
+		t.Fatalf("got batch %q, want the first readable one", name)
+	}
+	if ids := batchIDs(batch); !slices.Equal(ids, []string{"insert a"}) {
+		t.Errorf("got %v, want [insert a]", ids)
+	}
+	if spool.Len() != 1 {
+		t.Errorf("got %d spooled batches, want 1", spool.Len())
+	}
+	for _, corrupt := range []string{"0000000000000000001.jsonl", "0000000000000000002.jsonl"} {
+		if _, err := os.Stat(filepath.Join(dir, corrupt+".corrupt")); err != nil {
+			t.Errorf("batch %s not set aside: %v", corrupt, err)
+		}
+	}
+}
+
+func batchIDs(batch []Write) []string {
+	ids := make([]string, len(batch))
+	for i, w := range batch {
+		ids[i] = writeID(w)
+	}
+	return ids
+}
@@ -0,0 +1,385 @@
+package ingester
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const deadLetterFile = "deadletters.jsonl"
+
+// ErrDeadLetterNotFound is returned when no dead letter has the requested ID.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is an MQTT message the ingester rejected, kept so it can be
+// inspected and re-driven once the cause is fixed.
+type DeadLetter struct {
+	ID         string     `json:"id"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+	Topic      string     `json:"topic"`
+	Payload    string     `json:"payload"`
+	Error      string     `json:"error"`
+	RedrivenAt *time.Time `json:"redrivenAt,omitempty"`
+}
+
+// DeadLetterFilter selects dead letters to list. Zero fields match all.
+type DeadLetterFilter struct {
+	Topic   string // topic prefix
+	Since   time.Time
+	Pending bool // only letters not re-driven yet
+	Oldest  bool // oldest first, instead of newest
+	Limit   int
+}
+
+func (f DeadLetterFilter) match(dl *DeadLetter) bool {
+	return strings.HasPrefix(dl.Topic, f.Topic) &&
+		!dl.ReceivedAt.Before(f.Since) &&
+		(!f.Pending || dl.RedrivenAt == nil)
+}
+
+// DeadLetterStore keeps dead letters in ClickHouse. While ClickHouse is
+// unavailable they are appended to a local file instead, and moved over by
+// Drain once it is back.
+type DeadLetterStore struct {
+	ch   *ClickHouseClient
+	path string // local file; empty disables the fallback
+
+	// mu guards the local file.
+	mu sync.Mutex
+}
+
+// NewDeadLetterStore opens the store, keeping its local file in dir. An
+// empty dir disables the fallback, and letters are lost while ClickHouse is
+// down.
+func NewDeadLetterStore(ch *ClickHouseClient, dir string) (*DeadLetterStore, error) {
+	s := &DeadLetterStore{ch: ch}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+	s.path = filepath.Join(dir, deadLetterFile)
+	if err := terminateLastLine(s.path); err != nil {
+		return nil, err
+	}
+
+	letters, err := s.readFile()
+	if err != nil {
+		return nil, err
+	}
+	DeadLettersLocal.Set(float64(len(letters)))
+	return s, nil
+}
+
+// Add records a message rejected with cause. It fails only if the letter
+// could be stored neither in ClickHouse nor in the local file.
+func (s *DeadLetterStore) Add(ctx context.Context, topic string, payload []byte, cause error) error {
+	dl := DeadLetter{
+		ID:         uuid.NewString(),
+		ReceivedAt: time.Now().UTC(),
+		Topic:      topic,
+		Payload:    string(payload),
+		Error:      cause.Error(),
+	}
+
+	err := s.ch.insertDeadLetters(ctx, []DeadLetter{dl})
+	if err == nil {
+		DeadLetters.WithLabelValues("clickhouse").Inc()
+		return nil
+	}
+	if s.path == "" {
+		return err
+	}
+
+	slog.Warn("failed to store dead letter in clickhouse, keeping it on disk",
+		slog.String("dead_letter_id", dl.ID),
+		slog.String("error", err.Error()),
+	)
+	if err := s.append(dl); err != nil {
+		return err
+	}
+	DeadLetters.WithLabelValues("local").Inc()
+	return nil
+}
+
+func (s *DeadLetterStore) append(dl DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dead letter file: %w", err)
+	}
+	DeadLettersLocal.Inc()
+	return nil
+}
+
+// readFile returns the letters in the local file. Lines that cannot be read,
+// such as one cut short by a crash, are skipped. The caller must hold mu,
+// except while the store is being opened.
+func (s *DeadLetterStore) readFile() ([]DeadLetter, error) {
+	if s.path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			slog.Warn("skipping unreadable dead letter", slog.String("error", err.Error()))
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letter file: %w", err)
+	}
+	return letters, nil
+}
+
+// terminateLastLine ends the file at path with a newline if a crash left its
+// last line cut short, so the next letter is not appended to it.
+func terminateLastLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return fmt.Errorf("failed to read dead letter file: %w", err)
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	if _, err := f.WriteAt([]byte{'\n'}, info.Size()); err != nil {
+		return fmt.Errorf("failed to repair dead letter file: %w", err)
+	}
+	return nil
+}
+
+func (s *DeadLetterStore) local() ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readFile()
+}
+
+// Drain moves the letters in the local file to ClickHouse and returns how
+// many were moved.
+func (s *DeadLetterStore) Drain(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters, err := s.readFile()
+	if err != nil || len(letters) == 0 {
+		return 0, err
+	}
+	if err := s.ch.insertDeadLetters(ctx, letters); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(s.path); err != nil {
+		return 0, fmt.Errorf("failed to remove dead letter file: %w", err)
+	}
+	DeadLettersLocal.Set(0)
+	return len(letters), nil
+}
+
+// List returns the dead letters matching f, including those still in the
+// local file.
+func (s *DeadLetterStore) List(ctx context.Context, f DeadLetterFilter) ([]DeadLetter, error) {
+	letters, err := s.ch.queryDeadLetters(ctx, f, "")
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	for i := range local {
+		if f.match(&local[i]) {
+			letters = append(letters, local[i])
+		}
+	}
+
+	slices.SortFunc(letters, func(a, b DeadLetter) int {
+		if f.Oldest {
+			return a.ReceivedAt.Compare(b.ReceivedAt)
+		}
+		return b.ReceivedAt.Compare(a.ReceivedAt)
+	})
+	if f.Limit > 0 && len(letters) > f.Limit {
+		letters = letters[:f.Limit]
+	}
+	return letters, nil
+}
+
+// Get returns the dead letter with the given ID.
+func (s *DeadLetterStore) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	for i := range local {
+		if local[i].ID == id {
+			return &local[i], nil
+		}
+	}
+
+	letters, err := s.ch.queryDeadLetters(ctx, DeadLetterFilter{Limit: 1}, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &letters[0], nil
+}
+
+// MarkRedriven records that dl has been re-driven. Letters still in the
+// local file are moved to ClickHouse first, so it fails while ClickHouse is
+// down.
+func (s *DeadLetterStore) MarkRedriven(ctx context.Context, dl *DeadLetter) error {
+	if _, err := s.Drain(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	marked := *dl
+	marked.RedrivenAt = &now
+	if err := s.ch.insertDeadLetters(ctx, []DeadLetter{marked}); err != nil {
+		return err
+	}
+	dl.RedrivenAt = &now
+	return nil
+}
+
+// insertDeadLetters writes letters straight to ClickHouse; they are rare
+// enough not to need batching.
+func (c *ClickHouseClient) insertDeadLetters(ctx context.Context, letters []DeadLetter) error {
+	batch, err := c.conn.PrepareBatch(ctx, `
+		INSERT INTO dead_letters (id, received_at, topic, payload, error, redriven_at, updated_at)
+	`)
+	if err != nil {
+		ClickHouseErrors.WithLabelValues("prepare_batch").Inc()
+		return fmt.Errorf("failed to prepare dead letter batch: %w", err)
+	}
+
+	for _, dl := range letters {
+		updated := dl.ReceivedAt
+		if dl.RedrivenAt != nil {
+			updated = *dl.RedrivenAt
+		}
+		if err := batch.Append(dl.ID, dl.ReceivedAt, dl.Topic, dl.Payload, dl.Error, dl.RedrivenAt, updated); err != nil {
+			ClickHouseErrors.WithLabelValues("append").Inc()
+			return fmt.Errorf("failed to append dead letter: %w", err)
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		ClickHouseErrors.WithLabelValues("send").Inc()
+		return fmt.Errorf("failed to send dead letters: %w", err)
+	}
+	return nil
+}
+
+// queryDeadLetters returns the stored dead letters matching f, restricted to
+// id if it is not empty.
+func (c *ClickHouseClient) queryDeadLetters(ctx context.Context, f DeadLetterFilter, id string) ([]DeadLetter, error) {
+	var (
+		conds []string
+		args  []any
+	)
+	if id != "" {
+		conds = append(conds, "id = ?")
+		args = append(args, id)
+	}
+	if f.Topic != "" {
+		conds = append(conds, "startsWith(topic, ?)")
+		args = append(args, f.Topic)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "received_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Pending {
+		conds = append(conds, "redriven_at IS NULL")
+	}
+
+	query := "SELECT id, received_at, topic, payload, error, redriven_at FROM dead_letters FINAL"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if f.Oldest {
+		query += " ORDER BY received_at"
+	} else {
+		query += " ORDER BY received_at DESC"
+	}
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := c.conn.Query(ctx, query, args...)
+	if err != nil {
+		ClickHouseErrors.WithLabelValues("query").Inc()
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var dl DeadLetter
+		if err := rows.Scan(&dl.ID, &dl.ReceivedAt, &dl.Topic, &dl.Payload, &dl.Error, &dl.RedrivenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		letters = append(letters, dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	return letters, nil
+}
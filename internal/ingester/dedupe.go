@@ -0,0 +1,35 @@
+package ingester
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// Digest returns a content hash of the record as published on topic. The
+// record is normalized first: cause subtypes may come in any order. The
+// version is kept, so a new version is stored even if nothing else changed
+// and the stored version never falls behind the publisher's.
+//
+// It must be computed before the record is estimated or snapped, which
+// rewrite its coordinates.
+func Digest(topic string, r *datex.Record) string {
+	n := *r
+	if r.Cause != nil {
+		cause := *r.Cause
+		cause.Subtypes = slices.Clone(cause.Subtypes)
+		slices.Sort(cause.Subtypes)
+		n.Cause = &cause
+	}
+
+	// Record marshals deterministically: fields in declaration order.
+	data, _ := json.Marshal(n)
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
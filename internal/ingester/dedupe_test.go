@@ -0,0 +1,24 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+func TestDigest(t *testing.T) {
+	const topic = "beacon/es/madrid/situations/a"
+	base := datex.Record{ID: "a", Version: "1", Cause: &datex.Cause{Subtypes: []string{"x", "y"}}}
+
+	reordered := base
+	reordered.Cause = &datex.Cause{Subtypes: []string{"y", "x"}}
+	if Digest(topic, &base) != Digest(topic, &reordered) {
+		t.Error("reordering cause subtypes changed the digest")
+	}
+
+	bumped := base
+	bumped.Version = "2"
+	if Digest(topic, &base) == Digest(topic, &bumped) {
+		t.Error("a version-only bump kept the digest, so it would be skipped")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/sverdejot/beacon/internal/routing"
 	"github.com/sverdejot/beacon/internal/shared"
 	"github.com/sverdejot/beacon/pkg/datex"
 )
@@ -37,6 +38,16 @@ type Incident struct {
 	DelayMinutes        float32
 	Mobility            string
 	RoadDestination     string
+	RouteSource         string
+	OriginalLat         float64
+	OriginalLon         float64
+	OriginalToLat       float64
+	OriginalToLon       float64
+	SnapDistance        *float32
+	ToSnapDistance      *float32
+	RouteConfidence     *float32
+	RoutePolyline       string
+	EstimatedLocation   bool
 }
 
 func RecordToIncident(r *datex.Record, topic string, rawJSON string) *Incident {
@@ -130,6 +141,9 @@ func RecordToIncident(r *datex.Record, topic string, rawJSON string) *Incident {
 		inc.RoadDestination = r.Location.Roads[0].Destination
 	}
 
+	inc.OriginalLat, inc.OriginalLon = inc.Lat, inc.Lon
+	inc.OriginalToLat, inc.OriginalToLon = inc.ToLat, inc.ToLon
+
 	return inc
 }
 
@@ -138,10 +152,57 @@ func RecordToIncidentWithRoute(r *datex.Record, topic string, rawJSON string, lo
 
 	if loc != nil {
 		inc.LocationType = loc.Type
-		if loc.Distance > 0 {
-			inc.LengthMeters = float32(loc.Distance)
+		inc.RouteSource = loc.RouteSource
+		if loc.Snap != nil {
+			inc.OriginalLat, inc.OriginalLon = loc.Snap.Original.Lat, loc.Snap.Original.Lon
+			d := float32(loc.Snap.Distance)
+			inc.SnapDistance = &d
+		}
+		if loc.ToSnap != nil {
+			inc.OriginalToLat, inc.OriginalToLon = loc.ToSnap.Original.Lat, loc.ToSnap.Original.Lon
+			d := float32(loc.ToSnap.Distance)
+			inc.ToSnapDistance = &d
 		}
+		if length, ok := RoutedLength(loc); ok {
+			inc.LengthMeters = length
+		}
+		inc.RouteConfidence = RouteConfidence(loc)
+		inc.RoutePolyline = RoutePolyline(loc)
+		inc.EstimatedLocation = loc.Estimated
 	}
 
 	return inc
 }
+
+// RoutedLength returns the length of a segment's route if it can replace the
+// declared one: the route agreed with it, or there was none to check against.
+func RoutedLength(loc *shared.MapLocation) (float32, bool) {
+	if loc.Distance <= 0 {
+		return 0, false
+	}
+	if loc.RouteConfidence != nil {
+		return float32(loc.Distance), *loc.RouteConfidence >= routing.MinRouteConfidence
+	}
+	return float32(loc.Distance), loc.Expected == nil || loc.Expected.Length == 0
+}
+
+// RouteConfidence returns the confidence of a segment's route, if checked.
+func RouteConfidence(loc *shared.MapLocation) *float32 {
+	if loc.RouteConfidence == nil {
+		return nil
+	}
+	c := float32(*loc.RouteConfidence)
+	return &c
+}
+
+// RoutePolyline returns a segment's full-detail path as a precision-6
+// polyline, or "" for points.
+func RoutePolyline(loc *shared.MapLocation) string {
+	if loc.Polylines != nil {
+		return loc.Polylines.Full
+	}
+	if len(loc.Path) > 0 {
+		return routing.EncodePolyline(loc.Path)
+	}
+	return ""
+}
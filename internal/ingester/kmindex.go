@@ -0,0 +1,143 @@
+package ingester
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const (
+	// kmBin is the resolution in km of the index: references closer than
+	// this on the same road are merged.
+	kmBin = 0.1
+
+	// maxKmGap is the longest stretch in km interpolated across. Roads bend
+	// too much over longer ones for a straight line to land near them.
+	maxKmGap = 10
+)
+
+// KmReference is a km marker of a road located by a stored incident.
+type KmReference struct {
+	Road        string
+	Km          float64
+	Coordinates datex.Coordinates
+}
+
+// KmIndex locates km markers along roads. It is built from stored incidents
+// that carry both coordinates and km markers, and learns from new ones as
+// they are ingested, so that records published with only km markers can be
+// placed on the map.
+type KmIndex struct {
+	mu    sync.RWMutex
+	roads map[string][]KmReference // by normalized road number, sorted by km
+}
+
+func NewKmIndex() *KmIndex {
+	return &KmIndex{roads: make(map[string][]KmReference)}
+}
+
+// Reset replaces the index with refs.
+func (idx *KmIndex) Reset(refs []KmReference) {
+	roads := make(map[string][]KmReference)
+	for _, ref := range refs {
+		key := routing.NormalizeRoadNumber(ref.Road)
+		roads[key] = append(roads[key], ref)
+	}
+	for _, road := range roads {
+		sort.Slice(road, func(i, j int) bool { return road[i].Km < road[j].Km })
+	}
+
+	idx.mu.Lock()
+	idx.roads = roads
+	idx.mu.Unlock()
+	KmIndexReferences.Set(float64(len(refs)))
+}
+
+// Observe adds the km markers of a linear record that has coordinates for
+// them. Markers already in the index are kept as they are.
+func (idx *KmIndex) Observe(r *datex.Record) {
+	if r.Location.Linear == nil || len(r.Location.Roads) == 0 || r.Location.Roads[0].Number == "" {
+		return
+	}
+	road := r.Location.Roads[0].Number
+	for _, p := range []datex.LocationPoint{r.Location.Linear.From, r.Location.Linear.To} {
+		if p.Km != nil && *p.Km > 0 && !p.Coordinates.Empty() {
+			idx.add(KmReference{Road: road, Km: *p.Km, Coordinates: p.Coordinates})
+		}
+	}
+}
+
+func (idx *KmIndex) add(ref KmReference) {
+	ref.Km = math.Round(ref.Km/kmBin) * kmBin
+	key := routing.NormalizeRoadNumber(ref.Road)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	refs := idx.roads[key]
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].Km >= ref.Km-kmBin/2 })
+	if i < len(refs) && refs[i].Km <= ref.Km+kmBin/2 {
+		return
+	}
+	idx.roads[key] = slices.Insert(refs, i, ref)
+	KmIndexReferences.Inc()
+}
+
+// Locate returns the coordinates of km on road, interpolated between the
+// nearest known markers on either side. It returns false if the road is
+// unknown or km is not between two markers close enough together.
+func (idx *KmIndex) Locate(road string, km float64) (datex.Coordinates, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	refs := idx.roads[routing.NormalizeRoadNumber(road)]
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].Km >= km })
+	switch {
+	case i < len(refs) && refs[i].Km-km <= kmBin/2:
+		return refs[i].Coordinates, true
+	case i > 0 && km-refs[i-1].Km <= kmBin/2:
+		return refs[i-1].Coordinates, true
+	case i == 0 || i == len(refs):
+		return datex.Coordinates{}, false
+	}
+
+	a, b := refs[i-1], refs[i]
+	if b.Km-a.Km > maxKmGap {
+		return datex.Coordinates{}, false
+	}
+	t := (km - a.Km) / (b.Km - a.Km)
+	return datex.Coordinates{
+		Lat: a.Coordinates.Lat + t*(b.Coordinates.Lat-a.Coordinates.Lat),
+		Lon: a.Coordinates.Lon + t*(b.Coordinates.Lon-a.Coordinates.Lon),
+	}, true
+}
+
+// EstimateCoordinates fills in the missing coordinates of a linear record's
+// endpoints from their km markers, in place. It reports whether any were
+// estimated.
+func EstimateCoordinates(r *datex.Record, idx *KmIndex) bool {
+	if idx == nil || r.Location.Linear == nil || len(r.Location.Roads) == 0 || r.Location.Roads[0].Number == "" {
+		return false
+	}
+	road := r.Location.Roads[0].Number
+
+	estimated := false
+	for _, p := range []*datex.LocationPoint{&r.Location.Linear.From, &r.Location.Linear.To} {
+		if !p.Coordinates.Empty() || p.Km == nil {
+			continue
+		}
+		c, ok := idx.Locate(road, *p.Km)
+		if !ok {
+			KmEstimates.WithLabelValues("unknown").Inc()
+			continue
+		}
+		KmEstimates.WithLabelValues("estimated").Inc()
+		p.Coordinates = c
+		estimated = true
+	}
+	return estimated
+}
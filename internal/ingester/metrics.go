@@ -40,11 +40,58 @@ var (
 	ClickHouseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: metricsPrefix + "_clickhouse_errors_total",
 		Help: "Total number of ClickHouse errors",
-	}, []string{"operation"}) // operation: prepare_batch, append, send, update
+	}, []string{"operation"}) // operation: prepare_batch, append, send, update, query, spool
 
 	ClickHousePendingBatch = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_clickhouse_pending_batch_size",
-		Help: "Current number of incidents pending in batch",
+		Help: "Current number of writes pending in batch",
+	})
+
+	ClickHouseRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_clickhouse_retries_total",
+		Help: "Total number of retried batch inserts",
+	})
+
+	// Spool metrics
+	ClickHouseSpoolBatches = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_clickhouse_spool_batches",
+		Help: "Current number of batches waiting in the spool for ClickHouse",
+	})
+
+	ClickHouseSpoolAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_clickhouse_spool_age_seconds",
+		Help: "Age of the oldest batch waiting in the spool",
+	})
+
+	ClickHouseSpooledBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_clickhouse_spooled_batches_total",
+		Help: "Total number of batches spooled because ClickHouse was unavailable",
+	})
+
+	ClickHouseReplayedBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_clickhouse_replayed_batches_total",
+		Help: "Total number of spooled batches replayed into ClickHouse",
+	})
+
+	ClickHouseSpoolCorrupt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_clickhouse_spool_corrupt_total",
+		Help: "Total number of spooled batches set aside because they could not be read",
+	})
+
+	// Dead letter metrics
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_dead_letters_total",
+		Help: "Total number of rejected messages kept as dead letters",
+	}, []string{"store"}) // store: clickhouse, local
+
+	DeadLettersLocal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_dead_letters_local",
+		Help: "Current number of dead letters waiting on disk for ClickHouse",
+	})
+
+	DeadLettersRedriven = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_dead_letters_redriven_total",
+		Help: "Total number of dead letters re-driven through ingestion",
 	})
 
 	// Deletion metrics
@@ -53,6 +100,34 @@ var (
 		Help: "Total number of deletion events processed",
 	})
 
+	// Dedupe metrics
+	DedupeChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_dedupe_checks_total",
+		Help: "Total number of situations checked against the last version ingested",
+	}, []string{"result"}) // result: hit (unchanged, skipped), miss, error
+
+	// Reroute metrics
+	FallbackReroutes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_fallback_reroutes_total",
+		Help: "Total number of attempts to re-route fallback segments",
+	}, []string{"result"}) // result: success, failed, gone
+
+	FallbackSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_fallback_segments",
+		Help: "Current number of cached segments drawn as straight lines",
+	})
+
+	// Km index metrics
+	KmEstimates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_km_estimates_total",
+		Help: "Total number of segment endpoints located from their km marker",
+	}, []string{"result"}) // result: estimated, unknown
+
+	KmIndexReferences = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_km_index_references",
+		Help: "Current number of located km markers in the index",
+	})
+
 	// Worker pool metrics
 	WorkerPoolDropped = promauto.NewCounter(prometheus.CounterOpts{
 		Name: metricsPrefix + "_worker_pool_dropped_total",
@@ -63,4 +138,19 @@ var (
 		Name: metricsPrefix + "_worker_pool_queue_size",
 		Help: "Current number of messages in the worker pool queue",
 	})
+
+	WorkerPoolBlocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_worker_pool_blocked_total",
+		Help: "Total number of messages that had to wait for room in the worker pool queue",
+	})
+
+	WorkerPoolSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_worker_pool_spilled_total",
+		Help: "Total number of messages spilled to disk because the worker pool queue was full",
+	})
+
+	WorkerPoolSpillSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_worker_pool_spill_size",
+		Help: "Current number of spilled messages waiting on disk",
+	})
 )
@@ -0,0 +1,628 @@
+package ingester
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// OverflowStrategy is what the queue does with a message when it is full.
+type OverflowStrategy string
+
+const (
+	// OverflowBlock waits for room, holding up the MQTT client so the broker
+	// stops delivering until the workers catch up.
+	OverflowBlock OverflowStrategy = "block"
+	// OverflowSpill writes messages to a queue on disk and processes them
+	// in order once the workers catch up.
+	OverflowSpill OverflowStrategy = "spill"
+	// OverflowDropOldest drops the oldest queued situation to make room.
+	// Deletions are never dropped; when only deletions are queued it blocks.
+	OverflowDropOldest OverflowStrategy = "drop_oldest"
+)
+
+// ParseOverflowStrategy reads an overflow strategy from config.
+func ParseOverflowStrategy(s string) (OverflowStrategy, error) {
+	switch o := OverflowStrategy(strings.ToLower(s)); o {
+	case OverflowBlock, OverflowSpill, OverflowDropOldest:
+		return o, nil
+	default:
+		return "", fmt.Errorf("invalid overflow strategy %q, expected block, spill or drop_oldest", s)
+	}
+}
+
+// UnmarshalText lets OverflowStrategy be read from config.
+func (o *OverflowStrategy) UnmarshalText(text []byte) error {
+	parsed, err := ParseOverflowStrategy(string(text))
+	if err != nil {
+		return err
+	}
+	*o = parsed
+	return nil
+}
+
+// Message is an MQTT message waiting to be processed.
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+func (m Message) deletion() bool {
+	return datex.IsDeletionTopic(m.Topic)
+}
+
+// incidentID reads the ID situations and deletions both carry, or "" if the
+// payload is not valid.
+func (m Message) incidentID() string {
+	var v struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(m.Payload, &v) //nolint:errcheck
+	return v.ID
+}
+
+// Queue hands MQTT messages from the subscribe callback to the workers. It
+// holds up to size messages in memory and applies its overflow strategy
+// beyond that.
+type Queue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	buf      []Message
+	size     int
+	strategy OverflowStrategy
+	disk     *diskQueue
+	closed   bool
+}
+
+// NewQueue creates a queue of size messages. spillDir is only used with
+// OverflowSpill; messages spilled by a previous run are processed first.
+func NewQueue(size int, strategy OverflowStrategy, spillDir string) (*Queue, error) {
+	q := &Queue{
+		buf:      make([]Message, 0, size),
+		size:     size,
+		strategy: strategy,
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+
+	if strategy == OverflowSpill {
+		disk, err := openDiskQueue(spillDir)
+		if err != nil {
+			return nil, err
+		}
+		q.disk = disk
+	}
+	return q, nil
+}
+
+// Spilled returns the number of messages waiting on disk.
+func (q *Queue) Spilled() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.disk == nil {
+		return 0
+	}
+	return q.disk.pending
+}
+
+// Push queues m, applying the overflow strategy if the queue is full.
+func (q *Queue) Push(m Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	blocked := false
+	for !q.closed {
+		// Once spilling, keep spilling until the disk queue drains, so
+		// messages are processed in the order they arrived.
+		if len(q.buf) < q.size && (q.disk == nil || q.disk.pending == 0) {
+			q.buf = append(q.buf, m)
+			WorkerPoolQueueSize.Inc()
+			q.notEmpty.Signal()
+			return
+		}
+
+		switch q.strategy {
+		case OverflowSpill:
+			if err := q.disk.push(m); err == nil {
+				WorkerPoolSpilled.Inc()
+				q.notEmpty.Signal()
+				return
+			} else if !blocked {
+				slog.Error("failed to spill message to disk, blocking",
+					slog.String("topic", m.Topic),
+					slog.String("error", err.Error()),
+				)
+			}
+		case OverflowDropOldest:
+			if i := slices.IndexFunc(q.buf, func(m Message) bool { return !m.deletion() }); i >= 0 {
+				dropped := q.buf[i]
+				q.buf = slices.Delete(q.buf, i, i+1)
+				WorkerPoolQueueSize.Dec()
+				WorkerPoolDropped.Inc()
+				slog.Warn("worker pool full, dropping oldest message",
+					slog.String("topic", dropped.Topic),
+				)
+				continue
+			}
+		}
+
+		if !blocked {
+			blocked = true
+			WorkerPoolBlocked.Inc()
+		}
+		q.notFull.Wait()
+	}
+}
+
+// Pop returns the next message, waiting for one if the queue is empty. It
+// returns false once the queue is closed and its memory drained; spilled
+// messages are kept on disk for the next run.
+func (q *Queue) Pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if len(q.buf) > 0 {
+			m := q.buf[0]
+			q.buf = q.buf[1:]
+			WorkerPoolQueueSize.Dec()
+			q.notFull.Signal()
+			return m, true
+		}
+		if q.closed {
+			return Message{}, false
+		}
+		if q.disk != nil && q.disk.pending > 0 {
+			m, err := q.disk.pop()
+			if q.disk.pending == 0 {
+				q.notFull.Broadcast() // Push can use memory again
+			}
+			if err != nil {
+				slog.Error("failed to read spilled message", slog.String("error", err.Error()))
+				continue
+			}
+			return m, true
+		}
+		q.notEmpty.Wait()
+	}
+}
+
+// Close stops the queue. Blocked pushes return, dropping their message, and
+// Pop returns the messages still in memory before reporting it is closed.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	if q.disk != nil {
+		return q.disk.close()
+	}
+	return nil
+}
+
+// ShardedQueue spreads messages over one Queue per worker by a hash of their
+// incident ID, so all messages about an incident are handled by the same
+// worker in the order they arrived: a deletion never races the situation it
+// deletes.
+type ShardedQueue struct {
+	shards []*Queue
+}
+
+// shardsFile records, in the spill directory, the number of shards its
+// messages were spilled by.
+const shardsFile = "shards"
+
+// rehashPrefix names the directories shard directories are moved to when the
+// number of shards changes, until their messages are redistributed.
+const rehashPrefix = "rehash-"
+
+// NewShardedQueue creates n shards sharing size messages of memory. Each
+// shard spills to its own directory under spillDir. Messages spilled by a
+// previous run with a different number of shards are redistributed first.
+func NewShardedQueue(n, size int, strategy OverflowStrategy, spillDir string) (*ShardedQueue, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of shards %d, must be positive", n)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid queue size %d, must be positive", size)
+	}
+
+	if strategy == OverflowSpill {
+		if err := stageSpilled(spillDir, n); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &ShardedQueue{shards: make([]*Queue, n)}
+	perShard := max(1, (size+n-1)/n)
+	for i := range s.shards {
+		q, err := NewQueue(perShard, strategy, filepath.Join(spillDir, strconv.Itoa(i)))
+		if err != nil {
+			s.Close() //nolint:errcheck
+			return nil, err
+		}
+		s.shards[i] = q
+	}
+
+	if strategy == OverflowSpill {
+		if err := s.adoptSpilled(spillDir); err != nil {
+			s.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// stageSpilled moves the shard directories of a previous run that sharded by
+// a different number than n aside, for adoptSpilled to redistribute, and
+// records n. With a different number, an incident hashes to another shard.
+func stageSpilled(spillDir string, n int) error {
+	if err := os.MkdirAll(spillDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	path := filepath.Join(spillDir, shardsFile)
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read queue shards: %w", err)
+	}
+	if prev, err := strconv.Atoi(strings.TrimSpace(string(raw))); err == nil && prev == n {
+		return nil
+	}
+
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	staging := filepath.Join(spillDir, fmt.Sprintf("%s%019d", rehashPrefix, time.Now().UnixNano()))
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil || !e.IsDir() {
+			continue
+		}
+		if err := os.MkdirAll(staging, 0o755); err != nil {
+			return fmt.Errorf("failed to create queue directory: %w", err)
+		}
+		if err := os.Rename(filepath.Join(spillDir, e.Name()), filepath.Join(staging, e.Name())); err != nil {
+			return fmt.Errorf("failed to stage spilled messages: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(n)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write queue shards: %w", err)
+	}
+	return nil
+}
+
+// adoptSpilled moves the messages of the shard directories staged by
+// stageSpilled into the current shards.
+func (s *ShardedQueue) adoptSpilled(spillDir string) error {
+	var dirs, staged []string
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	// Staged directories are named after when they were staged, so older
+	// messages are adopted first.
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), rehashPrefix) {
+			continue
+		}
+		dir := filepath.Join(spillDir, e.Name())
+		shards, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read queue directory: %w", err)
+		}
+		for _, shard := range shards {
+			if shard.IsDir() {
+				dirs = append(dirs, filepath.Join(dir, shard.Name()))
+			}
+		}
+		staged = append(staged, dir)
+	}
+
+	for _, dir := range dirs {
+		disk, err := openDiskQueue(dir)
+		if err != nil {
+			return err
+		}
+		for disk.pending > 0 {
+			m, err := disk.pop()
+			if err != nil {
+				slog.Error("failed to read spilled message", slog.String("error", err.Error()))
+				continue
+			}
+			s.Push(m)
+		}
+		disk.close() //nolint:errcheck
+	}
+	for _, dir := range staged {
+		os.RemoveAll(dir) //nolint:errcheck
+	}
+	return nil
+}
+
+// Shard returns the queue of worker i.
+func (s *ShardedQueue) Shard(i int) *Queue {
+	return s.shards[i]
+}
+
+// Push queues m on the shard of its incident.
+func (s *ShardedQueue) Push(m Message) {
+	s.shards[shardOf(m.incidentID(), len(s.shards))].Push(m)
+}
+
+// shardOf returns which of n shards the messages of incident id go to.
+func shardOf(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id)) //nolint:errcheck
+	return int(h.Sum32() % uint32(n))
+}
+
+// Spilled returns the number of messages waiting on disk.
+func (s *ShardedQueue) Spilled() int {
+	var n int
+	for _, q := range s.shards {
+		if q != nil {
+			n += q.Spilled()
+		}
+	}
+	return n
+}
+
+// Close closes every shard.
+func (s *ShardedQueue) Close() error {
+	var errs []error
+	for _, q := range s.shards {
+		if q != nil {
+			errs = append(errs, q.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// spillSegmentSize is the number of messages per file of the disk queue.
+const spillSegmentSize = 1000
+
+type spillSegment struct {
+	name  string
+	count int // messages written
+}
+
+// diskQueue is a FIFO of messages in segment files of JSON lines, named after
+// the time they were started so they sort in order. Fully read segments are
+// removed. Read positions are not persisted: after a crash, the messages of
+// the oldest segment are processed again, which ingestion tolerates.
+type diskQueue struct {
+	dir      string
+	segments []*spillSegment // oldest first; the last one is written to
+	pending  int
+
+	w    *os.File
+	wbuf *bufio.Writer
+
+	r    *os.File
+	rbuf *bufio.Reader
+	read int // messages read from segments[0]
+}
+
+func openDiskQueue(dir string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	q := &diskQueue{dir: dir}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), spoolExt) {
+			continue
+		}
+		count, err := countLines(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queue segment: %w", err)
+		}
+		q.segments = append(q.segments, &spillSegment{name: e.Name(), count: count})
+		q.pending += count
+	}
+	slices.SortFunc(q.segments, func(a, b *spillSegment) int { return strings.Compare(a.name, b.name) })
+
+	if q.pending > 0 {
+		WorkerPoolSpillSize.Add(float64(q.pending))
+		slog.Info("resuming spilled messages",
+			slog.String("dir", dir),
+			slog.Int("count", q.pending),
+		)
+	}
+	return q, nil
+}
+
+func (q *diskQueue) push(m Message) error {
+	if q.w == nil || q.segments[len(q.segments)-1].count >= spillSegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	q.wbuf.Write(line)     //nolint:errcheck
+	q.wbuf.WriteByte('\n') //nolint:errcheck
+	// Flushed per message so the reader, on the same file, sees it.
+	if err := q.wbuf.Flush(); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	q.segments[len(q.segments)-1].count++
+	q.pending++
+	WorkerPoolSpillSize.Inc()
+	return nil
+}
+
+// rotate starts a new segment, closing the one being written.
+func (q *diskQueue) rotate() error {
+	if err := q.closeWriter(); err != nil {
+		return err
+	}
+
+	seq := time.Now().UnixNano()
+	if n := len(q.segments); n > 0 {
+		last, _ := strconv.ParseInt(strings.TrimSuffix(q.segments[n-1].name, spoolExt), 10, 64)
+		seq = max(seq, last+1)
+	}
+	name := fmt.Sprintf("%019d%s", seq, spoolExt)
+	f, err := os.OpenFile(filepath.Join(q.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %w", err)
+	}
+	q.w, q.wbuf = f, bufio.NewWriter(f)
+	q.segments = append(q.segments, &spillSegment{name: name})
+	return nil
+}
+
+func (q *diskQueue) pop() (Message, error) {
+	// With messages pending, an exhausted segment is never the last one,
+	// which is being written.
+	for q.read >= q.segments[0].count {
+		q.closeReader()
+		os.Remove(filepath.Join(q.dir, q.segments[0].name)) //nolint:errcheck
+		q.segments = q.segments[1:]
+	}
+
+	if q.r == nil {
+		f, err := os.Open(filepath.Join(q.dir, q.segments[0].name))
+		if err != nil {
+			name := q.segments[0].name
+			lost := q.setAside()
+			return Message{}, fmt.Errorf("failed to open queue segment %s, set aside with %d messages: %w", name, lost, err)
+		}
+		q.r, q.rbuf = f, bufio.NewReader(f)
+	}
+
+	line, err := q.rbuf.ReadBytes('\n')
+	q.read++
+	q.pending--
+	WorkerPoolSpillSize.Dec()
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to read queue segment: %w", err)
+	}
+	var m Message
+	if err := json.Unmarshal(line, &m); err != nil {
+		return Message{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+
+	if q.pending == 0 {
+		// Drained: start afresh on the next spill.
+		q.closeReader()
+		q.closeWriter() //nolint:errcheck
+		for _, s := range q.segments {
+			os.Remove(filepath.Join(q.dir, s.name)) //nolint:errcheck
+		}
+		q.segments = nil
+	}
+	return m, nil
+}
+
+// setAside renames the oldest segment, which cannot be read, out of the queue
+// and drops its unread messages, so they are not retried forever. It returns
+// the number of messages dropped.
+func (q *diskQueue) setAside() int {
+	s := q.segments[0]
+	lost := s.count - q.read
+	q.closeReader()
+	if len(q.segments) == 1 {
+		q.closeWriter() //nolint:errcheck
+	}
+	path := filepath.Join(q.dir, s.name)
+	os.Rename(path, path+".corrupt") //nolint:errcheck
+	q.segments = q.segments[1:]
+
+	q.pending -= lost
+	WorkerPoolSpillSize.Sub(float64(lost))
+	WorkerPoolDropped.Add(float64(lost))
+	if q.pending == 0 {
+		q.closeWriter() //nolint:errcheck
+		for _, s := range q.segments {
+			os.Remove(filepath.Join(q.dir, s.name)) //nolint:errcheck
+		}
+		q.segments = nil
+	}
+	return lost
+}
+
+func (q *diskQueue) closeReader() {
+	if q.r != nil {
+		q.r.Close() //nolint:errcheck
+		q.r, q.rbuf = nil, nil
+	}
+	q.read = 0
+}
+
+func (q *diskQueue) closeWriter() error {
+	if q.w == nil {
+		return nil
+	}
+	err := q.wbuf.Flush()
+	if serr := q.w.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := q.w.Close(); err == nil {
+		err = cerr
+	}
+	q.w, q.wbuf = nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to close queue segment: %w", err)
+	}
+	return nil
+}
+
+func (q *diskQueue) close() error {
+	q.closeReader()
+	return q.closeWriter()
+}
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var (
+		count int
+		buf   = make([]byte, 32*1024)
+	)
+	for {
+		n, err := f.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				count++
+			}
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	situationTopic = "beacon/v1/es/madrid/situations/accident"
+	deletionTopic  = "beacon/v1/es/madrid/deletions/accident"
+)
+
+func testMessage(topic, id string, seq int) Message {
+	return Message{Topic: topic, Payload: []byte(fmt.Sprintf(`{"id":%q,"seq":%d}`, id, seq))}
+}
+
+func messageSeq(t *testing.T, m Message) int {
+	t.Helper()
+	var v struct{ Seq int }
+	if err := json.Unmarshal(m.Payload, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v.Seq
+}
+
+// drain pops every message q holds without waiting for more.
+func drain(q *Queue) []Message {
+	var msgs []Message
+	for {
+		q.mu.Lock()
+		empty := len(q.buf) == 0 && (q.disk == nil || q.disk.pending == 0)
+		q.mu.Unlock()
+		if empty {
+			return msgs
+		}
+		m, _ := q.Pop()
+		msgs = append(msgs, m)
+	}
+}
+
+func TestDropOldestNeverDropsDeletions(t *testing.T) {
+	q, err := NewQueue(2, OverflowDropOldest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close() //nolint:errcheck
+
+	// A situation is dropped to make room for a deletion.
+	q.Push(testMessage(situationTopic, "a", 0))
+	q.Push(testMessage(deletionTopic, "b", 1))
+	q.Push(testMessage(deletionTopic, "c", 2))
+
+	// With only deletions queued, the push waits for room.
+	pushed := make(chan struct{})
+	go func() {
+		q.Push(testMessage(deletionTopic, "d", 3))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push dropped a deletion instead of waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m, _ := q.Pop()
+	<-pushed
+	got := append([]Message{m}, drain(q)...)
+
+	var seqs []int
+	for _, m := range got {
+		if !m.deletion() {
+			t.Errorf("got situation %s, want it dropped", m.Payload)
+		}
+		seqs = append(seqs, messageSeq(t, m))
+	}
+	if fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Errorf("got deletions %v, want [1 2 3]", seqs)
+	}
+}
+
+func TestSpillDrainsInOrderAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(1, OverflowSpill, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close() //nolint:errcheck
+
+	next := 0
+	push := func(n int) {
+		for range n {
+			q.Push(testMessage(situationTopic, "a", next))
+			next++
+		}
+	}
+
+	push(2*spillSegmentSize + 500)
+	if segments := countSegments(t, dir); segments != 3 {
+		t.Fatalf("got %d segments, want 3", segments)
+	}
+
+	// Pop into the second segment, then spill more behind it.
+	want := 0
+	for range spillSegmentSize + 200 {
+		m, _ := q.Pop()
+		if seq := messageSeq(t, m); seq != want {
+			t.Fatalf("got message %d, want %d", seq, want)
+		}
+		want++
+	}
+	push(spillSegmentSize)
+
+	for _, m := range drain(q) {
+		if seq := messageSeq(t, m); seq != want {
+			t.Fatalf("got message %d, want %d", seq, want)
+		}
+		want++
+	}
+	if want != next {
+		t.Fatalf("drained %d messages, want %d", want, next)
+	}
+	if segments := countSegments(t, dir); segments != 0 {
+		t.Errorf("got %d segments left after draining, want 0", segments)
+	}
+}
+
+func TestShardedQueueKeepsIncidentOrderAcrossSegments(t *testing.T) {
+	s, err := NewShardedQueue(2, 2, OverflowSpill, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() //nolint:errcheck
+
+	const incidents = 10
+	total := 3 * spillSegmentSize
+	for i := range total {
+		s.Push(testMessage(situationTopic, fmt.Sprintf("i%d", i%incidents), i))
+	}
+
+	got := 0
+	last := make(map[string]int)
+	for i := range s.shards {
+		for _, m := range drain(s.Shard(i)) {
+			id, seq := m.incidentID(), messageSeq(t, m)
+			if prev, ok := last[id]; ok && seq <= prev {
+				t.Fatalf("incident %s: got message %d after %d", id, seq, prev)
+			}
+			last[id] = seq
+			got++
+		}
+	}
+	if got != total {
+		t.Fatalf("got %d messages, want %d", got, total)
+	}
+}
+
+func TestShardedQueueRedistributesOnShardCountChange(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewShardedQueue(2, 2, OverflowSpill, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 500 {
+		s.Push(testMessage(situationTopic, fmt.Sprintf("i%d", i%20), i))
+	}
+	// Only what was spilled survives a restart.
+	spilled := s.Spilled()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewShardedQueue(3, 3, OverflowSpill, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() //nolint:errcheck
+
+	got := 0
+	last := make(map[string]int)
+	for i := range s.shards {
+		for _, m := range drain(s.Shard(i)) {
+			id, seq := m.incidentID(), messageSeq(t, m)
+			if shard := shardOf(id, len(s.shards)); shard != i {
+				t.Fatalf("incident %s: got it in shard %d, want %d", id, i, shard)
+			}
+			if prev, ok := last[id]; ok && seq <= prev {
+				t.Fatalf("incident %s: got message %d after %d", id, seq, prev)
+			}
+			last[id] = seq
+			got++
+		}
+	}
+	if got != spilled {
+		t.Fatalf("got %d messages, want the %d spilled", got, spilled)
+	}
+
+	shards, err := os.ReadFile(filepath.Join(dir, shardsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(shards)) != "3" {
+		t.Errorf("got shard count %q recorded, want 3", shards)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), rehashPrefix) {
+			t.Errorf("staged directory %s left behind", e.Name())
+		}
+	}
+}
+
+func countSegments(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), spoolExt) {
+			n++
+		}
+	}
+	return n
+}
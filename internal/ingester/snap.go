@@ -0,0 +1,53 @@
+package ingester
+
+import (
+	"github.com/sverdejot/beacon/internal/routing"
+	"github.com/sverdejot/beacon/internal/shared"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// SnapRecord moves the record's coordinates onto the road it is reported on,
+// in place, and returns how the point or the segment's start (from) and end
+// (to) were moved. Coordinates that could not be snapped are left as
+// published and their Snap is nil.
+func SnapRecord(r *datex.Record, s *routing.Snapper) (from, to *shared.Snap) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var road datex.RoadInfo
+	if len(r.Location.Roads) > 0 {
+		road = r.Location.Roads[0]
+	}
+
+	switch {
+	case r.Location.Linear != nil:
+		fromC := &r.Location.Linear.From.Coordinates
+		toC := &r.Location.Linear.To.Coordinates
+		if fromC.Empty() || toC.Empty() {
+			return nil, nil
+		}
+		fromWp, fromOk, toWp, toOk := s.SnapSegment(*fromC, *toC, road)
+		if fromOk {
+			from = apply(fromC, fromWp)
+		}
+		if toOk {
+			to = apply(toC, toWp)
+		}
+	case r.Location.Point != nil:
+		c := &r.Location.Point.Coordinates
+		if c.Empty() {
+			return nil, nil
+		}
+		if wp, ok := s.SnapPoint(*c, road); ok {
+			from = apply(c, wp)
+		}
+	}
+	return from, to
+}
+
+func apply(c *datex.Coordinates, wp routing.Waypoint) *shared.Snap {
+	snap := &shared.Snap{Original: *c, Distance: wp.Distance}
+	*c = wp.Location
+	return snap
+}
@@ -0,0 +1,207 @@
+package ingester
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const spoolExt = ".jsonl"
+
+// Spool is an on-disk queue of batches of writes that could not be applied
+// to ClickHouse. Each batch is a file of JSON lines named after the time it
+// was spooled, so names sort in the order batches must be replayed. Files
+// are written to a temporary name and renamed once synced, so a crash never
+// leaves a partial batch behind.
+//
+// Spool is not safe for concurrent use; ClickHouseClient serializes writes.
+type Spool struct {
+	dir     string
+	batches []string // file names, oldest first
+	last    int64
+}
+
+// OpenSpool opens the spool in dir, creating it if needed, and picks up any
+// batches left by a previous run.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			os.Remove(filepath.Join(dir, name)) //nolint:errcheck
+		case strings.HasSuffix(name, spoolExt):
+			seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolExt), 10, 64)
+			if err != nil {
+				continue
+			}
+			s.batches = append(s.batches, name)
+			s.last = max(s.last, seq)
+		}
+	}
+	slices.Sort(s.batches)
+	s.updateMetrics()
+	return s, nil
+}
+
+// Len returns the number of spooled batches.
+func (s *Spool) Len() int {
+	return len(s.batches)
+}
+
+// Push appends batch to the spool.
+func (s *Spool) Push(batch []Write) error {
+	seq := max(time.Now().UnixNano(), s.last+1)
+	name := fmt.Sprintf("%019d%s", seq, spoolExt)
+	if err := s.writeFile(name, batch); err != nil {
+		return err
+	}
+
+	s.batches = append(s.batches, name)
+	s.last = seq
+	s.updateMetrics()
+	return nil
+}
+
+// Replace swaps the oldest batch for what is left of it after part of it
+// was replayed, keeping its place in the queue.
+func (s *Spool) Replace(name string, batch []Write) error {
+	if len(s.batches) == 0 || s.batches[0] != name {
+		return fmt.Errorf("spooled batch %s is not the oldest", name)
+	}
+	return s.writeFile(name, batch)
+}
+
+// writeFile atomically writes batch to the file name.
+func (s *Spool) writeFile(name string, batch []Write) error {
+	path := filepath.Join(s.dir, name)
+
+	f, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range batch {
+		if err := enc.Encode(&batch[i]); err != nil {
+			f.Close() //nolint:errcheck
+			return fmt.Errorf("failed to encode spooled write: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close() //nolint:errcheck
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() //nolint:errcheck
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close spool file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to commit spool file: %w", err)
+	}
+	syncDir(s.dir)
+	return nil
+}
+
+// Peek returns the oldest batch and its name. A batch that cannot be read is
+// renamed out of the queue so it does not hold up the ones behind it.
+func (s *Spool) Peek() (string, []Write, bool) {
+	for len(s.batches) > 0 {
+		name := s.batches[0]
+		batch, err := s.read(name)
+		if err == nil {
+			return name, batch, true
+		}
+
+		slog.Error("failed to read spooled batch, setting it aside",
+			slog.String("file", name),
+			slog.String("error", err.Error()),
+		)
+		ClickHouseSpoolCorrupt.Inc()
+		path := filepath.Join(s.dir, name)
+		os.Rename(path, path+".corrupt") //nolint:errcheck
+		s.batches = s.batches[1:]
+		s.updateMetrics()
+	}
+	return "", nil, false
+}
+
+// Remove drops the oldest batch, once replayed.
+func (s *Spool) Remove(name string) error {
+	if len(s.batches) == 0 || s.batches[0] != name {
+		return fmt.Errorf("spooled batch %s is not the oldest", name)
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove spooled batch: %w", err)
+	}
+	s.batches = s.batches[1:]
+	s.updateMetrics()
+	return nil
+}
+
+func (s *Spool) read(name string) ([]Write, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var batch []Write
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var w Write
+		if err := dec.Decode(&w); err != nil {
+			return nil, err
+		}
+		if w.Insert == nil && w.End == nil && w.Route == nil {
+			return nil, fmt.Errorf("spooled write %d is empty", len(batch))
+		}
+		batch = append(batch, w)
+	}
+	return batch, nil
+}
+
+// updateMetrics reports the spool's depth and the age of its oldest batch.
+// It is also called on every flush so the age keeps growing while ClickHouse
+// is down.
+func (s *Spool) updateMetrics() {
+	ClickHouseSpoolBatches.Set(float64(len(s.batches)))
+	if len(s.batches) == 0 {
+		ClickHouseSpoolAge.Set(0)
+		return
+	}
+	seq, _ := strconv.ParseInt(strings.TrimSuffix(s.batches[0], spoolExt), 10, 64)
+	ClickHouseSpoolAge.Set(time.Since(time.Unix(0, seq)).Seconds())
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()  //nolint:errcheck
+	d.Close() //nolint:errcheck
+}
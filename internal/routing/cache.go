@@ -0,0 +1,200 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const (
+	// routeKeyPrecision is how many decimals endpoints are rounded to when
+	// building cache keys; 1e-5 degrees is about a meter.
+	routeKeyPrecision = 5
+
+	routeStoreTimeout      = 500 * time.Millisecond
+	routeInvalidateTimeout = time.Minute
+)
+
+// RouteStore persists computed routes per backend, grouped by the version of
+// the dataset that produced them.
+type RouteStore interface {
+	GetRoute(ctx context.Context, backend, version, key string) (RouteResult, bool, error)
+	StoreRoute(ctx context.Context, backend, version, key string, route RouteResult, ttl time.Duration) error
+	// RouteDatasetVersion returns the dataset version backend's routes are
+	// stored under.
+	RouteDatasetVersion(ctx context.Context, backend string) (string, error)
+	// SetRouteDatasetVersion makes version current for backend and drops the
+	// routes stored under the previous one. It reports whether the version
+	// changed.
+	SetRouteDatasetVersion(ctx context.Context, backend, version string) (bool, error)
+}
+
+// CachedRouteService serves routes from a RouteStore and only asks its
+// backend on a miss, so new versions of an incident whose endpoints have not
+// moved, and replays, don't reach the routing server.
+type CachedRouteService struct {
+	routes *RouteService
+	store  RouteStore
+	ttl    time.Duration
+
+	mu      sync.RWMutex
+	version string
+	probe   *datex.Coordinates // last routed origin, used to check the dataset version
+}
+
+// NewCachedRouteService wraps routes with store, keeping routes for ttl.
+func NewCachedRouteService(ctx context.Context, routes *RouteService, store RouteStore, ttl time.Duration) (*CachedRouteService, error) {
+	version, err := store.RouteDatasetVersion(ctx, routes.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &CachedRouteService{
+		routes:  routes,
+		store:   store,
+		ttl:     ttl,
+		version: version,
+	}, nil
+}
+
+func (c *CachedRouteService) Name() string {
+	return c.routes.Name()
+}
+
+// Route returns the cached route between from and to, routing and caching it
+// on a miss.
+func (c *CachedRouteService) Route(ctx context.Context, from, to datex.Coordinates) (RouteResult, error) {
+	name := c.routes.Name()
+	key := routeKey(from, to)
+	version := c.currentVersion()
+
+	storeCtx, cancel := context.WithTimeout(ctx, routeStoreTimeout)
+	cached, ok, err := c.store.GetRoute(storeCtx, name, version, key)
+	cancel()
+	switch {
+	case err != nil:
+		slog.Warn("failed to read route cache", slog.String("backend", name), slog.String("error", err.Error()))
+		RouteCacheRequests.WithLabelValues(name, "error").Inc()
+	case ok:
+		RouteCacheRequests.WithLabelValues(name, "hit").Inc()
+		return cached, nil
+	default:
+		RouteCacheRequests.WithLabelValues(name, "miss").Inc()
+	}
+
+	result, dataVersion, err := c.routes.route(ctx, from, to)
+	if err != nil {
+		return RouteResult{}, err
+	}
+
+	c.mu.Lock()
+	c.probe = &from
+	c.mu.Unlock()
+
+	// Only some backends report the version with each route; the others are
+	// left to WatchDatasetVersion.
+	if dataVersion != "" && dataVersion != version {
+		c.setVersion(dataVersion)
+		version = dataVersion
+	}
+
+	storeCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), routeStoreTimeout)
+	defer cancel()
+	if err := c.store.StoreRoute(storeCtx, name, version, key, result, c.ttl); err != nil {
+		slog.Warn("failed to store route in cache", slog.String("backend", name), slog.String("error", err.Error()))
+	}
+	return result, nil
+}
+
+// Available reports whether the backend is currently considered reachable.
+func (c *CachedRouteService) Available() bool {
+	return c.routes.Available()
+}
+
+// WatchDatasetVersion asks the backend for its dataset version every interval
+// and invalidates the cached routes when it changes. Routes served from the
+// cache never reach the backend, so without it a new dataset would go
+// unnoticed.
+func (c *CachedRouteService) WatchDatasetVersion(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.mu.RLock()
+			probe := c.probe
+			c.mu.RUnlock()
+			if probe == nil {
+				continue // nothing routed yet
+			}
+
+			version, err := c.routes.DatasetVersion(*probe)
+			if err != nil {
+				slog.Warn("failed to check routing dataset version",
+					slog.String("backend", c.routes.Name()),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+			if version != c.currentVersion() {
+				c.setVersion(version)
+			}
+		}
+	}
+}
+
+func (c *CachedRouteService) currentVersion() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// setVersion switches to version and drops the old routes in the background.
+func (c *CachedRouteService) setVersion(version string) {
+	c.mu.Lock()
+	if c.version == version {
+		c.mu.Unlock()
+		return
+	}
+	previous := c.version
+	c.version = version
+	c.mu.Unlock()
+
+	name := c.routes.Name()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), routeInvalidateTimeout)
+		defer cancel()
+
+		changed, err := c.store.SetRouteDatasetVersion(ctx, name, version)
+		if err != nil {
+			slog.Error("failed to invalidate route cache", slog.String("backend", name), slog.String("error", err.Error()))
+			return
+		}
+		if changed {
+			RouteCacheInvalidations.WithLabelValues(name).Inc()
+			slog.Info("routing dataset version changed, route cache invalidated",
+				slog.String("backend", name),
+				slog.String("previous", previous),
+				slog.String("version", version),
+			)
+		}
+	}()
+}
+
+// routeKey identifies a route by its endpoints rounded to routeKeyPrecision.
+func routeKey(from, to datex.Coordinates) string {
+	return fmt.Sprintf("%s,%s;%s,%s",
+		roundCoord(from.Lon), roundCoord(from.Lat), roundCoord(to.Lon), roundCoord(to.Lat))
+}
+
+func roundCoord(v float64) string {
+	scale := math.Pow10(routeKeyPrecision)
+	return fmt.Sprintf("%.*f", routeKeyPrecision, math.Round(v*scale)/scale)
+}
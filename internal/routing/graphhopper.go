@@ -0,0 +1,125 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// GraphHopper routes with a GraphHopper server.
+type GraphHopper struct {
+	url     string
+	profile string
+	apiKey  string
+}
+
+// NewGraphHopper returns a GraphHopper backend using the given profile, e.g.
+// "car". apiKey is only needed for the hosted API.
+func NewGraphHopper(url, profile, apiKey string) *GraphHopper {
+	return &GraphHopper{url: url, profile: profile, apiKey: apiKey}
+}
+
+type graphHopperResponse struct {
+	Paths []struct {
+		Distance float64 `json:"distance"` // meters
+		Time     float64 `json:"time"`     // milliseconds
+		Points   string  `json:"points"`   // polyline, precision set by points_encoded_multiplier
+	} `json:"paths"`
+	Message string `json:"message"`
+}
+
+func (g *GraphHopper) Name() string {
+	return RouteSourceGraphHopper
+}
+
+func (g *GraphHopper) Route(ctx context.Context, client *http.Client, from, to datex.Coordinates) (RouteResult, string, error) {
+	q := url.Values{}
+	q.Add("point", fmt.Sprintf("%f,%f", from.Lat, from.Lon))
+	q.Add("point", fmt.Sprintf("%f,%f", to.Lat, to.Lon))
+	q.Set("profile", g.profile)
+	q.Set("instructions", "false")
+	q.Set("points_encoded", "true")
+	q.Set("points_encoded_multiplier", "1e6")
+	if g.apiKey != "" {
+		q.Set("key", g.apiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url+"/route?"+q.Encode(), nil)
+	if err != nil {
+		return RouteResult{}, "", fmt.Errorf("failed to create route request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return RouteResult{}, "", retryable(fmt.Errorf("failed to request route: %w", err))
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var gr graphHopperResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gr); err != nil {
+		if resp.StatusCode == http.StatusOK || retryableStatus(resp.StatusCode) {
+			return RouteResult{}, "", retryable(fmt.Errorf("failed to decode route: %w", err))
+		}
+		return RouteResult{}, "", fmt.Errorf("unexpected graphhopper status %d", resp.StatusCode)
+	}
+
+	switch {
+	case retryableStatus(resp.StatusCode):
+		return RouteResult{}, "", retryable(fmt.Errorf("unexpected graphhopper status %d", resp.StatusCode))
+	case resp.StatusCode == http.StatusBadRequest && strings.Contains(gr.Message, "Connection between locations not found"):
+		return RouteResult{}, "", errNoRoute
+	case resp.StatusCode != http.StatusOK:
+		return RouteResult{}, "", fmt.Errorf("unexpected graphhopper status %d: %s", resp.StatusCode, gr.Message)
+	case len(gr.Paths) == 0:
+		return RouteResult{}, "", errNoRoute
+	}
+
+	path := gr.Paths[0]
+	coords, err := DecodePolyline(path.Points)
+	if err != nil || len(coords) == 0 {
+		return RouteResult{}, "", errors.New("invalid route geometry")
+	}
+
+	return RouteResult{
+		Path:      coords,
+		Polylines: NewPolylines(coords),
+		Distance:  path.Distance,
+		Duration:  path.Time / 1000,
+		Source:    RouteSourceGraphHopper,
+	}, "", nil
+}
+
+// DatasetVersion returns the date of the imported OSM data, from the info
+// endpoint.
+func (g *GraphHopper) DatasetVersion(client *http.Client, _ datex.Coordinates) (string, error) {
+	u := g.url + "/info"
+	if g.apiKey != "" {
+		u += "?key=" + url.QueryEscape(g.apiKey)
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return "", fmt.Errorf("failed to request graphhopper info: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected graphhopper status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		DataDate   string `json:"data_date"`
+		ImportDate string `json:"import_date"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode graphhopper info: %w", err)
+	}
+	if body.ImportDate != "" {
+		return body.ImportDate, nil
+	}
+	return body.DataDate, nil
+}
@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"context"
+	"math"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const (
+	earthRadius = 6371008.8 // meters
+
+	// greatCircleStep is the spacing in meters between interpolated points.
+	greatCircleStep      = 250
+	greatCircleMaxPoints = 64
+
+	// greatCircleSpeed is the speed in m/s used to estimate durations, about
+	// 50 km/h.
+	greatCircleSpeed = 13.9
+)
+
+// GreatCircle "routes" by interpolating along the great circle between the
+// endpoints. It needs no routing server, so the ingester can run without
+// one, but its paths do not follow roads.
+type GreatCircle struct{}
+
+func (GreatCircle) Name() string {
+	return RouteSourceGreatCircle
+}
+
+func (GreatCircle) Route(_ context.Context, from, to datex.Coordinates) (RouteResult, error) {
+	lat1, lon1 := from.Lat*math.Pi/180, from.Lon*math.Pi/180
+	lat2, lon2 := to.Lat*math.Pi/180, to.Lon*math.Pi/180
+
+	// Central angle, by the haversine formula.
+	h := math.Pow(math.Sin((lat2-lat1)/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lon2-lon1)/2), 2)
+	angle := 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+	distance := angle * earthRadius
+
+	segments := int(math.Ceil(distance / greatCircleStep))
+	segments = max(1, min(segments, greatCircleMaxPoints-1))
+
+	path := make([]datex.Coordinates, 0, segments+1)
+	path = append(path, from)
+	if angle > 0 {
+		for i := 1; i < segments; i++ {
+			f := float64(i) / float64(segments)
+			a := math.Sin((1-f)*angle) / math.Sin(angle)
+			b := math.Sin(f*angle) / math.Sin(angle)
+			x := a*math.Cos(lat1)*math.Cos(lon1) + b*math.Cos(lat2)*math.Cos(lon2)
+			y := a*math.Cos(lat1)*math.Sin(lon1) + b*math.Cos(lat2)*math.Sin(lon2)
+			z := a*math.Sin(lat1) + b*math.Sin(lat2)
+			path = append(path, datex.Coordinates{
+				Lat: math.Atan2(z, math.Hypot(x, y)) * 180 / math.Pi,
+				Lon: math.Atan2(y, x) * 180 / math.Pi,
+			})
+		}
+	}
+	path = append(path, to)
+
+	return RouteResult{
+		Path:      path,
+		Polylines: NewPolylines(path),
+		Distance:  distance,
+		Duration:  distance / greatCircleSpeed,
+		Source:    RouteSourceGreatCircle,
+	}, nil
+}
+
+// Available is always false: great-circle paths are not road routes, so a
+// chain that can only fall back to them has no routing backend available.
+func (GreatCircle) Available() bool {
+	return false
+}
@@ -8,20 +8,66 @@ import (
 const metricsPrefix = "ingester"
 
 var (
-	OSRMRequests = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_osrm_requests_total",
-		Help: "Total number of OSRM routing requests",
-	}, []string{"status"}) // status: success, error, fallback
-
-	OSRMRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    metricsPrefix + "_osrm_request_duration_seconds",
-		Help:    "Time spent on OSRM routing requests",
+	RoutingRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_routing_requests_total",
+		Help: "Total number of routing requests per backend",
+	}, []string{"backend", "status"}) // status: success, no_route, error, rejected
+
+	RoutingRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "_routing_request_duration_seconds",
+		Help:    "Time spent on routing requests per backend",
 		Buckets: prometheus.DefBuckets,
-	})
+	}, []string{"backend"})
 
-	OSRMRouteDistance = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    metricsPrefix + "_osrm_route_distance_meters",
+	RoutingRouteDistance = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "_routing_route_distance_meters",
 		Help:    "Distance of computed routes in meters",
 		Buckets: []float64{100, 500, 1000, 5000, 10000, 50000, 100000},
+	}, []string{"backend"})
+
+	RoutingRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_routing_retries_total",
+		Help: "Total number of routing request retries",
+	}, []string{"backend"})
+
+	RoutingInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_routing_requests_in_flight",
+		Help: "Current number of routing requests in flight",
+	}, []string{"backend"})
+
+	RoutingCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_routing_circuit_state",
+		Help: "State of the routing circuit breaker (0 closed, 1 open, 2 half-open)",
+	}, []string{"backend"})
+
+	RoutingFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "_routing_fallbacks_total",
+		Help: "Total number of routes drawn as straight lines because no backend could route them",
 	})
+
+	RouteValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_route_validations_total",
+		Help: "Total number of segment routes checked against their expected length",
+	}, []string{"result"}) // result: accepted, reversed, opposite_carriageway, low_confidence, unchecked
+
+	SnapRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_snap_requests_total",
+		Help: "Total number of coordinates snapped onto the road network",
+	}, []string{"result"}) // result: matched, other_road, too_far, error
+
+	SnapDistance = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    metricsPrefix + "_snap_distance_meters",
+		Help:    "Distance coordinates were moved when snapped onto the road network",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250},
+	})
+
+	RouteCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_route_cache_requests_total",
+		Help: "Total number of route cache lookups",
+	}, []string{"backend", "result"}) // result: hit, miss, error
+
+	RouteCacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_route_cache_invalidations_total",
+		Help: "Total number of route cache invalidations caused by a dataset change",
+	}, []string{"backend"})
 )
@@ -1,108 +1,191 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log/slog"
 	"net/http"
-	"time"
+	"strings"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sverdejot/beacon/pkg/datex"
 )
 
 const (
-	getRouteTemplatePath = "%s/route/v1/driving/%f,%f;%f,%f?overview=full&geometries=geojson"
+	getRouteTemplatePath   = "%s/route/v1/driving/%f,%f;%f,%f?overview=full&geometries=polyline6"
+	getNearestTemplatePath = "%s/nearest/v1/driving/%f,%f?number=%d"
+	getMatchTemplatePath   = "%s/match/v1/driving/%s?overview=false&gaps=ignore&radiuses=%s"
 )
 
-// RouteResult contains the computed route path and distance
-type RouteResult struct {
-	Path     []datex.Coordinates
-	Distance float64 // distance in meters
-	Duration float64 // duration in seconds
+// errNoRoute means the backend answered but found no route between the
+// endpoints.
+var errNoRoute = errors.New("no route found")
+
+// OSRM routes with an osrm-routed server.
+type OSRM struct {
+	url string
 }
 
-type RouteService struct {
-	url    string
-	client *http.Client
+func NewOSRM(url string) *OSRM {
+	return &OSRM{url: url}
 }
 
 type osrmResponse struct {
+	Code   string `json:"code"`
 	Routes []struct {
-		Geometry struct {
-			Coordinates [][]float64 `json:"coordinates"`
-		} `json:"geometry"`
+		Geometry string  `json:"geometry"` // precision-6 polyline
 		Distance float64 `json:"distance"` // distance in meters
 		Duration float64 `json:"duration"` // duration in seconds
 	} `json:"routes"`
+	DataVersion string `json:"data_version"` // set when the dataset was extracted with --data_version
 }
 
-func NewRouteService(url string) *RouteService {
-	return &RouteService{
-		url:    url,
-		client: &http.Client{Timeout: 5 * time.Second},
-	}
+func (o *OSRM) Name() string {
+	return RouteSourceOSRM
 }
 
-// GetRoute returns just the path coordinates (for backward compatibility)
-func (rs *RouteService) GetRoute(from, to datex.Coordinates) []datex.Coordinates {
-	result := rs.GetRouteWithDistance(from, to)
-	return result.Path
-}
+func (o *OSRM) Route(ctx context.Context, client *http.Client, from, to datex.Coordinates) (RouteResult, string, error) {
+	url := fmt.Sprintf(getRouteTemplatePath,
+		o.url, from.Lon, from.Lat, to.Lon, to.Lat)
 
-// GetRouteWithDistance returns the full route result including distance
-func (rs *RouteService) GetRouteWithDistance(from, to datex.Coordinates) RouteResult {
-	timer := prometheus.NewTimer(OSRMRequestDuration)
-	defer timer.ObserveDuration()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return RouteResult{}, "", fmt.Errorf("failed to create route request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return RouteResult{}, "", retryable(fmt.Errorf("failed to request route: %w", err))
+	}
+	defer resp.Body.Close() //nolint:errcheck
 
-	url := fmt.Sprintf(getRouteTemplatePath,
-		rs.url, from.Lon, from.Lat, to.Lon, to.Lat)
+	var osrm osrmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&osrm); err != nil {
+		if resp.StatusCode == http.StatusOK || retryableStatus(resp.StatusCode) {
+			return RouteResult{}, "", retryable(fmt.Errorf("failed to decode route: %w", err))
+		}
+		return RouteResult{}, "", fmt.Errorf("unexpected osrm status %d", resp.StatusCode)
+	}
+
+	switch {
+	case retryableStatus(resp.StatusCode):
+		return RouteResult{}, "", retryable(fmt.Errorf("unexpected osrm status %d", resp.StatusCode))
+	case osrm.Code == "NoRoute" || osrm.Code == "NoSegment" || (resp.StatusCode == http.StatusOK && len(osrm.Routes) == 0):
+		return RouteResult{}, osrm.DataVersion, errNoRoute
+	case resp.StatusCode != http.StatusOK:
+		return RouteResult{}, "", fmt.Errorf("unexpected osrm status %d: %s", resp.StatusCode, osrm.Code)
+	}
 
-	fallback := RouteResult{
-		Path:     []datex.Coordinates{from, to},
-		Distance: 0,
-		Duration: 0,
+	route := osrm.Routes[0]
+	coords, err := DecodePolyline(route.Geometry)
+	if err != nil || len(coords) == 0 {
+		return RouteResult{}, osrm.DataVersion, errors.New("invalid route geometry")
 	}
 
-	resp, err := rs.client.Get(url)
+	return RouteResult{
+		Path:      coords,
+		Polylines: NewPolylines(coords),
+		Distance:  route.Distance,
+		Duration:  route.Duration,
+		Source:    RouteSourceOSRM,
+	}, osrm.DataVersion, nil
+}
+
+// DatasetVersion uses a nearest query at c. It returns an empty string if
+// the dataset was built without a data version.
+func (o *OSRM) DatasetVersion(client *http.Client, c datex.Coordinates) (string, error) {
+	resp, err := client.Get(fmt.Sprintf(getNearestTemplatePath, o.url, c.Lon, c.Lat, 1))
 	if err != nil {
-		slog.Error("osrm route computation failed", slog.String("error", err.Error()))
-		OSRMRequests.WithLabelValues("error").Inc()
-		return fallback
+		return "", fmt.Errorf("failed to request osrm dataset version: %w", err)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 
 	if resp.StatusCode != http.StatusOK {
-		slog.Error("osrm route computation failed", slog.Int("status_code", resp.StatusCode))
-		OSRMRequests.WithLabelValues("error").Inc()
-		return fallback
+		return "", fmt.Errorf("unexpected osrm status %d", resp.StatusCode)
 	}
 
-	var osrm osrmResponse
-	if err := json.NewDecoder(resp.Body).Decode(&osrm); err != nil {
-		slog.Error("osrm route computation failed", slog.String("error", err.Error()))
-		OSRMRequests.WithLabelValues("error").Inc()
-		return fallback
+	var body struct {
+		DataVersion string `json:"data_version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode osrm response: %w", err)
 	}
+	return body.DataVersion, nil
+}
+
+type osrmWaypoint struct {
+	Name     string     `json:"name"`
+	Location [2]float64 `json:"location"` // lon, lat
+	Distance float64    `json:"distance"`
+}
 
-	if len(osrm.Routes) == 0 {
-		slog.Error("osrm route computation failed", slog.String("reason", "no_routes_returned"))
-		OSRMRequests.WithLabelValues("fallback").Inc()
-		return fallback
+func (w osrmWaypoint) waypoint() Waypoint {
+	return Waypoint{
+		Location: datex.Coordinates{Lat: w.Location[1], Lon: w.Location[0]},
+		Name:     w.Name,
+		Distance: w.Distance,
 	}
+}
 
-	route := osrm.Routes[0]
-	coords := make([]datex.Coordinates, len(route.Geometry.Coordinates))
-	for i, c := range route.Geometry.Coordinates {
-		coords[i] = datex.Coordinates{Lat: c[1], Lon: c[0]}
+func (o *OSRM) Nearest(client *http.Client, c datex.Coordinates, n int) ([]Waypoint, error) {
+	var body struct {
+		Code      string         `json:"code"`
+		Waypoints []osrmWaypoint `json:"waypoints"`
+	}
+	if err := o.get(client, fmt.Sprintf(getNearestTemplatePath, o.url, c.Lon, c.Lat, n), &body); err != nil {
+		return nil, err
 	}
 
-	OSRMRequests.WithLabelValues("success").Inc()
-	OSRMRouteDistance.Observe(route.Distance)
+	waypoints := make([]Waypoint, len(body.Waypoints))
+	for i, w := range body.Waypoints {
+		waypoints[i] = w.waypoint()
+	}
+	return waypoints, nil
+}
 
-	return RouteResult{
-		Path:     coords,
-		Distance: route.Distance,
-		Duration: route.Duration,
+func (o *OSRM) Match(client *http.Client, coords []datex.Coordinates, radius float64) ([]*Waypoint, error) {
+	points := make([]string, len(coords))
+	radiuses := make([]string, len(coords))
+	for i, c := range coords {
+		points[i] = fmt.Sprintf("%f,%f", c.Lon, c.Lat)
+		radiuses[i] = fmt.Sprintf("%.0f", radius)
+	}
+
+	var body struct {
+		Code        string          `json:"code"`
+		Tracepoints []*osrmWaypoint `json:"tracepoints"`
+	}
+	url := fmt.Sprintf(getMatchTemplatePath, o.url, strings.Join(points, ";"), strings.Join(radiuses, ";"))
+	if err := o.get(client, url, &body); err != nil {
+		return nil, err
+	}
+
+	waypoints := make([]*Waypoint, len(body.Tracepoints))
+	for i, w := range body.Tracepoints {
+		if w != nil {
+			wp := w.waypoint()
+			waypoints[i] = &wp
+		}
+	}
+	return waypoints, nil
+}
+
+// get decodes an OSRM response into v. Requests OSRM rejects, such as a
+// match with no matching, are reported as errNoRoute.
+func (o *OSRM) get(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return retryable(fmt.Errorf("failed to request osrm: %w", err))
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch {
+	case retryableStatus(resp.StatusCode):
+		return retryable(fmt.Errorf("unexpected osrm status %d", resp.StatusCode))
+	case resp.StatusCode != http.StatusOK:
+		return errNoRoute
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return retryable(fmt.Errorf("failed to decode osrm response: %w", err))
 	}
+	return nil
 }
@@ -0,0 +1,160 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// polylineFactor is 10^6: paths are encoded with the precision-6 variant of
+// Google's polyline algorithm, the same one OSRM returns for polyline6.
+const polylineFactor = 1e6
+
+// Detail selects how much a routed path is simplified before it is sent to
+// clients.
+type Detail string
+
+const (
+	DetailFull   Detail = "full"
+	DetailHigh   Detail = "high"
+	DetailMedium Detail = "medium"
+	DetailLow    Detail = "low"
+
+	DefaultDetail = DetailMedium
+)
+
+// detailTolerances is the Douglas-Peucker tolerance in meters for each
+// detail level.
+var detailTolerances = map[Detail]float64{
+	DetailFull:   0,
+	DetailHigh:   5,
+	DetailMedium: 20,
+	DetailLow:    100,
+}
+
+// ParseDetail reads a detail query parameter, defaulting to DefaultDetail.
+func ParseDetail(s string) (Detail, error) {
+	if s == "" {
+		return DefaultDetail, nil
+	}
+	d := Detail(strings.ToLower(s))
+	if _, ok := detailTolerances[d]; !ok {
+		return "", fmt.Errorf("invalid detail %q, expected full, high, medium or low", s)
+	}
+	return d, nil
+}
+
+// Polylines holds a path encoded as a precision-6 polyline at every detail
+// level.
+type Polylines struct {
+	Full   string `json:"full"`
+	High   string `json:"high"`
+	Medium string `json:"medium"`
+	Low    string `json:"low"`
+}
+
+// NewPolylines simplifies path at every detail level and encodes the results.
+func NewPolylines(path []datex.Coordinates) Polylines {
+	return Polylines{
+		Full:   EncodePolyline(path),
+		High:   EncodePolyline(SimplifyPath(path, detailTolerances[DetailHigh])),
+		Medium: EncodePolyline(SimplifyPath(path, detailTolerances[DetailMedium])),
+		Low:    EncodePolyline(SimplifyPath(path, detailTolerances[DetailLow])),
+	}
+}
+
+// Get returns the polyline for d, falling back to the full path.
+func (p Polylines) Get(d Detail) string {
+	switch d {
+	case DetailHigh:
+		return p.High
+	case DetailMedium:
+		return p.Medium
+	case DetailLow:
+		return p.Low
+	default:
+		return p.Full
+	}
+}
+
+// EncodePolyline encodes path as a precision-6 polyline.
+func EncodePolyline(path []datex.Coordinates) string {
+	var (
+		b                strings.Builder
+		prevLat, prevLon int64
+	)
+	for _, c := range path {
+		lat := int64(math.Round(c.Lat * polylineFactor))
+		lon := int64(math.Round(c.Lon * polylineFactor))
+		encodeValue(&b, lat-prevLat)
+		encodeValue(&b, lon-prevLon)
+		prevLat, prevLon = lat, lon
+	}
+	return b.String()
+}
+
+func encodeValue(b *strings.Builder, v int64) {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+	for u >= 0x20 {
+		b.WriteByte(byte((0x20 | (u & 0x1f)) + 63))
+		u >>= 5
+	}
+	b.WriteByte(byte(u + 63))
+}
+
+var errMalformedPolyline = errors.New("malformed polyline")
+
+// DecodePolyline decodes a precision-6 polyline.
+func DecodePolyline(s string) ([]datex.Coordinates, error) {
+	var (
+		path     []datex.Coordinates
+		lat, lon int64
+	)
+	for i := 0; i < len(s); {
+		dLat, n, err := decodeValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		dLon, n, err := decodeValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+
+		lat += dLat
+		lon += dLon
+		path = append(path, datex.Coordinates{Lat: float64(lat) / polylineFactor, Lon: float64(lon) / polylineFactor})
+	}
+	return path, nil
+}
+
+func decodeValue(s string) (int64, int, error) {
+	var (
+		u     uint64
+		shift uint
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 63 || shift > 63 {
+			return 0, 0, errMalformedPolyline
+		}
+		chunk := uint64(c - 63)
+		u |= (chunk & 0x1f) << shift
+		shift += 5
+		if chunk < 0x20 {
+			v := int64(u >> 1)
+			if u&1 != 0 {
+				v = ^v
+			}
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errMalformedPolyline
+}
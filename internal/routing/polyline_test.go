@@ -0,0 +1,80 @@
+package routing
+
+import (
+	"math"
+	"testing"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// The example path of Google's polyline documentation, at precision 6 as
+// OSRM returns it for polyline6.
+var (
+	polyline6Path = []datex.Coordinates{
+		{Lat: 38.5, Lon: -120.2},
+		{Lat: 40.7, Lon: -120.95},
+		{Lat: 43.252, Lon: -126.453},
+	}
+	polyline6Encoded = "_izlhA~rlgdF_{geC~ywl@_kwzCn`{nI"
+)
+
+func TestEncodePolylineKnownVector(t *testing.T) {
+	if got := EncodePolyline(polyline6Path); got != polyline6Encoded {
+		t.Errorf("got %q, want %q", got, polyline6Encoded)
+	}
+}
+
+func TestDecodePolylineKnownVector(t *testing.T) {
+	got, err := DecodePolyline(polyline6Encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPath(t, got, polyline6Path)
+}
+
+func TestPolylineRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		path []datex.Coordinates
+	}{
+		{"empty", nil},
+		{"single point", []datex.Coordinates{{Lat: 40.416775, Lon: -3.703790}}},
+		{"negative", []datex.Coordinates{{Lat: -33.868820, Lon: -151.209296}, {Lat: -34.603684, Lon: -58.381559}}},
+		{"across the antimeridian", []datex.Coordinates{{Lat: 51.5, Lon: 179.999999}, {Lat: 51.5, Lon: -179.999999}, {Lat: 51.6, Lon: 180}}},
+		{"poles", []datex.Coordinates{{Lat: 90, Lon: 0}, {Lat: -90, Lon: 0}}},
+		{"repeated point", []datex.Coordinates{{Lat: 28.1, Lon: -15.4}, {Lat: 28.1, Lon: -15.4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePolyline(EncodePolyline(tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertPath(t, got, tt.path)
+		})
+	}
+}
+
+func TestDecodePolylineMalformed(t *testing.T) {
+	for _, s := range []string{
+		polyline6Encoded[:len(polyline6Encoded)-1], // longitude cut short
+		"_izlhA",        // latitude without longitude
+		"_izlhA~rl\x01", // below the encoding alphabet
+	} {
+		if _, err := DecodePolyline(s); err == nil {
+			t.Errorf("decoding %q: got no error", s)
+		}
+	}
+}
+
+func assertPath(t *testing.T, got, want []datex.Coordinates) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d points, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(got[i].Lat-want[i].Lat) > 1e-9 || math.Abs(got[i].Lon-want[i].Lon) > 1e-9 {
+			t.Errorf("point %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
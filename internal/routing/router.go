@@ -0,0 +1,152 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// Route sources tell which backend produced a path. Approximate sources are
+// not road routes: a straight line drawn because nothing could route the
+// endpoints, or a great-circle interpolation.
+const (
+	RouteSourceOSRM        = "osrm"
+	RouteSourceValhalla    = "valhalla"
+	RouteSourceGraphHopper = "graphhopper"
+	RouteSourceGreatCircle = "great_circle"
+	RouteSourceFallback    = "fallback"
+)
+
+// IsApproximate reports whether source does not follow the road network.
+func IsApproximate(source string) bool {
+	return source == RouteSourceFallback || source == RouteSourceGreatCircle
+}
+
+// RouteResult contains the computed route path and distance
+type RouteResult struct {
+	Path      []datex.Coordinates
+	Polylines Polylines // Path encoded at every detail level
+	Distance  float64   // distance in meters
+	Duration  float64   // duration in seconds
+	Source    string    // backend that produced the route, or RouteSourceFallback
+
+	// Confidence is how well Distance agrees with the segment's expected
+	// length, from 0 to 1, or nil if it was not checked.
+	Confidence *float64
+}
+
+// Approximate reports whether the result does not follow the road network.
+func (r RouteResult) Approximate() bool {
+	return IsApproximate(r.Source)
+}
+
+// Provider computes routes between coordinates and never fails: when no
+// route can be computed it returns a straight line marked as a fallback.
+type Provider interface {
+	GetRoute(ctx context.Context, from, to datex.Coordinates) []datex.Coordinates
+	GetRouteWithDistance(ctx context.Context, from, to datex.Coordinates) RouteResult
+	// Available reports whether a road routing backend is currently reachable.
+	Available() bool
+}
+
+// Router routes with a single backend and reports failures instead of
+// falling back, so routers can be chained.
+type Router interface {
+	Name() string
+	Route(ctx context.Context, from, to datex.Coordinates) (RouteResult, error)
+	Available() bool
+}
+
+// Backend makes a single routing request to a routing server. RouteService
+// adds retries, a circuit breaker and a concurrency cap on top.
+type Backend interface {
+	Name() string
+	// Route returns the route and the version of the dataset that produced
+	// it, empty if the server does not report one.
+	Route(ctx context.Context, client *http.Client, from, to datex.Coordinates) (RouteResult, string, error)
+	// DatasetVersion asks the server which dataset it is serving, using c if
+	// it needs a location to answer.
+	DatasetVersion(client *http.Client, c datex.Coordinates) (string, error)
+}
+
+// backendError is a failed request. Retryable errors are the ones a server
+// being down or overloaded would cause; they also count against the breaker.
+type backendError struct {
+	err       error
+	retryable bool
+}
+
+func (e *backendError) Error() string { return e.err.Error() }
+func (e *backendError) Unwrap() error { return e.err }
+
+func retryable(err error) error { return &backendError{err, true} }
+
+func isRetryable(err error) bool {
+	var berr *backendError
+	return errors.As(err, &berr) && berr.retryable
+}
+
+// retryableStatus reports whether an HTTP status means the server could not
+// answer, rather than that it could not route the request.
+func retryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+// Chain tries its routers in order and returns the first route. If all of
+// them fail it falls back to a straight line.
+type Chain struct {
+	routers []Router
+}
+
+func NewChain(routers ...Router) *Chain {
+	return &Chain{routers: routers}
+}
+
+// GetRoute returns just the path coordinates
+func (c *Chain) GetRoute(ctx context.Context, from, to datex.Coordinates) []datex.Coordinates {
+	return c.GetRouteWithDistance(ctx, from, to).Path
+}
+
+// GetRouteWithDistance returns the full route result including distance
+func (c *Chain) GetRouteWithDistance(ctx context.Context, from, to datex.Coordinates) RouteResult {
+	for _, r := range c.routers {
+		result, err := r.Route(ctx, from, to)
+		if err == nil {
+			return result
+		}
+	}
+	RoutingFallbacks.Inc()
+	return fallbackRoute(from, to)
+}
+
+// Available reports whether any router in the chain is available.
+func (c *Chain) Available() bool {
+	for _, r := range c.routers {
+		if r.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns the routers in the order they are tried.
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.routers))
+	for i, r := range c.routers {
+		names[i] = r.Name()
+	}
+	return names
+}
+
+// fallbackRoute is a straight line between the endpoints, used when no
+// router can route them.
+func fallbackRoute(from, to datex.Coordinates) RouteResult {
+	path := []datex.Coordinates{from, to}
+	return RouteResult{
+		Path:      path,
+		Polylines: NewPolylines(path),
+		Source:    RouteSourceFallback,
+	}
+}
@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// RouteOptions bounds how hard RouteService tries to reach its backend.
+type RouteOptions struct {
+	Timeout          time.Duration // per attempt
+	MaxRetries       int           // attempts after the first
+	RetryBackoff     time.Duration // base delay, doubled per retry with full jitter
+	MaxConcurrent    int           // in-flight requests; 0 means unlimited
+	BreakerThreshold int           // consecutive failures that open the breaker; 0 disables it
+	BreakerCooldown  time.Duration // how long the breaker stays open before probing
+}
+
+// RouteService routes with a Backend, retrying transient failures, failing
+// fast while the backend is down and capping concurrent requests.
+type RouteService struct {
+	backend Backend
+	client  *http.Client
+	opts    RouteOptions
+	breaker *circuitBreaker
+	slots   chan struct{}
+}
+
+func NewRouteService(backend Backend, opts RouteOptions) *RouteService {
+	rs := &RouteService{
+		backend: backend,
+		client:  &http.Client{Timeout: opts.Timeout},
+		opts:    opts,
+		breaker: newCircuitBreaker(backend.Name(), opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+	if opts.MaxConcurrent > 0 {
+		rs.slots = make(chan struct{}, opts.MaxConcurrent)
+	}
+	return rs
+}
+
+func (rs *RouteService) Name() string {
+	return rs.backend.Name()
+}
+
+// Route returns the route between from and to.
+func (rs *RouteService) Route(ctx context.Context, from, to datex.Coordinates) (RouteResult, error) {
+	result, _, err := rs.route(ctx, from, to)
+	return result, err
+}
+
+// Available reports whether the backend is currently considered reachable,
+// i.e. the circuit breaker is closed.
+func (rs *RouteService) Available() bool {
+	return rs.breaker.closed()
+}
+
+// DatasetVersion asks the backend which dataset it is serving.
+func (rs *RouteService) DatasetVersion(c datex.Coordinates) (string, error) {
+	return rs.backend.DatasetVersion(rs.client, c)
+}
+
+// route returns the route with the version of the dataset that produced it.
+// It gives up, without holding it against the backend, once ctx is done.
+func (rs *RouteService) route(ctx context.Context, from, to datex.Coordinates) (RouteResult, string, error) {
+	name := rs.backend.Name()
+
+	var err error
+	for attempt := 0; attempt <= rs.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			RoutingRetries.WithLabelValues(name).Inc()
+			select {
+			case <-ctx.Done():
+				return RouteResult{}, "", ctx.Err()
+			case <-time.After(rs.backoff(attempt)):
+			}
+		}
+
+		if !rs.breaker.allow() {
+			RoutingRequests.WithLabelValues(name, "rejected").Inc()
+			return RouteResult{}, "", errCircuitOpen
+		}
+
+		var (
+			result  RouteResult
+			version string
+		)
+		result, version, err = rs.routeOnce(ctx, from, to)
+		if ctx.Err() != nil {
+			rs.breaker.abandon()
+			return RouteResult{}, "", ctx.Err()
+		}
+		if err == nil || !isRetryable(err) {
+			// The backend answered, even if it could not route these endpoints.
+			rs.breaker.success()
+			return result, version, err
+		}
+		rs.breaker.failure()
+	}
+	return RouteResult{}, "", err
+}
+
+// backoff returns a random delay up to RetryBackoff doubled per attempt.
+func (rs *RouteService) backoff(attempt int) time.Duration {
+	ceiling := rs.opts.RetryBackoff << (attempt - 1)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+func (rs *RouteService) routeOnce(ctx context.Context, from, to datex.Coordinates) (RouteResult, string, error) {
+	name := rs.backend.Name()
+
+	release, err := rs.acquire(ctx)
+	if err != nil {
+		return RouteResult{}, "", err
+	}
+	defer release()
+
+	timer := prometheus.NewTimer(RoutingRequestDuration.WithLabelValues(name))
+	defer timer.ObserveDuration()
+
+	result, version, err := rs.backend.Route(ctx, rs.client, from, to)
+	switch {
+	case err == nil:
+		RoutingRequests.WithLabelValues(name, "success").Inc()
+		RoutingRouteDistance.WithLabelValues(name).Observe(result.Distance)
+	case errors.Is(err, errNoRoute):
+		slog.Warn("route computation failed", slog.String("backend", name), slog.String("error", err.Error()))
+		RoutingRequests.WithLabelValues(name, "no_route").Inc()
+	default:
+		slog.Error("route computation failed", slog.String("backend", name), slog.String("error", err.Error()))
+		RoutingRequests.WithLabelValues(name, "error").Inc()
+	}
+	return result, version, err
+}
+
+// acquire waits for a request slot, or until ctx is done, and returns the
+// function that frees it.
+func (rs *RouteService) acquire(ctx context.Context) (func(), error) {
+	if rs.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case rs.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	name := rs.backend.Name()
+	RoutingInFlight.WithLabelValues(name).Inc()
+	return func() {
+		<-rs.slots
+		RoutingInFlight.WithLabelValues(name).Dec()
+	}, nil
+}
@@ -0,0 +1,263 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+var errBackendDown = retryable(errors.New("backend down"))
+
+// fakeBackend answers route requests with errs in turn, succeeding once they
+// run out. Requests wait for release, if set.
+type fakeBackend struct {
+	mu      sync.Mutex
+	errs    []error
+	calls   int
+	onCall  func()
+	release chan struct{}
+
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (f *fakeBackend) Name() string { return "fake" }
+
+func (f *fakeBackend) Route(ctx context.Context, _ *http.Client, from, to datex.Coordinates) (RouteResult, string, error) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		m := f.maxInFlight.Load()
+		if n <= m || f.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	f.mu.Lock()
+	f.calls++
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+	onCall := f.onCall
+	f.mu.Unlock()
+
+	if onCall != nil {
+		onCall()
+	}
+	if f.release != nil {
+		<-f.release
+	}
+	if err != nil {
+		return RouteResult{}, "", err
+	}
+	return RouteResult{Path: []datex.Coordinates{from, to}, Source: "fake"}, "", nil
+}
+
+func (f *fakeBackend) DatasetVersion(*http.Client, datex.Coordinates) (string, error) {
+	return "", nil
+}
+
+func (f *fakeBackend) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const cooldown = time.Minute
+
+	type step struct {
+		do        string // allow, failure, success, abandon or wait
+		wait      time.Duration
+		wantAllow bool
+		wantState breakerState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after threshold consecutive failures", []step{
+			{do: "allow", wantAllow: true, wantState: breakerClosed},
+			{do: "failure", wantState: breakerClosed},
+			{do: "success", wantState: breakerClosed},
+			{do: "failure", wantState: breakerClosed},
+			{do: "failure", wantState: breakerOpen},
+			{do: "allow", wantAllow: false, wantState: breakerOpen},
+		}},
+		{"lets a single probe through after the cooldown", []step{
+			{do: "failure"}, {do: "failure", wantState: breakerOpen},
+			{do: "wait", wait: cooldown - time.Second, wantState: breakerOpen},
+			{do: "allow", wantAllow: false, wantState: breakerOpen},
+			{do: "wait", wait: time.Second, wantState: breakerOpen},
+			{do: "allow", wantAllow: true, wantState: breakerHalfOpen},
+			{do: "allow", wantAllow: false, wantState: breakerHalfOpen},
+		}},
+		{"a successful probe closes it", []step{
+			{do: "failure"}, {do: "failure", wantState: breakerOpen},
+			{do: "wait", wait: cooldown, wantState: breakerOpen},
+			{do: "allow", wantAllow: true, wantState: breakerHalfOpen},
+			{do: "success", wantState: breakerClosed},
+			{do: "allow", wantAllow: true, wantState: breakerClosed},
+			{do: "failure", wantState: breakerClosed},
+		}},
+		{"a failed probe reopens it for another cooldown", []step{
+			{do: "failure"}, {do: "failure", wantState: breakerOpen},
+			{do: "wait", wait: cooldown, wantState: breakerOpen},
+			{do: "allow", wantAllow: true, wantState: breakerHalfOpen},
+			{do: "failure", wantState: breakerOpen},
+			{do: "wait", wait: cooldown - time.Second, wantState: breakerOpen},
+			{do: "allow", wantAllow: false, wantState: breakerOpen},
+		}},
+		{"an abandoned probe lets another through", []step{
+			{do: "failure"}, {do: "failure", wantState: breakerOpen},
+			{do: "wait", wait: cooldown, wantState: breakerOpen},
+			{do: "allow", wantAllow: true, wantState: breakerHalfOpen},
+			{do: "abandon", wantState: breakerHalfOpen},
+			{do: "allow", wantAllow: true, wantState: breakerHalfOpen},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			b := newCircuitBreaker("fake", 2, cooldown)
+			b.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				switch s.do {
+				case "allow":
+					if got := b.allow(); got != s.wantAllow {
+						t.Fatalf("step %d: allow() = %v, want %v", i, got, s.wantAllow)
+					}
+				case "failure":
+					b.failure()
+				case "success":
+					b.success()
+				case "abandon":
+					b.abandon()
+				case "wait":
+					now = now.Add(s.wait)
+				}
+				if b.state != s.wantState {
+					t.Fatalf("step %d (%s): state %d, want %d", i, s.do, b.state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("fake", 0, time.Minute)
+	for range 10 {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Error("a breaker with no threshold opened")
+	}
+}
+
+func TestRouteServiceRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		threshold int
+		wantCalls int
+		wantErr   error
+		wantState breakerState
+	}{
+		{"first attempt succeeds", nil, 5, 1, nil, breakerClosed},
+		{"retries a transient failure", []error{errBackendDown}, 5, 2, nil, breakerClosed},
+		{"gives up after the retries", []error{errBackendDown, errBackendDown, errBackendDown}, 5, 3, errBackendDown, breakerClosed},
+		{"does not retry a route that does not exist", []error{errNoRoute}, 5, 1, errNoRoute, breakerClosed},
+		{"stops once the breaker opens", []error{errBackendDown, errBackendDown, errBackendDown}, 2, 2, errCircuitOpen, breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &fakeBackend{errs: tt.errs}
+			rs := NewRouteService(backend, RouteOptions{MaxRetries: 2, BreakerThreshold: tt.threshold, BreakerCooldown: time.Minute})
+
+			_, err := rs.Route(context.Background(), datex.Coordinates{}, datex.Coordinates{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got := backend.callCount(); got != tt.wantCalls {
+				t.Errorf("got %d requests, want %d", got, tt.wantCalls)
+			}
+			if rs.breaker.state != tt.wantState {
+				t.Errorf("got breaker state %d, want %d", rs.breaker.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestRouteServiceGivesUpOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &fakeBackend{errs: []error{errBackendDown, errBackendDown}, onCall: cancel}
+	rs := NewRouteService(backend, RouteOptions{MaxRetries: 5, RetryBackoff: time.Hour, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+
+	_, err := rs.Route(ctx, datex.Coordinates{}, datex.Coordinates{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if got := backend.callCount(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+	// Giving up is not the backend's fault.
+	if !rs.Available() {
+		t.Error("breaker opened on a cancelled request")
+	}
+}
+
+func TestRouteServiceGivesUpWaitingForSlot(t *testing.T) {
+	backend := &fakeBackend{}
+	rs := NewRouteService(backend, RouteOptions{MaxConcurrent: 1})
+	release, err := rs.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := rs.Route(ctx, datex.Coordinates{}, datex.Coordinates{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := backend.callCount(); got != 0 {
+		t.Errorf("got %d requests, want none", got)
+	}
+}
+
+func TestRouteServiceCapsConcurrentRequests(t *testing.T) {
+	const limit = 2
+	backend := &fakeBackend{release: make(chan struct{})}
+	rs := NewRouteService(backend, RouteOptions{MaxConcurrent: limit})
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs.Route(context.Background(), datex.Coordinates{}, datex.Coordinates{}) //nolint:errcheck
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for backend.inFlight.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // room for a request over the limit to start
+	close(backend.release)
+	wg.Wait()
+
+	if got := backend.maxInFlight.Load(); got != limit {
+		t.Errorf("got %d requests in flight at most, want %d", got, limit)
+	}
+	if got := backend.callCount(); got != 5 {
+		t.Errorf("got %d requests, want 5", got)
+	}
+}
@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"math"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const metersPerDegree = earthRadius * math.Pi / 180
+
+// SimplifyPath reduces path with the Douglas-Peucker algorithm, dropping
+// points closer than tolerance meters to the simplified line. Endpoints are
+// always kept. A tolerance of zero returns path unchanged.
+func SimplifyPath(path []datex.Coordinates, tolerance float64) []datex.Coordinates {
+	if tolerance <= 0 || len(path) < 3 {
+		return path
+	}
+
+	// Project into local meters around the path's first point; the error is
+	// negligible over the length of a road incident.
+	kx := math.Cos(path[0].Lat*math.Pi/180) * metersPerDegree
+	xy := make([][2]float64, len(path))
+	for i, c := range path {
+		xy[i] = [2]float64{(c.Lon - path[0].Lon) * kx, (c.Lat - path[0].Lat) * metersPerDegree}
+	}
+
+	keep := make([]bool, len(path))
+	keep[0], keep[len(path)-1] = true, true
+
+	stack := [][2]int{{0, len(path) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		maxDist, index := 0.0, -1
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(xy[i], xy[first], xy[last]); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+		if index >= 0 && maxDist > tolerance {
+			keep[index] = true
+			stack = append(stack, [2]int{first, index}, [2]int{index, last})
+		}
+	}
+
+	out := make([]datex.Coordinates, 0, len(path))
+	for i, k := range keep {
+		if k {
+			out = append(out, path[i])
+		}
+	}
+	return out
+}
+
+// segmentDistance returns the distance from p to the segment a-b.
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	t := math.Max(0, math.Min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/(dx*dx+dy*dy)))
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+func TestSimplifyPath(t *testing.T) {
+	// About 11m between points, along a meridian with a 55m detour at the
+	// third one.
+	path := []datex.Coordinates{
+		{Lat: 40.0000, Lon: -3.7},
+		{Lat: 40.0001, Lon: -3.7},
+		{Lat: 40.0002, Lon: -3.7 + 0.00065},
+		{Lat: 40.0003, Lon: -3.7},
+		{Lat: 40.0004, Lon: -3.7},
+	}
+
+	tests := []struct {
+		name      string
+		tolerance float64
+		want      []int // indexes of path kept
+	}{
+		{"zero tolerance keeps every point", 0, []int{0, 1, 2, 3, 4}},
+		{"detour above tolerance is kept", 20, []int{0, 2, 4}},
+		{"detour below tolerance is dropped", 100, []int{0, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SimplifyPath(path, tt.tolerance)
+			want := make([]datex.Coordinates, len(tt.want))
+			for i, j := range tt.want {
+				want[i] = path[j]
+			}
+			assertPath(t, got, want)
+		})
+	}
+}
+
+func TestSimplifyPathShortPaths(t *testing.T) {
+	for _, path := range [][]datex.Coordinates{
+		nil,
+		{{Lat: 40, Lon: -3.7}},
+		{{Lat: 40, Lon: -3.7}, {Lat: 41, Lon: -3.7}},
+	} {
+		assertPath(t, SimplifyPath(path, 100), path)
+	}
+}
@@ -0,0 +1,230 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// snapCandidates is how many nearby road segments are considered when
+// looking for the incident's road.
+const snapCandidates = 5
+
+// carriagewaySeparation is how far apart in meters two segments of the same
+// road must be to count as its two carriageways rather than one.
+const carriagewaySeparation = 8
+
+var errSnapUnsupported = errors.New("backend does not support snapping")
+
+// Waypoint is a coordinate snapped onto the road network.
+type Waypoint struct {
+	Location datex.Coordinates
+	Name     string  // name of the road it was snapped to
+	Distance float64 // meters from the input coordinate
+}
+
+// SnapBackend is implemented by backends that can snap coordinates.
+type SnapBackend interface {
+	// Nearest returns up to n road segments near c, closest first.
+	Nearest(client *http.Client, c datex.Coordinates, n int) ([]Waypoint, error)
+	// Match snaps coords as a trace, so consecutive points land on connected
+	// roads. Points that could not be matched are nil.
+	Match(client *http.Client, coords []datex.Coordinates, radius float64) ([]*Waypoint, error)
+}
+
+// Nearest returns up to n road segments near c, closest first.
+func (rs *RouteService) Nearest(c datex.Coordinates, n int) ([]Waypoint, error) {
+	sb, ok := rs.backend.(SnapBackend)
+	if !ok {
+		return nil, errSnapUnsupported
+	}
+	var waypoints []Waypoint
+	err := rs.snapCall(func() (err error) {
+		waypoints, err = sb.Nearest(rs.client, c, n)
+		return err
+	})
+	return waypoints, err
+}
+
+// Match snaps coords as a trace, searching radius meters around each one.
+func (rs *RouteService) Match(coords []datex.Coordinates, radius float64) ([]*Waypoint, error) {
+	sb, ok := rs.backend.(SnapBackend)
+	if !ok {
+		return nil, errSnapUnsupported
+	}
+	var waypoints []*Waypoint
+	err := rs.snapCall(func() (err error) {
+		waypoints, err = sb.Match(rs.client, coords, radius)
+		return err
+	})
+	return waypoints, err
+}
+
+// SupportsSnapping reports whether the backend can snap coordinates.
+func (rs *RouteService) SupportsSnapping() bool {
+	_, ok := rs.backend.(SnapBackend)
+	return ok
+}
+
+// snapCall makes a single attempt through the breaker and request slots;
+// snapping is best effort, so it is not retried.
+func (rs *RouteService) snapCall(fn func() error) error {
+	if !rs.breaker.allow() {
+		return errCircuitOpen
+	}
+	release, _ := rs.acquire(context.Background()) // waits, it cannot fail
+	defer release()
+
+	err := fn()
+	if isRetryable(err) {
+		rs.breaker.failure()
+	} else {
+		rs.breaker.success()
+	}
+	return err
+}
+
+// Snapper moves incident coordinates onto the road they are reported on.
+type Snapper struct {
+	routes      *RouteService
+	maxDistance float64
+}
+
+// NewSnapper snaps with routes, never moving a coordinate more than
+// maxDistance meters.
+func NewSnapper(routes *RouteService, maxDistance float64) *Snapper {
+	return &Snapper{routes: routes, maxDistance: maxDistance}
+}
+
+// SnapPoint snaps c onto road, given by its number and name. It prefers the
+// nearest segment of that road and otherwise takes the nearest segment of any
+// road. It returns false if nothing is within the maximum distance.
+func (s *Snapper) SnapPoint(c datex.Coordinates, road datex.RoadInfo) (Waypoint, bool) {
+	candidates, err := s.routes.Nearest(c, snapCandidates)
+	if err != nil {
+		SnapRequests.WithLabelValues("error").Inc()
+		return Waypoint{}, false
+	}
+	return s.pick(candidates, road)
+}
+
+// SnapSegment snaps the endpoints of a segment. Both are matched together
+// first so they land on the same carriageway; an endpoint the match misses,
+// or puts on another road, is snapped on its own.
+func (s *Snapper) SnapSegment(from, to datex.Coordinates, road datex.RoadInfo) (Waypoint, bool, Waypoint, bool) {
+	matched, err := s.routes.Match([]datex.Coordinates{from, to}, s.maxDistance)
+	if err != nil || len(matched) != 2 {
+		matched = []*Waypoint{nil, nil}
+	}
+
+	snap := func(c datex.Coordinates, wp *Waypoint) (Waypoint, bool) {
+		if wp != nil && wp.Distance <= s.maxDistance && onRoad(wp.Name, road) {
+			SnapRequests.WithLabelValues("matched").Inc()
+			SnapDistance.Observe(wp.Distance)
+			return *wp, true
+		}
+		return s.SnapPoint(c, road)
+	}
+
+	fromWp, fromOk := snap(from, matched[0])
+	toWp, toOk := snap(to, matched[1])
+	return fromWp, fromOk, toWp, toOk
+}
+
+// OppositeCarriageway returns the segment of road near c that runs apart from
+// the nearest one, which on a dual carriageway is the other direction. It
+// returns false if road has a single carriageway near c.
+func (s *Snapper) OppositeCarriageway(c datex.Coordinates, road datex.RoadInfo) (Waypoint, bool) {
+	candidates, err := s.routes.Nearest(c, snapCandidates)
+	if err != nil {
+		return Waypoint{}, false
+	}
+
+	var nearest *Waypoint
+	for i := range candidates {
+		wp := &candidates[i]
+		if wp.Distance > s.maxDistance || !onRoad(wp.Name, road) {
+			continue
+		}
+		if nearest == nil {
+			nearest = wp
+			continue
+		}
+		if planarDistance(wp.Location, nearest.Location) >= carriagewaySeparation {
+			return *wp, true
+		}
+	}
+	return Waypoint{}, false
+}
+
+func (s *Snapper) pick(candidates []Waypoint, road datex.RoadInfo) (Waypoint, bool) {
+	var nearest *Waypoint
+	for i := range candidates {
+		wp := &candidates[i]
+		if wp.Distance > s.maxDistance {
+			continue
+		}
+		if onRoad(wp.Name, road) {
+			SnapRequests.WithLabelValues("matched").Inc()
+			SnapDistance.Observe(wp.Distance)
+			return *wp, true
+		}
+		if nearest == nil || wp.Distance < nearest.Distance {
+			nearest = wp
+		}
+	}
+	if nearest == nil {
+		SnapRequests.WithLabelValues("too_far").Inc()
+		return Waypoint{}, false
+	}
+	SnapRequests.WithLabelValues("other_road").Inc()
+	SnapDistance.Observe(nearest.Distance)
+	return *nearest, true
+}
+
+// onRoad reports whether a road segment called name is road. Segment names
+// come from OpenStreetMap and may be the road name, its number, or both,
+// e.g. "Autovía del Noroeste (A-6)".
+func onRoad(name string, road datex.RoadInfo) bool {
+	if road.Number == "" && road.Name == "" {
+		return true
+	}
+	if road.Name != "" && strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(road.Name)) {
+		return true
+	}
+	if road.Number == "" {
+		return false
+	}
+
+	number := NormalizeRoadNumber(road.Number)
+	for _, token := range strings.FieldsFunc(name, func(r rune) bool {
+		return r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if NormalizeRoadNumber(token) == number {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeRoadNumber makes "A-6", "a 6" and "A6" compare equal.
+func NormalizeRoadNumber(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// planarDistance approximates the distance in meters between two nearby
+// coordinates.
+func planarDistance(a, b datex.Coordinates) float64 {
+	kx := math.Cos((a.Lat+b.Lat)/2*math.Pi/180) * metersPerDegree
+	return math.Hypot((b.Lon-a.Lon)*kx, (b.Lat-a.Lat)*metersPerDegree)
+}
@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// valhallaNoRoute is the error code Valhalla returns when no path exists
+// between the locations.
+const valhallaNoRoute = 442
+
+// Valhalla routes with a Valhalla server.
+type Valhalla struct {
+	url     string
+	costing string
+}
+
+// NewValhalla returns a Valhalla backend using the given costing model,
+// e.g. "auto".
+func NewValhalla(url, costing string) *Valhalla {
+	return &Valhalla{url: url, costing: costing}
+}
+
+type valhallaLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type valhallaRequest struct {
+	Locations      []valhallaLocation `json:"locations"`
+	Costing        string             `json:"costing"`
+	Units          string             `json:"units"`
+	DirectionsType string             `json:"directions_type"`
+}
+
+type valhallaResponse struct {
+	Trip struct {
+		Legs []struct {
+			Shape string `json:"shape"` // precision-6 polyline
+		} `json:"legs"`
+		Summary struct {
+			Length float64 `json:"length"` // kilometers
+			Time   float64 `json:"time"`   // seconds
+		} `json:"summary"`
+	} `json:"trip"`
+	ErrorCode int    `json:"error_code"`
+	Error     string `json:"error"`
+}
+
+func (v *Valhalla) Name() string {
+	return RouteSourceValhalla
+}
+
+func (v *Valhalla) Route(ctx context.Context, client *http.Client, from, to datex.Coordinates) (RouteResult, string, error) {
+	body, err := json.Marshal(valhallaRequest{
+		Locations:      []valhallaLocation{{Lat: from.Lat, Lon: from.Lon}, {Lat: to.Lat, Lon: to.Lon}},
+		Costing:        v.costing,
+		Units:          "kilometers",
+		DirectionsType: "none",
+	})
+	if err != nil {
+		return RouteResult{}, "", fmt.Errorf("failed to marshal valhalla request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url+"/route", bytes.NewReader(body))
+	if err != nil {
+		return RouteResult{}, "", fmt.Errorf("failed to create route request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return RouteResult{}, "", retryable(fmt.Errorf("failed to request route: %w", err))
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var vr valhallaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		if resp.StatusCode == http.StatusOK || retryableStatus(resp.StatusCode) {
+			return RouteResult{}, "", retryable(fmt.Errorf("failed to decode route: %w", err))
+		}
+		return RouteResult{}, "", fmt.Errorf("unexpected valhalla status %d", resp.StatusCode)
+	}
+
+	switch {
+	case retryableStatus(resp.StatusCode):
+		return RouteResult{}, "", retryable(fmt.Errorf("unexpected valhalla status %d", resp.StatusCode))
+	case vr.ErrorCode == valhallaNoRoute:
+		return RouteResult{}, "", errNoRoute
+	case resp.StatusCode != http.StatusOK:
+		return RouteResult{}, "", fmt.Errorf("unexpected valhalla status %d: %s", resp.StatusCode, vr.Error)
+	}
+
+	var coords []datex.Coordinates
+	for _, leg := range vr.Trip.Legs {
+		path, err := DecodePolyline(leg.Shape)
+		if err != nil {
+			return RouteResult{}, "", errors.New("invalid route geometry")
+		}
+		coords = append(coords, path...)
+	}
+	if len(coords) == 0 {
+		return RouteResult{}, "", errNoRoute
+	}
+
+	return RouteResult{
+		Path:      coords,
+		Polylines: NewPolylines(coords),
+		Distance:  vr.Trip.Summary.Length * 1000,
+		Duration:  vr.Trip.Summary.Time,
+		Source:    RouteSourceValhalla,
+	}, "", nil
+}
+
+// DatasetVersion returns when the routing tiles were last modified, from the
+// status endpoint.
+func (v *Valhalla) DatasetVersion(client *http.Client, _ datex.Coordinates) (string, error) {
+	resp, err := client.Get(v.url + "/status")
+	if err != nil {
+		return "", fmt.Errorf("failed to request valhalla status: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected valhalla status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		TilesetLastModified int64 `json:"tileset_last_modified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode valhalla status: %w", err)
+	}
+	if body.TilesetLastModified == 0 {
+		return "", nil
+	}
+	return strconv.FormatInt(body.TilesetLastModified, 10), nil
+}
@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"context"
+	"math"
+	"slices"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// MinRouteConfidence is the confidence below which a route is taken not to
+// follow its segment, typically a detour to turn around because the endpoints
+// were routed against the direction of traffic.
+const MinRouteConfidence = 0.5
+
+// lengthSlack is added to both lengths before comparing them, so that short
+// segments are not rejected for the few hundred meters km markers, rounded to
+// the hectometer, can be off by.
+const lengthSlack = 200
+
+// Expected is what a segment's publisher declared about its length, in
+// meters. Zero values are unknown.
+type Expected struct {
+	Length  float64 `json:"length,omitempty"`  // declared length
+	KmDelta float64 `json:"kmDelta,omitempty"` // distance between the km markers of its ends
+}
+
+// ExpectedFor reads the expected length of a linear location.
+func ExpectedFor(loc datex.Location) Expected {
+	var e Expected
+	if loc.Length != nil && *loc.Length > 0 {
+		e.Length = *loc.Length
+	}
+	if loc.Linear != nil && loc.Linear.From.Km != nil && loc.Linear.To.Km != nil {
+		e.KmDelta = math.Abs(*loc.Linear.To.Km-*loc.Linear.From.Km) * 1000
+	}
+	return e
+}
+
+// Known reports whether there is anything to compare a route with.
+func (e Expected) Known() bool {
+	return e.Length > 0 || e.KmDelta > 0
+}
+
+// Confidence scores from 0 to 1 how well a routed distance agrees with the
+// expected length. When both the declared length and the km markers are known
+// the better agreement counts, as either may be wrong. It returns false if
+// nothing is known.
+func (e Expected) Confidence(distance float64) (float64, bool) {
+	var (
+		best  float64
+		known bool
+	)
+	for _, want := range []float64{e.Length, e.KmDelta} {
+		if want <= 0 {
+			continue
+		}
+		a, b := distance+lengthSlack, want+lengthSlack
+		best = max(best, min(a, b)/max(a, b))
+		known = true
+	}
+	return best, known
+}
+
+// Segment is an incident segment to route.
+type Segment struct {
+	From, To datex.Coordinates
+	Road     datex.RoadInfo
+	Expected Expected
+}
+
+// SegmentRouter routes incident segments and checks each route against the
+// segment's expected length. When they disagree it also tries the endpoints
+// reversed and, if it can snap, the road's opposite carriageway, and keeps
+// whichever route agrees best.
+type SegmentRouter struct {
+	Provider
+	snapper *Snapper
+}
+
+// NewSegmentRouter routes with routes. snapper may be nil, in which case the
+// opposite carriageway is not tried.
+func NewSegmentRouter(routes Provider, snapper *Snapper) *SegmentRouter {
+	return &SegmentRouter{Provider: routes, snapper: snapper}
+}
+
+// RouteSegment routes seg from its start to its end. Road routes are given a
+// confidence if seg has an expected length; approximate ones are not checked.
+func (sr *SegmentRouter) RouteSegment(ctx context.Context, seg Segment) RouteResult {
+	result := sr.GetRouteWithDistance(ctx, seg.From, seg.To)
+	confidence, ok := seg.Expected.Confidence(result.Distance)
+	if result.Approximate() || !ok {
+		RouteValidations.WithLabelValues("unchecked").Inc()
+		return result
+	}
+	result.Confidence = &confidence
+	if confidence >= MinRouteConfidence {
+		RouteValidations.WithLabelValues("accepted").Inc()
+		return result
+	}
+
+	outcome := "low_confidence"
+	try := func(name string, alt RouteResult) {
+		if alt.Approximate() {
+			return
+		}
+		c, _ := seg.Expected.Confidence(alt.Distance)
+		if c > *result.Confidence {
+			alt.Confidence = &c
+			result = alt
+			if c >= MinRouteConfidence {
+				outcome = name
+			}
+		}
+	}
+
+	try("reversed", reverse(sr.GetRouteWithDistance(ctx, seg.To, seg.From)))
+	if *result.Confidence < MinRouteConfidence && sr.snapper != nil {
+		from, fromOk := sr.snapper.OppositeCarriageway(seg.From, seg.Road)
+		to, toOk := sr.snapper.OppositeCarriageway(seg.To, seg.Road)
+		if fromOk && toOk {
+			try("opposite_carriageway", sr.GetRouteWithDistance(ctx, from.Location, to.Location))
+		}
+	}
+
+	RouteValidations.WithLabelValues(outcome).Inc()
+	return result
+}
+
+// reverse turns a route between to and from into one between from and to, so
+// paths always start at the segment's start.
+func reverse(r RouteResult) RouteResult {
+	path := slices.Clone(r.Path)
+	slices.Reverse(path)
+	r.Path = path
+	r.Polylines = NewPolylines(path)
+	return r
+}
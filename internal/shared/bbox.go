@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+// BBox is a WGS84 bounding box in GeoJSON order: west, south, east, north.
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// ParseBBox parses a "minLon,minLat,maxLon,maxLat" query parameter.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat, got %q", s)
+	}
+
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("invalid bbox coordinate %q: %w", p, err)
+		}
+		v[i] = f
+	}
+
+	b := BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if b.MinLon < -180 || b.MaxLon > 180 || b.MinLat < -90 || b.MaxLat > 90 {
+		return BBox{}, fmt.Errorf("bbox %q is outside WGS84 bounds", s)
+	}
+	if b.MinLon > b.MaxLon || b.MinLat > b.MaxLat {
+		return BBox{}, fmt.Errorf("bbox %q has min greater than max", s)
+	}
+	return b, nil
+}
+
+// Contains reports whether c lies inside or on the edge of the box.
+func (b BBox) Contains(c datex.Coordinates) bool {
+	return c.Lon >= b.MinLon && c.Lon <= b.MaxLon && c.Lat >= b.MinLat && c.Lat <= b.MaxLat
+}
+
+// Intersects reports whether the two boxes overlap.
+func (b BBox) Intersects(o BBox) bool {
+	return b.MinLon <= o.MaxLon && o.MinLon <= b.MaxLon && b.MinLat <= o.MaxLat && o.MinLat <= b.MaxLat
+}
+
+// BoundsOf returns the smallest box containing every coordinate. It returns
+// false for an empty slice.
+func BoundsOf(coords []datex.Coordinates) (BBox, bool) {
+	if len(coords) == 0 {
+		return BBox{}, false
+	}
+	b := BBox{MinLon: coords[0].Lon, MinLat: coords[0].Lat, MaxLon: coords[0].Lon, MaxLat: coords[0].Lat}
+	for _, c := range coords[1:] {
+		b.MinLon = min(b.MinLon, c.Lon)
+		b.MinLat = min(b.MinLat, c.Lat)
+		b.MaxLon = max(b.MaxLon, c.Lon)
+		b.MaxLat = max(b.MaxLat, c.Lat)
+	}
+	return b, true
+}
+
+// Bounds returns the box covering the location's point or path.
+func (l *MapLocation) Bounds() (BBox, bool) {
+	if l.Point != nil {
+		return BBox{MinLon: l.Point.Lon, MinLat: l.Point.Lat, MaxLon: l.Point.Lon, MaxLat: l.Point.Lat}, true
+	}
+	return BoundsOf(l.Path)
+}
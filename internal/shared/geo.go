@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"math"
+
+	"github.com/sverdejot/beacon/pkg/datex"
+)
+
+const earthRadiusMeters = 6371008.8
+
+// Haversine returns the great-circle distance between a and b in meters.
+func Haversine(a, b datex.Coordinates) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Anchor returns the single coordinate that represents the location in a
+// spatial index: the point itself, or the point halfway along a segment's path.
+func (l *MapLocation) Anchor() (datex.Coordinates, bool) {
+	if l.Point != nil {
+		return *l.Point, true
+	}
+	if len(l.Path) == 0 {
+		return datex.Coordinates{}, false
+	}
+
+	var total float64
+	for i := 1; i < len(l.Path); i++ {
+		total += Haversine(l.Path[i-1], l.Path[i])
+	}
+
+	half := total / 2
+	for i := 1; i < len(l.Path); i++ {
+		step := Haversine(l.Path[i-1], l.Path[i])
+		if step >= half && step > 0 {
+			t := half / step
+			a, b := l.Path[i-1], l.Path[i]
+			return datex.Coordinates{Lat: a.Lat + (b.Lat-a.Lat)*t, Lon: a.Lon + (b.Lon-a.Lon)*t}, true
+		}
+		half -= step
+	}
+	return l.Path[len(l.Path)-1], true
+}
+
+// Extent returns the distance in meters from the anchor to the farthest
+// corner of the location's bounds, i.e. how far the geometry can reach from
+// its indexed coordinate.
+func (l *MapLocation) Extent() float64 {
+	anchor, ok := l.Anchor()
+	if !ok {
+		return 0
+	}
+	b, ok := l.Bounds()
+	if !ok {
+		return 0
+	}
+
+	var extent float64
+	for _, c := range []datex.Coordinates{
+		{Lat: b.MinLat, Lon: b.MinLon},
+		{Lat: b.MinLat, Lon: b.MaxLon},
+		{Lat: b.MaxLat, Lon: b.MinLon},
+		{Lat: b.MaxLat, Lon: b.MaxLon},
+	} {
+		extent = math.Max(extent, Haversine(anchor, c))
+	}
+	return extent
+}
+
+// DistanceTo returns the distance in meters from c to the nearest part of the
+// location's point or path. Segments are measured in a local equirectangular
+// projection around c, which is accurate at map-query distances.
+func (l *MapLocation) DistanceTo(c datex.Coordinates) float64 {
+	if l.Point != nil {
+		return Haversine(c, *l.Point)
+	}
+	if len(l.Path) == 0 {
+		return math.Inf(1)
+	}
+	if len(l.Path) == 1 {
+		return Haversine(c, l.Path[0])
+	}
+
+	kx := math.Cos(c.Lat*math.Pi/180) * earthRadiusMeters * math.Pi / 180
+	ky := earthRadiusMeters * math.Pi / 180
+	project := func(p datex.Coordinates) (float64, float64) {
+		return (p.Lon - c.Lon) * kx, (p.Lat - c.Lat) * ky
+	}
+
+	best := math.Inf(1)
+	for i := 1; i < len(l.Path); i++ {
+		ax, ay := project(l.Path[i-1])
+		bx, by := project(l.Path[i])
+		dx, dy := bx-ax, by-ay
+
+		var t float64
+		if lenSq := dx*dx + dy*dy; lenSq > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lenSq))
+		}
+		best = math.Min(best, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+	return best
+}
@@ -0,0 +1,95 @@
+package shared
+
+import "github.com/sverdejot/beacon/pkg/datex"
+
+// Geometry is a GeoJSON geometry. Coordinates are in [lon, lat] order.
+type Geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// Feature is a GeoJSON feature. Geometry is nil, encoded as null, when the
+// feature has no usable location.
+type Feature struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id,omitempty"`
+	Geometry   *Geometry      `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+func NewFeature(id string, geometry *Geometry, properties map[string]any) Feature {
+	if properties == nil {
+		properties = map[string]any{}
+	}
+	return Feature{Type: "Feature", ID: id, Geometry: geometry, Properties: properties}
+}
+
+func NewFeatureCollection(features []Feature) FeatureCollection {
+	if features == nil {
+		features = []Feature{}
+	}
+	return FeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+func PointGeometry(c datex.Coordinates) *Geometry {
+	return &Geometry{Type: "Point", Coordinates: [2]float64{c.Lon, c.Lat}}
+}
+
+// LineStringGeometry returns a LineString for path, a Point when it has a
+// single coordinate, or nil when it is empty.
+func LineStringGeometry(path []datex.Coordinates) *Geometry {
+	switch len(path) {
+	case 0:
+		return nil
+	case 1:
+		return PointGeometry(path[0])
+	}
+	coords := make([][2]float64, len(path))
+	for i, c := range path {
+		coords[i] = [2]float64{c.Lon, c.Lat}
+	}
+	return &Geometry{Type: "LineString", Coordinates: coords}
+}
+
+// Feature converts the location into a Point or LineString feature carrying
+// its attributes as properties.
+func (l *MapLocation) Feature() Feature {
+	var geometry *Geometry
+	if l.Point != nil {
+		geometry = PointGeometry(*l.Point)
+	} else {
+		geometry = LineStringGeometry(l.Path)
+	}
+
+	props := map[string]any{
+		"type":      l.Type,
+		"icon":      l.Icon,
+		"severity":  l.Severity,
+		"eventType": l.EventType,
+	}
+	if l.Province != "" {
+		props["province"] = l.Province
+	}
+	if l.Road != "" {
+		props["road"] = l.Road
+	}
+	if l.Estimated {
+		props["estimated"] = true
+	}
+	if l.Type == "segment" {
+		props["distance"] = l.Distance
+		props["duration"] = l.Duration
+		if l.RouteSource != "" {
+			props["routeSource"] = l.RouteSource
+		}
+		if l.RouteConfidence != nil {
+			props["routeConfidence"] = *l.RouteConfidence
+		}
+	}
+	return NewFeature(l.ID, geometry, props)
+}
@@ -1,6 +1,9 @@
 package shared
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/sverdejot/beacon/internal/routing"
@@ -42,28 +45,107 @@ func GetEmoji(recordType string) string {
 
 type MapLocation struct {
 	ID        string              `json:"id"`
+	Version   int64               `json:"version,omitempty"` // record version, newer ones replace older ones
 	Type      string              `json:"type"`
 	Icon      string              `json:"icon"`
 	Severity  string              `json:"severity,omitempty"`
+	Province  string              `json:"province,omitempty"` // normalized region from the MQTT topic
+	Road      string              `json:"road,omitempty"`     // road number, e.g. "A-6"
 	EventType string              `json:"eventType,omitempty"`
 	Point     *datex.Coordinates  `json:"point,omitempty"`
 	Path      []datex.Coordinates `json:"path,omitempty"`
-	Distance  float64             `json:"distance,omitempty"` // distance in meters (for segments)
-	Duration  float64             `json:"duration,omitempty"` // duration in seconds (for segments)
+	Polylines *routing.Polylines  `json:"polylines,omitempty"` // Path at every detail level, as stored in cache
+	Polyline  string              `json:"polyline,omitempty"`  // Path at the detail a client asked for
+	Distance  float64             `json:"distance,omitempty"`  // distance in meters (for segments)
+	Duration  float64             `json:"duration,omitempty"`  // duration in seconds (for segments)
+
+	// RouteSource is the routing backend that produced a segment's path, or
+	// routing.RouteSourceFallback for a straight line between its endpoints.
+	RouteSource string `json:"routeSource,omitempty"`
+
+	// Expected is the length the publisher declared for a segment, and
+	// RouteConfidence how well its path agrees with it, from 0 to 1.
+	Expected        *routing.Expected `json:"expected,omitempty"`
+	RouteConfidence *float64          `json:"routeConfidence,omitempty"`
+
+	// Estimated is set when coordinates missing from the record were
+	// located from its km markers.
+	Estimated bool `json:"estimated,omitempty"`
+
+	// Snap and ToSnap record how the point, or the segment's start and end,
+	// were moved onto the road network during ingestion.
+	Snap   *Snap `json:"snap,omitempty"`
+	ToSnap *Snap `json:"toSnap,omitempty"`
+}
+
+// Snap is a coordinate moved onto the road network.
+type Snap struct {
+	Original datex.Coordinates `json:"original"` // as published
+	Distance float64           `json:"distance"` // meters between the original and snapped coordinates
+}
+
+// Compact returns a copy of the location for storage, with the segment path
+// kept only as encoded polylines.
+func (l MapLocation) Compact() MapLocation {
+	if len(l.Path) > 0 {
+		if l.Polylines == nil {
+			p := routing.NewPolylines(l.Path)
+			l.Polylines = &p
+		}
+		l.Path = nil
+	}
+	l.Polyline = ""
+	return l
+}
+
+// Expand restores Path from the full-detail polyline of a compacted location.
+func (l *MapLocation) Expand() error {
+	if len(l.Path) > 0 || l.Polylines == nil || l.Polylines.Full == "" {
+		return nil
+	}
+	path, err := routing.DecodePolyline(l.Polylines.Full)
+	if err != nil {
+		return fmt.Errorf("failed to decode path of %s: %w", l.ID, err)
+	}
+	l.Path = path
+	return nil
+}
+
+// AtDetail returns a copy of the location for sending to clients, with the
+// segment path replaced by a single polyline at detail d.
+func (l MapLocation) AtDetail(d routing.Detail) MapLocation {
+	if l.Polylines != nil {
+		l.Polyline = l.Polylines.Get(d)
+	} else if len(l.Path) > 0 {
+		l.Polyline = routing.NewPolylines(l.Path).Get(d)
+	}
+	l.Path = nil
+	l.Polylines = nil
+	return l
 }
 
-// RouteProvider is an interface for services that compute routes between coordinates
+// NearbyLocation is a MapLocation found by a proximity search.
+type NearbyLocation struct {
+	MapLocation
+	Proximity float64 `json:"proximity"` // meters from the search point to the nearest part of the location
+}
+
+// RouteProvider is an interface for services that route incident segments
 type RouteProvider interface {
-	GetRoute(from, to datex.Coordinates) []datex.Coordinates
-	GetRouteWithDistance(from, to datex.Coordinates) routing.RouteResult
+	RouteSegment(ctx context.Context, seg routing.Segment) routing.RouteResult
 }
 
-func RecordToMapLocation(r *datex.Record, rs RouteProvider, recordType string) *MapLocation {
+func RecordToMapLocation(ctx context.Context, r *datex.Record, rs RouteProvider, recordType string) *MapLocation {
 	icon := GetEmoji(recordType)
 	severity := strings.ToLower(r.Severity)
 	if severity == "" {
 		severity = "unknown"
 	}
+	var road datex.RoadInfo
+	if len(r.Location.Roads) > 0 {
+		road = r.Location.Roads[0]
+	}
+	version, _ := strconv.ParseInt(r.Version, 10, 64)
 
 	if r.Location.Linear != nil {
 		from := r.Location.Linear.From.Coordinates
@@ -71,17 +153,28 @@ func RecordToMapLocation(r *datex.Record, rs RouteProvider, recordType string) *
 		if from.Empty() || to.Empty() {
 			return nil
 		}
-		routeResult := rs.GetRouteWithDistance(from, to)
-		return &MapLocation{
+		expected := routing.ExpectedFor(r.Location)
+		routeResult := rs.RouteSegment(ctx, routing.Segment{From: from, To: to, Road: road, Expected: expected})
+		loc := &MapLocation{
 			ID:        r.ID,
+			Version:   version,
 			Type:      "segment",
 			Icon:      icon,
 			Severity:  severity,
+			Road:      road.Number,
 			EventType: recordType,
 			Path:      routeResult.Path,
+			Polylines: &routeResult.Polylines,
 			Distance:  routeResult.Distance,
 			Duration:  routeResult.Duration,
+
+			RouteSource:     routeResult.Source,
+			RouteConfidence: routeResult.Confidence,
+		}
+		if expected.Known() {
+			loc.Expected = &expected
 		}
+		return loc
 	}
 	if r.Location.Point != nil {
 		point := r.Location.Point.Coordinates
@@ -90,9 +183,11 @@ func RecordToMapLocation(r *datex.Record, rs RouteProvider, recordType string) *
 		}
 		return &MapLocation{
 			ID:        r.ID,
+			Version:   version,
 			Type:      "point",
 			Icon:      icon,
 			Severity:  severity,
+			Road:      road.Number,
 			EventType: recordType,
 			Point:     &point,
 		}
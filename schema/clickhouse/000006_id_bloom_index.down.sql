@@ -0,0 +1,2 @@
+ALTER TABLE beacon.traffic_incidents
+    DROP INDEX IF EXISTS idx_id;
@@ -0,0 +1,5 @@
+ALTER TABLE beacon.traffic_incidents
+    ADD INDEX IF NOT EXISTS idx_id id TYPE bloom_filter(0.01) GRANULARITY 4;
+
+ALTER TABLE beacon.traffic_incidents
+    MATERIALIZE INDEX idx_id;
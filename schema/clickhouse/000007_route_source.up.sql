@@ -0,0 +1,2 @@
+ALTER TABLE beacon.traffic_incidents
+    ADD COLUMN IF NOT EXISTS route_source LowCardinality(String) DEFAULT '';
@@ -0,0 +1,7 @@
+ALTER TABLE beacon.traffic_incidents
+    DROP COLUMN IF EXISTS original_lat,
+    DROP COLUMN IF EXISTS original_lon,
+    DROP COLUMN IF EXISTS original_to_lat,
+    DROP COLUMN IF EXISTS original_to_lon,
+    DROP COLUMN IF EXISTS snap_distance,
+    DROP COLUMN IF EXISTS to_snap_distance;
@@ -0,0 +1,7 @@
+ALTER TABLE beacon.traffic_incidents
+    ADD COLUMN IF NOT EXISTS original_lat Float64 DEFAULT lat,
+    ADD COLUMN IF NOT EXISTS original_lon Float64 DEFAULT lon,
+    ADD COLUMN IF NOT EXISTS original_to_lat Float64 DEFAULT to_lat,
+    ADD COLUMN IF NOT EXISTS original_to_lon Float64 DEFAULT to_lon,
+    ADD COLUMN IF NOT EXISTS snap_distance Nullable(Float32),
+    ADD COLUMN IF NOT EXISTS to_snap_distance Nullable(Float32);
@@ -0,0 +1,2 @@
+ALTER TABLE beacon.traffic_incidents
+    DROP COLUMN IF EXISTS route_polyline;
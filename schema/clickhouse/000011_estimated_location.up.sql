@@ -0,0 +1,2 @@
+ALTER TABLE beacon.traffic_incidents
+    ADD COLUMN IF NOT EXISTS estimated_location Bool DEFAULT false;
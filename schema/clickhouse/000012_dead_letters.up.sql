@@ -0,0 +1,13 @@
+-- Messages the ingester could not process, kept for inspection and re-drive.
+-- Re-driving a message inserts a newer row for it with redriven_at set.
+CREATE TABLE IF NOT EXISTS beacon.dead_letters (
+    id String,
+    received_at DateTime64(3),
+    topic String,
+    payload String,
+    error String,
+    redriven_at Nullable(DateTime64(3)),
+    updated_at DateTime64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY id
+TTL toDateTime(received_at) + INTERVAL 3 MONTH;